@@ -6,13 +6,16 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/nais/hunter2/pkg/metrics"
 
+	"github.com/nais/hunter2/pkg/controller"
 	"github.com/nais/hunter2/pkg/google"
 	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/sharding"
 	"github.com/nais/hunter2/pkg/synchronizer"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -20,6 +23,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	kubernetes2 "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 // Configuration options
@@ -27,9 +35,23 @@ const (
 	KubeconfigPath               = "kubeconfig-path"
 	BindAddress                  = "bind-address"
 	Debug                        = "debug"
+	EventNamespace               = "event-namespace"
 	GoogleProjectID              = "google-project-id"
+	GoogleImpersonation          = "google-impersonation"
 	GooglePubsubSubscriptionName = "google-pubsub-subscription-name"
 	ReportInterval               = "report-interval"
+	SopsAgeKeyFile               = "sops-age-key-file"
+	SopsAgeKeySecret             = "sops-age-key-secret"
+	SecretSyncStatus             = "secret-sync-status"
+	SecretPull                   = "secret-pull"
+	SecretPullResync             = "secret-pull-resync"
+	LeaderElection               = "leader-election"
+	LeaderElectionLease          = "leader-election-lease"
+	LeaderElectionNamespace      = "leader-election-namespace"
+	Sharding                     = "sharding"
+	DeletionPolicy               = "deletion-policy"
+	DeletionGracePeriod          = "deletion-grace-period"
+	ReleasePolicy                = "release-policy"
 )
 
 func init() {
@@ -39,10 +61,24 @@ func init() {
 
 	flag.String(BindAddress, "127.0.0.1:8080", "Bind address for application.")
 	flag.Bool(Debug, false, "enables debug logging")
+	flag.String(DeletionPolicy, string(synchronizer.DeletionPolicyImmediate), "What happens to Kubernetes secrets when their Secret Manager secrets are deleted: immediate, delayed or orphan.")
+	flag.Duration(DeletionGracePeriod, synchronizer.DefaultDeletionGracePeriod, "How long to keep Kubernetes secrets before deleting them with the delayed deletion policy")
+	flag.String(EventNamespace, "", "Namespace for events about secrets from projects without a namespace, typically the namespace hunter2 runs in.")
 	flag.String(GoogleProjectID, "", "GCP project ID.")
+	flag.StringToString(GoogleImpersonation, nil, "Service account to impersonate per GCP project ID when accessing Secret Manager, e.g. project-id=sa@project-id.iam.gserviceaccount.com.")
 	flag.String(GooglePubsubSubscriptionName, "", "GCP subscription name for the PubSub topic to consume from.")
+	flag.String(ReleasePolicy, string(synchronizer.ReleasePolicyStale), "What happens to Kubernetes secrets when the sync label is removed from their Secret Manager secrets: stale, delete or orphan.")
+	flag.Bool(LeaderElection, false, "elect a leader among replicas with a Lease, so that only the leader synchronizes secrets")
+	flag.String(LeaderElectionLease, "hunter2", "name of the Lease for leader election, and prefix of the Leases for sharding")
+	flag.String(LeaderElectionNamespace, "", "namespace of the Leases for leader election and sharding, the event namespace if empty")
+	flag.Bool(Sharding, false, "split the projects between all replicas by consistent hashing, instead of electing a leader")
 	flag.String(KubeconfigPath, "", "path to Kubernetes config file")
 	flag.Duration(ReportInterval, 5*time.Minute, "How often to collect number of Kubernetes secrets in cluster")
+	flag.String(SopsAgeKeyFile, "", "path to a file with age identities for decrypting SOPS payloads")
+	flag.String(SopsAgeKeySecret, "", "Kubernetes secret with age identities for decrypting SOPS payloads, as namespace/name")
+	flag.Bool(SecretSyncStatus, true, "maintain a SecretSync resource with the status of every synchronized secret")
+	flag.Bool(SecretPull, false, "synchronize the secrets named by SecretPull resources")
+	flag.Duration(SecretPullResync, 5*time.Minute, "How often to pull the latest versions of the secrets named by SecretPull resources")
 
 	flag.Parse()
 
@@ -55,10 +91,10 @@ func init() {
 func main() {
 	setupLogging()
 
-	stopChan := make(chan struct{}, 1)
+	stop, cancel := context.WithCancel(context.Background())
 
 	go serve(viper.GetString(BindAddress))
-	go handleSigterm(stopChan)
+	go handleSigterm(cancel)
 
 	clientSet, err := kubernetes.NewClient(viper.GetString(KubeconfigPath))
 	if err != nil {
@@ -78,16 +114,102 @@ func main() {
 	if err != nil {
 		log.Fatalf("getting secret manager client: %v", err)
 	}
+	serviceAccounts := synchronizer.NewServiceAccounts(clientSet, viper.GetStringMapString(GoogleImpersonation))
+	secretManagerClient = google.NewImpersonatingSecretManagerClient(ctx, secretManagerClient, serviceAccounts.Resolve)
 
-	syncer := synchronizer.NewSynchronizer(log.NewEntry(log.StandardLogger()), secretManagerClient, clientSet, nil)
+	deletionPolicy, err := synchronizer.ParseDeletionPolicy(viper.GetString(DeletionPolicy))
+	if err != nil {
+		log.Fatalf("%s: %v", DeletionPolicy, err)
+	}
+	releasePolicy, err := synchronizer.ParseReleasePolicy(viper.GetString(ReleasePolicy))
+	if err != nil {
+		log.Fatalf("%s: %v", ReleasePolicy, err)
+	}
+
+	recorder := kubernetes.NewEventRecorder(clientSet)
+	opts := []synchronizer.Option{
+		synchronizer.WithEventRecorder(recorder),
+		synchronizer.WithEventNamespace(viper.GetString(EventNamespace)),
+		synchronizer.WithDeletionPolicy(deletionPolicy, viper.GetDuration(DeletionGracePeriod)),
+		synchronizer.WithReleasePolicy(releasePolicy),
+	}
+	if path := viper.GetString(SopsAgeKeyFile); path != "" {
+		opts = append(opts, synchronizer.WithAgeIdentities(synchronizer.AgeIdentityFile(path)))
+	}
+	if secret := viper.GetString(SopsAgeKeySecret); secret != "" {
+		namespace, name, ok := strings.Cut(secret, "/")
+		if !ok {
+			log.Fatalf("%s must be given as namespace/name", SopsAgeKeySecret)
+		}
+		opts = append(opts, synchronizer.WithAgeIdentities(synchronizer.AgeIdentitySecret(clientSet, namespace, name)))
+	}
+	var dynamicClient dynamic.Interface
+	if viper.GetBool(SecretSyncStatus) || viper.GetBool(SecretPull) {
+		dynamicClient, err = kubernetes.NewDynamicClient(viper.GetString(KubeconfigPath))
+		if err != nil {
+			log.Fatalf("getting kubernetes dynamic client: %v", err)
+		}
+	}
+	if viper.GetBool(SecretSyncStatus) {
+		opts = append(opts, synchronizer.WithStatus(dynamicClient))
+	}
+	var pullController *controller.SecretPullController
+	var membership *sharding.Membership
+	if viper.GetBool(Sharding) {
+		membership = sharding.NewMembership(log.WithField("component", "sharding"), clientSet.CoordinationV1(), leaseNamespace(),
+			viper.GetString(LeaderElectionLease), identity(), 15*time.Second, func([]string) {
+				if pullController != nil {
+					pullController.Requeue()
+				}
+			})
+		opts = append(opts, synchronizer.WithShard(membership))
+	}
+	syncer := synchronizer.NewSynchronizer(log.NewEntry(log.StandardLogger()), secretManagerClient, clientSet, nil, opts...)
 
+	if viper.GetBool(SecretPull) {
+		pullController = controller.NewSecretPullController(log.WithField("controller", kubernetes.SecretPullKind), dynamicClient, syncer, viper.GetDuration(SecretPullResync))
+	}
+
+	lead := func(ctx context.Context) {
+		var running sync.WaitGroup
+		if pullController != nil {
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				pullController.Run(ctx)
+			}()
+		}
+		run(ctx, syncer, pubsubClient)
+		running.Wait()
+	}
+
+	go warmCaches(stop, syncer, serviceAccounts)
+	if membership != nil {
+		runSharded(stop, syncer, membership, lead)
+		return
+	}
+	if !viper.GetBool(LeaderElection) {
+		metrics.Leader.Set(1)
+		lead(stop)
+		return
+	}
+	runLeaderElection(stop, clientSet, lead)
+}
+
+// run synchronizes secrets from Pub/Sub messages and collects garbage until the context is done.
+// The message being synchronized when the context is done is finished first.
+func run(ctx context.Context, syncer *synchronizer.Synchronizer, pubsubClient *google.PubSubClient) {
 	secretCounter := time.NewTicker(1 * time.Second)
+	defer secretCounter.Stop()
 
 	messages := pubsubClient.Consume(ctx)
 	for {
 		select {
 		case msg, ok := <-messages:
 			if !ok {
+				if ctx.Err() != nil {
+					return
+				}
 				log.Errorf("lost connection to pubsub; retrying...")
 				time.Sleep(time.Second * 5)
 				messages = pubsubClient.Consume(ctx)
@@ -103,7 +225,6 @@ func main() {
 			log.Debugf("reporting total number of managed secrets...")
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 			secrets, err := syncer.ManagedSecrets(ctx)
-			cancel()
 
 			secretCounter.Reset(viper.GetDuration(ReportInterval))
 
@@ -111,8 +232,121 @@ func main() {
 				log.Errorf("list managed secrets from cluster: %s", err)
 			} else {
 				metrics.ManagedSecrets.Set(float64(len(secrets)))
+				if err := syncer.CollectGarbage(ctx, secrets); err != nil {
+					log.Errorf("collecting old versions of secrets: %s", err)
+				}
+				if err := syncer.DeleteExpired(ctx, secrets); err != nil {
+					log.Errorf("deleting secrets after the grace period: %s", err)
+				}
 			}
-		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runLeaderElection runs lead while this replica holds the leader Lease, until stop is done. On stop, the leader finishes
+// the message it is synchronizing before releasing the Lease, so that a standby takes over right away. A replica that
+// loses the Lease exits, to restart as a standby.
+func runLeaderElection(stop context.Context, clientSet kubernetes2.Interface, lead func(ctx context.Context)) {
+	identity := identity()
+
+	election, cancelElection := context.WithCancel(context.Background())
+	var leading sync.Mutex
+	go func() {
+		<-stop.Done()
+		leading.Lock()
+		cancelElection()
+	}()
+
+	leaderelection.RunOrDie(election, leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: viper.GetString(LeaderElectionLease), Namespace: leaseNamespace()},
+			Client:     clientSet.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				leading.Lock()
+				defer leading.Unlock()
+
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				defer context.AfterFunc(stop, cancel)()
+
+				log.Infof("%s started leading", identity)
+				metrics.Leader.Set(1)
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s stopped leading", identity)
+				metrics.Leader.Set(0)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("%s is the leader, standing by", leader)
+				}
+			},
+		},
+	})
+
+	if stop.Err() == nil {
+		log.Fatalf("lost leadership, restarting as standby")
+	}
+}
+
+// runSharded runs lead on every replica, each synchronizing the projects in its own shard, until stop is done.
+// The replica leaves the shard group after finishing the message it is synchronizing.
+func runSharded(stop context.Context, syncer *synchronizer.Synchronizer, membership *sharding.Membership, lead func(ctx context.Context)) {
+	member, leave := context.WithCancel(context.Background())
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		membership.Run(member)
+	}()
+
+	lead(stop)
+	leave()
+	<-left
+}
+
+// identity identifies the replica in leader election and sharding, which is the pod name in Kubernetes.
+func identity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("getting hostname to identify replica: %v", err)
+	}
+	return hostname
+}
+
+// leaseNamespace returns the namespace of the Leases for leader election and sharding.
+func leaseNamespace() string {
+	if namespace := viper.GetString(LeaderElectionNamespace); namespace != "" {
+		return namespace
+	}
+	return viper.GetString(EventNamespace)
+}
+
+// warmCaches refreshes the namespaces and service accounts of projects, so that changes to the annotations of namespaces
+// are picked up, and so that a standby is ready to synchronize when it becomes the leader.
+func warmCaches(ctx context.Context, syncer *synchronizer.Synchronizer, serviceAccounts *synchronizer.ServiceAccounts) {
+	ticker := time.NewTicker(viper.GetDuration(ReportInterval))
+	defer ticker.Stop()
+	for {
+		if err := syncer.RefreshProjectNamespaces(ctx); err != nil {
+			log.Warnf("refreshing namespaces of projects: %v", err)
+		}
+		if err := serviceAccounts.Refresh(ctx); err != nil {
+			log.Warnf("refreshing service accounts of projects: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -138,6 +372,10 @@ func serve(address string) {
 	prometheus.MustRegister(metrics.Requests)
 	prometheus.MustRegister(metrics.GoogleSecretManagerResponseTime)
 	prometheus.MustRegister(metrics.ManagedSecrets)
+	prometheus.MustRegister(metrics.Leader)
+	prometheus.MustRegister(metrics.ShardMembers)
+	prometheus.MustRegister(metrics.PendingDeletions)
+	prometheus.MustRegister(metrics.ReleasedSecrets)
 	metrics.InitLabels()
 
 	http.Handle("/metrics", promhttp.Handler())
@@ -146,11 +384,11 @@ func serve(address string) {
 	log.Fatal(http.ListenAndServe(address, nil))
 }
 
-// Handles SIGTERM and exits
-func handleSigterm(stopChan chan struct{}) {
+// Handles SIGTERM and stops synchronizing
+func handleSigterm(cancel context.CancelFunc) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM)
 	<-signals
 	log.Info("received SIGTERM. Terminating...")
-	close(stopChan)
+	cancel()
 }
@@ -0,0 +1,187 @@
+// Package controller reconciles the SecretPull resources, which let namespaces pull Secret Manager secrets from their project.
+package controller
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/sharding"
+)
+
+// Reasons for the Ready condition of a SecretPull.
+const (
+	ReasonPulled  = "Pulled"
+	ReasonFailed  = "Failed"
+	ReasonInvalid = "Invalid"
+)
+
+// Puller synchronizes the secrets named by a SecretPull, returning the status of every secret.
+type Puller interface {
+	Pull(ctx context.Context, pull *kubernetes.SecretPull) ([]kubernetes.SecretPullSourceStatus, error)
+}
+
+// SecretPullController reconciles SecretPull resources when they change, and at every resync to pick up new versions.
+type SecretPullController struct {
+	logger   *log.Entry
+	client   dynamic.Interface
+	puller   Puller
+	informer cache.SharedIndexInformer
+	queue    workqueue.TypedRateLimitingInterface[string]
+	timeout  time.Duration
+}
+
+func NewSecretPullController(logger *log.Entry, client dynamic.Interface, puller Puller, resync time.Duration) *SecretPullController {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resync)
+	controller := &SecretPullController{
+		logger:   logger,
+		client:   client,
+		puller:   puller,
+		informer: factory.ForResource(kubernetes.SecretPullResource).Informer(),
+		queue:    workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+		timeout:  30 * time.Second,
+	}
+
+	enqueue := func(object any) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(object)
+		if err != nil {
+			logger.Errorf("getting key of SecretPull: %v", err)
+			return
+		}
+		controller.queue.Add(key)
+	}
+	_, _ = controller.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, object any) { enqueue(object) },
+	})
+
+	return controller
+}
+
+// Run watches SecretPull resources and reconciles them until the context is done, and the reconciliation in progress has finished.
+func (in *SecretPullController) Run(ctx context.Context) {
+	go in.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), in.informer.HasSynced) {
+		in.queue.ShutDown()
+		in.logger.Errorf("timed out waiting for SecretPull cache to sync")
+		return
+	}
+	in.logger.Info("SecretPull controller started")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for in.processNext(ctx) {
+		}
+	}()
+	<-ctx.Done()
+	in.queue.ShutDown()
+	<-done
+}
+
+// Requeue reconciles all SecretPull resources, e.g. when the shards of the replicas have changed.
+func (in *SecretPullController) Requeue() {
+	for _, key := range in.informer.GetStore().ListKeys() {
+		in.queue.Add(key)
+	}
+}
+
+func (in *SecretPullController) processNext(ctx context.Context) bool {
+	key, shutdown := in.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer in.queue.Done(key)
+
+	reconcileCtx, cancel := context.WithTimeout(ctx, in.timeout)
+	err := in.Reconcile(reconcileCtx, key)
+	cancel()
+	if err != nil {
+		in.logger.Errorf("reconciling SecretPull %s: %v", key, err)
+		in.queue.AddRateLimited(key)
+		return true
+	}
+	in.queue.Forget(key)
+	return true
+}
+
+// Reconcile pulls the secrets named by the SecretPull with the namespace/name key, and records the outcome in its status.
+// Deleted SecretPulls need no reconciliation, as their secrets are garbage collected through their owner references.
+func (in *SecretPullController) Reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	resource := in.client.Resource(kubernetes.SecretPullResource).Namespace(namespace)
+	object, err := resource.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting SecretPull: %w", err)
+	}
+	pull, err := kubernetes.SecretPullFromUnstructured(object)
+	if err != nil {
+		return fmt.Errorf("converting SecretPull: %w", err)
+	}
+
+	statuses, pullErr := in.puller.Pull(ctx, pull)
+	if stderrors.Is(pullErr, sharding.ErrOtherShard) {
+		in.logger.Debugf("SecretPull %s belongs to another shard", key)
+		return nil
+	}
+	pull.Status.Secrets = statuses
+	pull.Status.ObservedGeneration = pull.GetGeneration()
+	var failed []string
+	for _, status := range statuses {
+		if status.Error != "" {
+			failed = append(failed, status.Name)
+		}
+	}
+	switch {
+	case pullErr != nil && statuses == nil:
+		pull.SetCondition(kubernetes.ConditionReady, false, ReasonInvalid, pullErr.Error())
+	case pullErr != nil:
+		pull.SetCondition(kubernetes.ConditionReady, false, ReasonFailed, pullErr.Error())
+	case len(failed) > 0:
+		pull.SetCondition(kubernetes.ConditionReady, false, ReasonFailed, "failed to pull "+strings.Join(failed, ", "))
+	default:
+		pull.SetCondition(kubernetes.ConditionReady, true, ReasonPulled, "")
+	}
+
+	if err := in.updateStatus(ctx, resource, pull); err != nil {
+		return err
+	}
+	// SecretPulls that failed are retried with backoff
+	if pullErr != nil {
+		return pullErr
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to pull %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (in *SecretPullController) updateStatus(ctx context.Context, resource dynamic.ResourceInterface, pull *kubernetes.SecretPull) error {
+	object, err := pull.ToUnstructured()
+	if err != nil {
+		return fmt.Errorf("converting SecretPull: %w", err)
+	}
+	_, err = resource.UpdateStatus(ctx, object, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("updating SecretPull status: %w", err)
+	}
+	return nil
+}
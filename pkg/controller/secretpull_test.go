@@ -0,0 +1,83 @@
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/nais/hunter2/pkg/controller"
+	"github.com/nais/hunter2/pkg/kubernetes"
+)
+
+type puller struct {
+	statuses []kubernetes.SecretPullSourceStatus
+	err      error
+	pulled   []string
+}
+
+func (p *puller) Pull(_ context.Context, pull *kubernetes.SecretPull) ([]kubernetes.SecretPullSourceStatus, error) {
+	p.pulled = append(p.pulled, pull.GetNamespace()+"/"+pull.GetName())
+	return p.statuses, p.err
+}
+
+func TestSecretPullController_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	pull := &kubernetes.SecretPull{
+		TypeMeta:   metav1.TypeMeta{APIVersion: kubernetes.SecretPullResource.GroupVersion().String(), Kind: kubernetes.SecretPullKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "some-app", Namespace: "some-namespace", Generation: 2},
+		Spec:       kubernetes.SecretPullSpec{Secrets: []kubernetes.SecretPullSource{{Name: "database"}, {Name: "api-key"}}},
+	}
+	object, err := pull.ToUnstructured()
+	assert.NoError(t, err)
+	client := dynamicFake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		kubernetes.SecretPullResource: "SecretPullList",
+	}, object)
+	getPull := func() *kubernetes.SecretPull {
+		object, err := client.Resource(kubernetes.SecretPullResource).Namespace("some-namespace").Get(ctx, "some-app", metav1.GetOptions{})
+		assert.NoError(t, err)
+		pull, err := kubernetes.SecretPullFromUnstructured(object)
+		assert.NoError(t, err)
+		return pull
+	}
+
+	p := &puller{statuses: []kubernetes.SecretPullSourceStatus{
+		{Name: "database", AppliedVersion: "3"},
+		{Name: "api-key", Error: "some error"},
+	}}
+	c := controller.NewSecretPullController(log.NewEntry(log.StandardLogger()), client, p, 0)
+
+	err = c.Reconcile(ctx, "some-namespace/some-app")
+	assert.EqualError(t, err, "failed to pull api-key")
+	assert.Equal(t, []string{"some-namespace/some-app"}, p.pulled)
+
+	status := getPull().Status
+	assert.Equal(t, p.statuses, status.Secrets)
+	assert.Equal(t, int64(2), status.ObservedGeneration)
+	assert.Len(t, status.Conditions, 1)
+	assert.Equal(t, kubernetes.ConditionReady, status.Conditions[0].Type)
+	assert.Equal(t, metav1.ConditionFalse, status.Conditions[0].Status)
+	assert.Equal(t, "failed to pull api-key", status.Conditions[0].Message)
+
+	p.statuses = []kubernetes.SecretPullSourceStatus{{Name: "database", AppliedVersion: "3"}, {Name: "api-key", AppliedVersion: "1"}}
+	assert.NoError(t, c.Reconcile(ctx, "some-namespace/some-app"))
+	status = getPull().Status
+	assert.Equal(t, metav1.ConditionTrue, status.Conditions[0].Status)
+	assert.Equal(t, controller.ReasonPulled, status.Conditions[0].Reason)
+
+	p.statuses, p.err = nil, errors.New("namespace some-namespace is not mapped to a Google project")
+	assert.Error(t, c.Reconcile(ctx, "some-namespace/some-app"))
+	status = getPull().Status
+	assert.Equal(t, metav1.ConditionFalse, status.Conditions[0].Status)
+	assert.Equal(t, controller.ReasonInvalid, status.Conditions[0].Reason)
+
+	// deleted SecretPulls are not pulled
+	assert.NoError(t, c.Reconcile(ctx, "some-namespace/other-app"))
+	assert.Len(t, p.pulled, 3)
+}
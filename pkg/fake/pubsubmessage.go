@@ -17,6 +17,10 @@ func (p *pubSubMessageImpl) Ack() {
 	// no-op
 }
 
+func (p *pubSubMessageImpl) Nack() {
+	// no-op
+}
+
 func (p *pubSubMessageImpl) GetPrincipalEmail() string {
 	return p.principalEmail
 }
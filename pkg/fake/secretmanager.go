@@ -4,6 +4,8 @@ import (
 	"context"
 	"github.com/nais/hunter2/pkg/google"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type secretManagerClientImpl struct {
@@ -26,6 +28,94 @@ func (s *secretManagerClientImpl) GetSecretData(context.Context, string, string)
 	return s.data, nil
 }
 
+func (s *secretManagerClientImpl) GetPreviousSecretData(_ context.Context, _, secretName, version string) (string, []byte, error) {
+	if s.err != nil {
+		return "", nil, s.err
+	}
+	return "", nil, status.Errorf(codes.NotFound, "secret %s has no enabled version before %q", secretName, version)
+}
+
+func (s *secretManagerClientImpl) GetSecretVersionData(_ context.Context, _, _, version string) (string, []byte, error) {
+	if s.err != nil {
+		return "", nil, s.err
+	}
+	if version == "latest" {
+		version = "1"
+	}
+	return version, s.data, nil
+}
+
 func NewSecretManagerClient(data []byte, metadata *secretmanagerpb.Secret, err error) google.SecretManagerClient {
 	return &secretManagerClientImpl{data: data, metadata: metadata, err: err}
 }
+
+// Secret is a Secret Manager secret served by the fake client returned from NewSecretManagerClientWithSecrets.
+type Secret struct {
+	Data     []byte
+	Metadata *secretmanagerpb.Secret
+	// Previous holds the data of the previous enabled version by version number, if any.
+	Previous map[string][]byte
+	// Version is the version number of Data, 1 if empty.
+	Version string
+}
+
+type multiSecretManagerClientImpl struct {
+	secrets map[string]Secret
+}
+
+func (s *multiSecretManagerClientImpl) GetSecretMetadata(_ context.Context, _ string, secretName string) (*secretmanagerpb.Secret, error) {
+	secret, ok := s.secrets[secretName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %s not found", secretName)
+	}
+	return secret.Metadata, nil
+}
+
+func (s *multiSecretManagerClientImpl) GetSecretData(_ context.Context, _ string, secretName string) ([]byte, error) {
+	secret, ok := s.secrets[secretName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %s not found", secretName)
+	}
+	return secret.Data, nil
+}
+
+func (s *multiSecretManagerClientImpl) GetPreviousSecretData(_ context.Context, _ string, secretName, version string) (string, []byte, error) {
+	secret, ok := s.secrets[secretName]
+	if !ok {
+		return "", nil, status.Errorf(codes.NotFound, "secret %s not found", secretName)
+	}
+	versions := make([]string, 0, len(secret.Previous))
+	for v := range secret.Previous {
+		versions = append(versions, v)
+	}
+	previous, ok := google.PreviousVersion(version, versions)
+	if !ok {
+		return "", nil, status.Errorf(codes.NotFound, "secret %s has no enabled version before %q", secretName, version)
+	}
+	return previous, secret.Previous[previous], nil
+}
+
+func (s *multiSecretManagerClientImpl) GetSecretVersionData(_ context.Context, _ string, secretName, version string) (string, []byte, error) {
+	secret, ok := s.secrets[secretName]
+	if !ok {
+		return "", nil, status.Errorf(codes.NotFound, "secret %s not found", secretName)
+	}
+	latest := secret.Version
+	if latest == "" {
+		latest = "1"
+	}
+	if version == "latest" || version == latest {
+		return latest, secret.Data, nil
+	}
+	data, ok := secret.Previous[version]
+	if !ok {
+		return "", nil, status.Errorf(codes.NotFound, "secret %s has no version %s", secretName, version)
+	}
+	return version, data, nil
+}
+
+// NewSecretManagerClientWithSecrets returns a client serving the given secrets by name, and NotFound for any other secret.
+// The map may be modified between calls to simulate changes in Secret Manager.
+func NewSecretManagerClientWithSecrets(secrets map[string]Secret) google.SecretManagerClient {
+	return &multiSecretManagerClientImpl{secrets: secrets}
+}
@@ -0,0 +1,101 @@
+package google
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// ServiceAccountResolver returns the service account to impersonate when accessing secrets in the given project.
+// An empty service account means that the ambient credentials should be used.
+type ServiceAccountResolver func(ctx context.Context, projectID string) (string, error)
+
+type impersonatingSecretManagerClient struct {
+	ctx      context.Context
+	fallback SecretManagerClient
+	resolve  ServiceAccountResolver
+	clients  map[string]SecretManagerClient
+	lock     sync.Mutex
+}
+
+// NewImpersonatingSecretManagerClient returns a client that accesses each project as the service account given by resolve,
+// keeping one client per impersonated service account. Projects without a service account are accessed through fallback.
+// The context is used for minting and refreshing the short-lived credentials, and should outlive the client.
+func NewImpersonatingSecretManagerClient(ctx context.Context, fallback SecretManagerClient, resolve ServiceAccountResolver) SecretManagerClient {
+	return &impersonatingSecretManagerClient{
+		ctx:      ctx,
+		fallback: fallback,
+		resolve:  resolve,
+		clients:  make(map[string]SecretManagerClient),
+	}
+}
+
+func (in *impersonatingSecretManagerClient) GetSecretData(ctx context.Context, projectID, secretName string) ([]byte, error) {
+	client, err := in.clientFor(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetSecretData(ctx, projectID, secretName)
+}
+
+func (in *impersonatingSecretManagerClient) GetSecretMetadata(ctx context.Context, projectID, secretName string) (*secretmanagerpb.Secret, error) {
+	client, err := in.clientFor(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetSecretMetadata(ctx, projectID, secretName)
+}
+
+func (in *impersonatingSecretManagerClient) GetPreviousSecretData(ctx context.Context, projectID, secretName, version string) (string, []byte, error) {
+	client, err := in.clientFor(ctx, projectID)
+	if err != nil {
+		return "", nil, err
+	}
+	return client.GetPreviousSecretData(ctx, projectID, secretName, version)
+}
+
+func (in *impersonatingSecretManagerClient) GetSecretVersionData(ctx context.Context, projectID, secretName, version string) (string, []byte, error) {
+	client, err := in.clientFor(ctx, projectID)
+	if err != nil {
+		return "", nil, err
+	}
+	return client.GetSecretVersionData(ctx, projectID, secretName, version)
+}
+
+func (in *impersonatingSecretManagerClient) clientFor(ctx context.Context, projectID string) (SecretManagerClient, error) {
+	serviceAccount, err := in.resolve(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("resolving service account for project %s: %w", projectID, err)
+	}
+	if serviceAccount == "" {
+		return in.fallback, nil
+	}
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	if client, ok := in.clients[serviceAccount]; ok {
+		return client, nil
+	}
+
+	tokenSource, err := impersonate.CredentialsTokenSource(in.ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          secretmanager.DefaultAuthScopes(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("impersonating service account %s: %w", serviceAccount, err)
+	}
+
+	client, err := NewSecretManagerClient(in.ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, err
+	}
+	in.clients[serviceAccount] = client
+
+	return client, nil
+}
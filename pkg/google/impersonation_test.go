@@ -0,0 +1,45 @@
+package google_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+
+	"github.com/nais/hunter2/pkg/fake"
+	"github.com/nais/hunter2/pkg/google"
+)
+
+func TestImpersonatingSecretManagerClient_Fallback(t *testing.T) {
+	ctx := context.Background()
+	metadata := &secretmanagerpb.Secret{Name: "some-secret"}
+	fallback := fake.NewSecretManagerClient([]byte("some-payload"), metadata, nil)
+	resolve := func(context.Context, string) (string, error) {
+		return "", nil
+	}
+
+	client := google.NewImpersonatingSecretManagerClient(ctx, fallback, resolve)
+
+	data, err := client.GetSecretData(ctx, "some-project", "some-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("some-payload"), data)
+
+	actual, err := client.GetSecretMetadata(ctx, "some-project", "some-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, actual)
+}
+
+func TestImpersonatingSecretManagerClient_ResolveError(t *testing.T) {
+	ctx := context.Background()
+	fallback := fake.NewSecretManagerClient([]byte("some-payload"), nil, nil)
+	resolve := func(context.Context, string) (string, error) {
+		return "", fmt.Errorf("some error")
+	}
+
+	client := google.NewImpersonatingSecretManagerClient(ctx, fallback, resolve)
+
+	_, err := client.GetSecretData(ctx, "some-project", "some-secret")
+	assert.Error(t, err)
+}
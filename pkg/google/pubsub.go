@@ -18,6 +18,8 @@ type PubSubClient struct {
 
 type PubSubMessage interface {
 	Ack()
+	// Nack returns the message for redelivery, possibly to another replica.
+	Nack()
 	GetPrincipalEmail() string
 	GetProjectID() string
 	GetSecretName() string
@@ -133,11 +135,16 @@ func (in *PubSubClient) Consume(ctx context.Context) chan PubSubMessage {
 				return
 			}
 
-			messages <- &pubSubMessage{
+			select {
+			case messages <- &pubSubMessage{
 				ProjectID:  projectID,
 				SecretName: secretName,
 				LogMessage: logMessage,
 				Message:    *msg,
+			}:
+			case <-ctx.Done():
+				// no longer consuming, e.g. after losing leadership, so another replica can have the message right away
+				msg.Nack()
 			}
 		})
 
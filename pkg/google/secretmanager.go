@@ -4,23 +4,35 @@ import (
 	"context"
 	"fmt"
 	"github.com/nais/hunter2/pkg/metrics"
+	"path"
+	"strconv"
 	"time"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type SecretManagerClient interface {
 	GetSecretData(ctx context.Context, projectID, secretName string) ([]byte, error)
 	GetSecretMetadata(ctx context.Context, projectID, secretName string) (*secretmanagerpb.Secret, error)
+	// GetPreviousSecretData returns the newest enabled version older than the given version, and its data.
+	// If the version is empty, the version before the latest enabled one is returned. Returns NotFound if there is none.
+	GetPreviousSecretData(ctx context.Context, projectID, secretName, version string) (string, []byte, error)
+	// GetSecretVersionData returns the data of a version, or of the latest version if the version is "latest",
+	// along with the version number.
+	GetSecretVersionData(ctx context.Context, projectID, secretName, version string) (string, []byte, error)
 }
 
 type secretManagerClient struct {
 	*secretmanager.Client
 }
 
-func NewSecretManagerClient(ctx context.Context) (SecretManagerClient, error) {
-	client, err := secretmanager.NewClient(ctx)
+func NewSecretManagerClient(ctx context.Context, opts ...option.ClientOption) (SecretManagerClient, error) {
+	client, err := secretmanager.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("creating secret manager client: %w", err)
 	}
@@ -51,6 +63,79 @@ func (in *secretManagerClient) GetSecretMetadata(ctx context.Context, projectID,
 	return secret, nil
 }
 
+func (in *secretManagerClient) GetPreviousSecretData(ctx context.Context, projectID, secretName, version string) (string, []byte, error) {
+	start := time.Now()
+	defer func() {
+		metrics.GoogleSecretManagerResponseTime.Observe(time.Now().Sub(start).Seconds())
+	}()
+
+	var enabled []string
+	versions := in.ListSecretVersions(ctx, ToListEnabledSecretVersionsRequest(projectID, secretName))
+	for {
+		secretVersion, err := versions.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		enabled = append(enabled, path.Base(secretVersion.GetName()))
+	}
+
+	previous, ok := PreviousVersion(version, enabled)
+	if !ok {
+		return "", nil, status.Errorf(codes.NotFound, "secret %s has no enabled version before %q", secretName, version)
+	}
+
+	result, err := in.AccessSecretVersion(ctx, ToAccessSecretVersionNumberRequest(projectID, secretName, previous))
+	if err != nil {
+		return "", nil, err
+	}
+	return previous, result.Payload.Data, nil
+}
+
+func (in *secretManagerClient) GetSecretVersionData(ctx context.Context, projectID, secretName, version string) (string, []byte, error) {
+	start := time.Now()
+	result, err := in.AccessSecretVersion(ctx, ToAccessSecretVersionNumberRequest(projectID, secretName, version))
+	metrics.GoogleSecretManagerResponseTime.Observe(time.Now().Sub(start).Seconds())
+	if err != nil {
+		return "", nil, err
+	}
+	return path.Base(result.GetName()), result.Payload.Data, nil
+}
+
+// PreviousVersion returns the highest of the enabled version numbers below the given version,
+// or the second highest if the version is empty.
+func PreviousVersion(version string, enabled []string) (string, bool) {
+	current, err := strconv.Atoi(version)
+	if err != nil {
+		current = 0
+	}
+
+	latest, previous := 0, 0
+	for _, v := range enabled {
+		number, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		switch {
+		case current > 0:
+			if number < current && number > previous {
+				previous = number
+			}
+		case number > latest:
+			latest, previous = number, latest
+		case number > previous:
+			previous = number
+		}
+	}
+
+	if previous == 0 {
+		return "", false
+	}
+	return strconv.Itoa(previous), true
+}
+
 func ToAccessSecretVersionRequest(projectID, secretName string) *secretmanagerpb.AccessSecretVersionRequest {
 	name := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", projectID, secretName)
 	return &secretmanagerpb.AccessSecretVersionRequest{
@@ -64,3 +149,18 @@ func ToGetSecretRequest(projectID, secretName string) *secretmanagerpb.GetSecret
 		Name: name,
 	}
 }
+
+func ToAccessSecretVersionNumberRequest(projectID, secretName, version string) *secretmanagerpb.AccessSecretVersionRequest {
+	name := fmt.Sprintf("projects/%s/secrets/%s/versions/%s", projectID, secretName, version)
+	return &secretmanagerpb.AccessSecretVersionRequest{
+		Name: name,
+	}
+}
+
+func ToListEnabledSecretVersionsRequest(projectID, secretName string) *secretmanagerpb.ListSecretVersionsRequest {
+	parent := fmt.Sprintf("projects/%s/secrets/%s", projectID, secretName)
+	return &secretmanagerpb.ListSecretVersionsRequest{
+		Parent: parent,
+		Filter: "state:ENABLED",
+	}
+}
@@ -25,3 +25,29 @@ func TestToGetSecretRequest(t *testing.T) {
 
 	assert.Equal(t, expected, actual.GetName())
 }
+
+func TestPreviousVersion(t *testing.T) {
+	enabled := []string{"7", "5", "2"}
+
+	for version, expected := range map[string]string{
+		"7":  "5",
+		"6":  "5",
+		"5":  "2",
+		"":   "5",
+		"12": "7",
+	} {
+		actual, ok := google.PreviousVersion(version, enabled)
+		assert.True(t, ok)
+		assert.Equal(t, expected, actual, "previous version of %q", version)
+	}
+
+	_, ok := google.PreviousVersion("2", enabled)
+	assert.False(t, ok)
+	_, ok = google.PreviousVersion("", []string{"1"})
+	assert.False(t, ok)
+}
+
+func TestToAccessSecretVersionNumberRequest(t *testing.T) {
+	actual := google.ToAccessSecretVersionNumberRequest("some-project", "some-secret", "3")
+	assert.Equal(t, "projects/some-project/secrets/some-secret/versions/3", actual.GetName())
+}
@@ -2,10 +2,15 @@ package kubernetes
 
 import (
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth" // enables azure/gcp auth; for side effects only
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 func NewClient(kubeconfigPath string) (*kubernetes.Clientset, error) {
@@ -22,6 +27,22 @@ func NewClient(kubeconfigPath string) (*kubernetes.Clientset, error) {
 	return clientSet, err
 }
 
+// NewDynamicClient returns a client for custom resources, such as SecretSync.
+func NewDynamicClient(kubeconfigPath string) (dynamic.Interface, error) {
+	kubeconfig, err := getK8sConfig(kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(kubeconfig)
+}
+
+// NewEventRecorder returns a recorder that publishes events to the cluster as the hunter2 component.
+func NewEventRecorder(clientSet kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: CreatedByValue})
+}
+
 func getK8sConfig(kubeconfig string) (*rest.Config, error) {
 	if kubeconfig == "" {
 		log.Infof("using in-cluster configuration")
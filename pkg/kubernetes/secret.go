@@ -1,20 +1,52 @@
 package kubernetes
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	metav1ac "k8s.io/client-go/applyconfigurations/meta/v1"
 )
 
 const (
 	CreatedBy      = "nais.io/created-by"
 	CreatedByValue = "hunter2"
 
+	// FieldManager is the field manager for server-side apply, which owns the data, labels and annotations set by hunter2.
+	FieldManager = "hunter2"
+
 	LastModifiedBy = "hunter2.nais.io/last-modified-by"
 	LastModified   = "hunter2.nais.io/last-modified"
 	SecretVersion  = "hunter2.nais.io/secret-version"
+	// SecretName is the name of the Secret Manager secret, which is lowercased in the name of the Kubernetes secret.
+	SecretName            = "hunter2.nais.io/secret-name"
+	PreviousSecretVersion = "hunter2.nais.io/previous-secret-version"
+	References            = "hunter2.nais.io/references"
+	Sources               = "hunter2.nais.io/sources"
+	VersionOf             = "hunter2.nais.io/version-of"
+	Retain                = "hunter2.nais.io/retain"
+	Current               = "hunter2.nais.io/current"
+	ContentHash           = "hunter2.nais.io/content-hash"
+	// RemovedSources describes the sources of a merged secret whose keys are kept after they were removed, by name.
+	RemovedSources = "hunter2.nais.io/removed-sources"
+	// DeleteAfter is the time after which a secret whose Secret Manager secret has been deleted is deleted as well.
+	DeleteAfter    = "hunter2.nais.io/delete-after"
+	DeletionReason = "hunter2.nais.io/deletion-reason"
+	// StaleSince is the time from which a secret is no longer synchronized, as the sync label was removed from its
+	// Secret Manager secret.
+	StaleSince = "hunter2.nais.io/stale-since"
+	// Adopt set to true on a secret that is not managed by hunter2 lets hunter2 take it over.
+	Adopt = "hunter2.nais.io/adopt"
+	// AdoptedDataHash is the hash of the type and data a secret had when it was adopted, for audit.
+	AdoptedDataHash = "hunter2.nais.io/adopted-data-hash"
 
 	StakaterReloaderKey = "reloader.stakater.com/match"
 )
@@ -26,6 +58,34 @@ type SecretData struct {
 	LastModified   time.Time
 	LastModifiedBy string
 	SecretVersion  string
+	// SecretName is the name of the Secret Manager secret the secret is synchronized from, if there is a single one.
+	SecretName string
+	// PreviousSecretVersion is the version of the previous values in the payload, if any.
+	PreviousSecretVersion string
+	Type                  corev1.SecretType
+	References            []string
+	// Sources maps the names of the Secret Manager secrets merged into the secret to their versions.
+	Sources map[string]string
+	// RemovedSources are the sources whose keys are kept after they were removed, by name.
+	RemovedSources map[string]RemovedSource
+	// Retain is the number of immutable secrets to keep, one per version, or zero for a single mutable secret.
+	Retain int
+	// PulledBy is the name of the SecretPull the secret is pulled by, if any, which then owns the secret.
+	PulledBy string
+	Owner    *metav1.OwnerReference
+}
+
+// RemovedSource is a Secret Manager secret that is no longer merged into a secret, but whose keys are kept according to
+// the deletion or release policy.
+type RemovedSource struct {
+	// Policy is the deletion or release policy that the keys are kept by.
+	Policy string `json:"policy"`
+	// Reason is why the Secret Manager secret is no longer merged.
+	Reason string `json:"reason"`
+	// Keys are the keys of the merged secret that are kept for the Secret Manager secret.
+	Keys []string `json:"keys"`
+	// DeleteAfter is the time after which the keys are removed, if they are not kept for good.
+	DeleteAfter *time.Time `json:"deleteAfter,omitempty"`
 }
 
 func IsOwned(secret corev1.Secret) bool {
@@ -33,8 +93,112 @@ func IsOwned(secret corev1.Secret) bool {
 	return labels != nil && labels[CreatedBy] == CreatedByValue
 }
 
+// IsAdoptable reports whether the secret is not managed by hunter2, but has opted in to be taken over.
+func IsAdoptable(secret corev1.Secret) bool {
+	return !IsOwned(secret) && secret.GetAnnotations()[Adopt] == "true"
+}
+
+// ReferencesOf returns the names of the Secret Manager secrets that the secret was built from, in addition to its own.
+func ReferencesOf(secret corev1.Secret) []string {
+	references := secret.GetAnnotations()[References]
+	if references == "" {
+		return nil
+	}
+	return strings.Split(references, ",")
+}
+
+// SecretNameOf returns the name of the Secret Manager secret the secret is synchronized from. Secrets written before the
+// name was recorded fall back to their own name.
+func SecretNameOf(secret corev1.Secret) string {
+	if name := secret.GetAnnotations()[SecretName]; name != "" {
+		return name
+	}
+	return secret.GetName()
+}
+
+// SourcesOf returns the names and versions of the Secret Manager secrets merged into the secret.
+// Secrets synchronized from a single Secret Manager secret have no sources.
+func SourcesOf(secret corev1.Secret) map[string]string {
+	sources := make(map[string]string)
+	for _, source := range strings.Split(secret.GetAnnotations()[Sources], ",") {
+		name, version, _ := strings.Cut(source, "=")
+		if name != "" {
+			sources[name] = version
+		}
+	}
+	return sources
+}
+
+// RemovedSourcesOf returns the sources of a merged secret whose keys are kept after they were removed, by name.
+func RemovedSourcesOf(secret corev1.Secret) map[string]RemovedSource {
+	removed := make(map[string]RemovedSource)
+	if value, ok := secret.GetAnnotations()[RemovedSources]; ok {
+		// sources that cannot be read are removed on the next merge
+		_ = json.Unmarshal([]byte(value), &removed)
+	}
+	return removed
+}
+
+// VersionedName returns the name of the immutable secret for a version of a secret.
+func VersionedName(name, version string) string {
+	return fmt.Sprintf("%s-v%s", strings.ToLower(name), version)
+}
+
+// IsVersioned reports whether the secret is an immutable secret for a single version, and returns the name of the secret it is a version of.
+func IsVersioned(secret corev1.Secret) (string, bool) {
+	name, ok := secret.GetAnnotations()[VersionOf]
+	return name, ok
+}
+
+// PendingDeletion returns the time after which the secret is deleted, if its deletion is pending.
+func PendingDeletion(secret corev1.Secret) (time.Time, bool) {
+	deleteAfter, ok := secret.GetAnnotations()[DeleteAfter]
+	if !ok {
+		return time.Time{}, false
+	}
+	deadline, err := time.Parse(time.RFC3339, deleteAfter)
+	return deadline, err == nil
+}
+
+// OpaqueSecret returns the secret for the data, of type Opaque unless another type is given.
 func OpaqueSecret(data SecretData) *corev1.Secret {
-	return &corev1.Secret{
+	secretType := data.Type
+	if secretType == "" {
+		secretType = corev1.SecretTypeOpaque
+	}
+
+	annotations := map[string]string{
+		LastModified:        data.LastModified.Format(time.RFC3339),
+		LastModifiedBy:      data.LastModifiedBy,
+		StakaterReloaderKey: "true",
+	}
+	if data.SecretVersion != "" {
+		annotations[SecretVersion] = data.SecretVersion
+	}
+	if data.SecretName != "" {
+		annotations[SecretName] = data.SecretName
+	}
+	if data.PreviousSecretVersion != "" {
+		annotations[PreviousSecretVersion] = data.PreviousSecretVersion
+	}
+	if len(data.References) > 0 {
+		annotations[References] = strings.Join(data.References, ",")
+	}
+	if len(data.Sources) > 0 {
+		sources := make([]string, 0, len(data.Sources))
+		for name, version := range data.Sources {
+			sources = append(sources, name+"="+version)
+		}
+		sort.Strings(sources)
+		annotations[Sources] = strings.Join(sources, ",")
+	}
+	if len(data.RemovedSources) > 0 {
+		// maps are marshalled with sorted keys
+		removed, _ := json.Marshal(data.RemovedSources)
+		annotations[RemovedSources] = string(removed)
+	}
+
+	secret := &corev1.Secret{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Secret",
 			APIVersion: "v1",
@@ -45,14 +209,113 @@ func OpaqueSecret(data SecretData) *corev1.Secret {
 			Labels: map[string]string{
 				CreatedBy: CreatedByValue,
 			},
-			Annotations: map[string]string{
-				LastModified:        data.LastModified.Format(time.RFC3339),
-				LastModifiedBy:      data.LastModifiedBy,
-				SecretVersion:       data.SecretVersion,
-				StakaterReloaderKey: "true",
-			},
+			Annotations: annotations,
 		},
 		Data: data.Payload,
-		Type: corev1.SecretTypeOpaque,
+		Type: secretType,
+	}
+
+	if data.PulledBy != "" {
+		annotations[PulledBy] = data.PulledBy
+	}
+	if data.Owner != nil {
+		secret.OwnerReferences = []metav1.OwnerReference{*data.Owner}
+	}
+
+	if data.Retain > 0 {
+		immutable := true
+		secret.Name = VersionedName(data.Name, data.SecretVersion)
+		secret.Immutable = &immutable
+		secret.Labels[Current] = "true"
+		annotations[VersionOf] = strings.ToLower(data.Name)
+		annotations[Retain] = strconv.Itoa(data.Retain)
+	}
+
+	annotations[ContentHash] = contentHash(secret, secret)
+	return secret
+}
+
+// Unchanged reports whether the existing secret already has the contents of the desired secret, so that writing it can be skipped.
+// The content hash annotation of the existing secret must match, and the fields set by hunter2 must not have been changed since.
+func Unchanged(existing, desired *corev1.Secret) bool {
+	hash := desired.GetAnnotations()[ContentHash]
+	return hash != "" && existing.GetAnnotations()[ContentHash] == hash && contentHash(existing, desired) == hash
+}
+
+// contentHash returns a hash over the type of the secret and the data, labels and annotations with the keys set in fields,
+// except for the annotations describing the last write.
+func contentHash(secret, fields *corev1.Secret) string {
+	hash := sha256.New()
+	write := func(values ...string) {
+		for _, value := range values {
+			fmt.Fprintf(hash, "%d:%s", len(value), value)
+		}
+	}
+
+	write(string(secret.Type), strconv.FormatBool(secret.Immutable != nil && *secret.Immutable))
+	for _, key := range sortedKeys(fields.Data) {
+		value, ok := secret.Data[key]
+		write("data", key, strconv.FormatBool(ok), string(value))
+	}
+	for _, key := range sortedKeys(fields.GetLabels()) {
+		value, ok := secret.GetLabels()[key]
+		write("label", key, strconv.FormatBool(ok), value)
+	}
+	for _, key := range sortedKeys(fields.GetAnnotations()) {
+		switch key {
+		case LastModified, LastModifiedBy, ContentHash:
+			continue
+		}
+		value, ok := secret.GetAnnotations()[key]
+		write("annotation", key, strconv.FormatBool(ok), value)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// DataHash returns a hash over the type and data of the secret.
+func DataHash(secret corev1.Secret) string {
+	hash := sha256.New()
+	write := func(values ...string) {
+		for _, value := range values {
+			fmt.Fprintf(hash, "%d:%s", len(value), value)
+		}
+	}
+
+	write(string(secret.Type))
+	for _, key := range sortedKeys(secret.Data) {
+		write(key, string(secret.Data[key]))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ApplyConfiguration returns the fields of the secret that hunter2 manages, for server-side apply.
+func ApplyConfiguration(secret *corev1.Secret) *corev1ac.SecretApplyConfiguration {
+	configuration := corev1ac.Secret(secret.GetName(), secret.GetNamespace()).
+		WithLabels(secret.GetLabels()).
+		WithAnnotations(secret.GetAnnotations()).
+		WithType(secret.Type).
+		WithData(secret.Data)
+	if secret.Immutable != nil {
+		configuration.WithImmutable(*secret.Immutable)
+	}
+	for _, owner := range secret.GetOwnerReferences() {
+		configuration.WithOwnerReferences(metav1ac.OwnerReference().
+			WithAPIVersion(owner.APIVersion).
+			WithKind(owner.Kind).
+			WithName(owner.Name).
+			WithUID(owner.UID).
+			WithController(owner.Controller != nil && *owner.Controller).
+			WithBlockOwnerDeletion(owner.BlockOwnerDeletion != nil && *owner.BlockOwnerDeletion))
 	}
+	return configuration
 }
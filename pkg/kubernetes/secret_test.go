@@ -6,6 +6,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/nais/hunter2/pkg/kubernetes"
 )
@@ -37,7 +38,9 @@ func TestOpaqueSecret(t *testing.T) {
 		kubernetes.LastModifiedBy:      secretData.LastModifiedBy,
 		kubernetes.SecretVersion:       secretData.SecretVersion,
 		kubernetes.StakaterReloaderKey: "true",
+		kubernetes.ContentHash:         secret.GetAnnotations()[kubernetes.ContentHash],
 	}, secret.GetAnnotations())
+	assert.Len(t, secret.GetAnnotations()[kubernetes.ContentHash], 64)
 	assert.Equal(t, secretData.Payload, secret.Data)
 
 	secretDataUppercase := secretData
@@ -54,3 +57,129 @@ func TestIsOwned(t *testing.T) {
 	assert.True(t, kubernetes.IsOwned(*ownedSecret))
 	assert.False(t, kubernetes.IsOwned(*nonOwnedSecret))
 }
+
+func TestOpaqueSecret_References(t *testing.T) {
+	secretDataWithReferences := secretData
+	secretDataWithReferences.References = []string{"other-secret", "template"}
+
+	secret := kubernetes.OpaqueSecret(secretDataWithReferences)
+	assert.Equal(t, "other-secret,template", secret.GetAnnotations()[kubernetes.References])
+	assert.Equal(t, []string{"other-secret", "template"}, kubernetes.ReferencesOf(*secret))
+
+	assert.Empty(t, kubernetes.ReferencesOf(*kubernetes.OpaqueSecret(secretData)))
+}
+
+func TestOpaqueSecret_Sources(t *testing.T) {
+	mergedSecretData := secretData
+	mergedSecretData.SecretVersion = ""
+	mergedSecretData.Sources = map[string]string{"database": "3", "api-key": "12"}
+
+	secret := kubernetes.OpaqueSecret(mergedSecretData)
+	assert.Equal(t, "api-key=12,database=3", secret.GetAnnotations()[kubernetes.Sources])
+	assert.NotContains(t, secret.GetAnnotations(), kubernetes.SecretVersion)
+	assert.Equal(t, mergedSecretData.Sources, kubernetes.SourcesOf(*secret))
+
+	assert.Empty(t, kubernetes.SourcesOf(*kubernetes.OpaqueSecret(secretData)))
+}
+
+func TestOpaqueSecret_RemovedSources(t *testing.T) {
+	deleteAfter := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mergedSecretData := secretData
+	mergedSecretData.SecretVersion = ""
+	mergedSecretData.Sources = map[string]string{"database": "3", "api-key": "12"}
+	mergedSecretData.RemovedSources = map[string]kubernetes.RemovedSource{
+		"api-key": {Policy: "delayed", Reason: "the Secret Manager secret has been deleted", Keys: []string{"API_KEY"}, DeleteAfter: &deleteAfter},
+	}
+
+	secret := kubernetes.OpaqueSecret(mergedSecretData)
+	assert.Equal(t, `{"api-key":{"policy":"delayed","reason":"the Secret Manager secret has been deleted","keys":["API_KEY"],"deleteAfter":"2024-01-02T03:04:05Z"}}`,
+		secret.GetAnnotations()[kubernetes.RemovedSources])
+	assert.Equal(t, mergedSecretData.RemovedSources, kubernetes.RemovedSourcesOf(*secret))
+
+	assert.Empty(t, kubernetes.RemovedSourcesOf(*kubernetes.OpaqueSecret(secretData)))
+}
+
+func TestOpaqueSecret_Versioned(t *testing.T) {
+	versionedSecretData := secretData
+	versionedSecretData.Name = "Some-Name"
+	versionedSecretData.Retain = 3
+
+	secret := kubernetes.OpaqueSecret(versionedSecretData)
+	assert.Equal(t, "some-name-v1", secret.Name)
+	assert.True(t, *secret.Immutable)
+	assert.Equal(t, "true", secret.GetLabels()[kubernetes.Current])
+	assert.Equal(t, "3", secret.GetAnnotations()[kubernetes.Retain])
+
+	name, ok := kubernetes.IsVersioned(*secret)
+	assert.True(t, ok)
+	assert.Equal(t, "some-name", name)
+
+	_, ok = kubernetes.IsVersioned(*kubernetes.OpaqueSecret(secretData))
+	assert.False(t, ok)
+}
+
+func TestUnchanged(t *testing.T) {
+	desired := kubernetes.OpaqueSecret(secretData)
+
+	rewritten := secretData
+	rewritten.LastModified = secretData.LastModified.Add(time.Hour)
+	rewritten.LastModifiedBy = "someone-else@some-domain.test"
+	existing := kubernetes.OpaqueSecret(rewritten)
+	existing.Labels["team"] = "some-team"
+	existing.Annotations["example.com/owner"] = "someone"
+	assert.True(t, kubernetes.Unchanged(existing, desired))
+
+	newVersion := secretData
+	newVersion.SecretVersion = "2"
+	assert.False(t, kubernetes.Unchanged(existing, kubernetes.OpaqueSecret(newVersion)))
+
+	newPayload := secretData
+	newPayload.Payload = map[string][]byte{"some-key": []byte("other-value")}
+	assert.False(t, kubernetes.Unchanged(existing, kubernetes.OpaqueSecret(newPayload)))
+
+	edited := existing.DeepCopy()
+	edited.Data = map[string][]byte{"some-key": []byte("edited")}
+	assert.False(t, kubernetes.Unchanged(edited, desired))
+
+	unhashed := existing.DeepCopy()
+	delete(unhashed.Annotations, kubernetes.ContentHash)
+	assert.False(t, kubernetes.Unchanged(unhashed, desired))
+}
+
+func TestPendingDeletion(t *testing.T) {
+	secret := kubernetes.OpaqueSecret(secretData)
+	_, pending := kubernetes.PendingDeletion(*secret)
+	assert.False(t, pending)
+
+	secret.Annotations[kubernetes.DeleteAfter] = "2024-01-02T03:04:05Z"
+	deleteAfter, pending := kubernetes.PendingDeletion(*secret)
+	assert.True(t, pending)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), deleteAfter)
+
+	secret.Annotations[kubernetes.DeleteAfter] = "tomorrow"
+	_, pending = kubernetes.PendingDeletion(*secret)
+	assert.False(t, pending)
+}
+
+func TestIsAdoptable(t *testing.T) {
+	ownedSecret := kubernetes.OpaqueSecret(secretData)
+	ownedSecret.Annotations[kubernetes.Adopt] = "true"
+	handmade := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "handmade"}}
+
+	assert.False(t, kubernetes.IsAdoptable(*ownedSecret))
+	assert.False(t, kubernetes.IsAdoptable(*handmade))
+	handmade.SetAnnotations(map[string]string{kubernetes.Adopt: "true"})
+	assert.True(t, kubernetes.IsAdoptable(*handmade))
+}
+
+func TestDataHash(t *testing.T) {
+	secret := corev1.Secret{Type: corev1.SecretTypeOpaque, Data: map[string][]byte{"a": []byte("b"), "c": []byte("d")}}
+	hash := kubernetes.DataHash(secret)
+	assert.Len(t, hash, 64)
+
+	secret.Data = map[string][]byte{"a": []byte("bc"), "": []byte("d")}
+	assert.NotEqual(t, hash, kubernetes.DataHash(secret))
+	secret.Data = map[string][]byte{"a": []byte("b"), "c": []byte("d")}
+	secret.Type = corev1.SecretTypeBasicAuth
+	assert.NotEqual(t, hash, kubernetes.DataHash(secret))
+}
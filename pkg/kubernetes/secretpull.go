@@ -0,0 +1,94 @@
+package kubernetes
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SecretPullResource is the custom resource naming the Secret Manager secrets a namespace pulls,
+// as defined in charts/crds/secretpull.yaml.
+var SecretPullResource = schema.GroupVersionResource{Group: "hunter2.nais.io", Version: "v1alpha1", Resource: "secretpulls"}
+
+const SecretPullKind = "SecretPull"
+
+// PulledBy is the annotation with the name of the SecretPull a secret is pulled by.
+const PulledBy = "hunter2.nais.io/pulled-by"
+
+// ConditionReady is true when all secrets of a SecretPull are synchronized.
+const ConditionReady = "Ready"
+
+type SecretPull struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SecretPullSpec   `json:"spec"`
+	Status SecretPullStatus `json:"status,omitempty"`
+}
+
+type SecretPullSpec struct {
+	Secrets []SecretPullSource `json:"secrets"`
+}
+
+// SecretPullSource is a Secret Manager secret in the project of the namespace, synchronized to a Kubernetes secret with
+// the same name. The labels of the Secret Manager secret apply as in push mode, except for the settings given here.
+type SecretPullSource struct {
+	// Name is the name of the Secret Manager secret, or its resource name as projects/<project>/secrets/<name>.
+	Name string `json:"name"`
+	// Version is the version number to pull, or latest if empty.
+	Version string `json:"version,omitempty"`
+	// Format is the format of the payload, overriding the format label.
+	Format string `json:"format,omitempty"`
+	// Keys renames keys of the payload, from the old to the new name, replacing the hunter2-rename annotation.
+	Keys map[string]string `json:"keys,omitempty"`
+}
+
+type SecretPullStatus struct {
+	Secrets            []SecretPullSourceStatus `json:"secrets,omitempty"`
+	Conditions         []metav1.Condition       `json:"conditions,omitempty"`
+	ObservedGeneration int64                    `json:"observedGeneration,omitempty"`
+}
+
+type SecretPullSourceStatus struct {
+	Name string `json:"name"`
+	// AppliedVersion is the version of the Secret Manager secret in the Kubernetes secret.
+	AppliedVersion string `json:"appliedVersion,omitempty"`
+	// Error is the error of the last sync, if it failed. It never contains secret values.
+	Error string `json:"error,omitempty"`
+}
+
+// OwnerReference returns a reference to the SecretPull, for the secrets pulled by it.
+func (in *SecretPull) OwnerReference() metav1.OwnerReference {
+	return *metav1.NewControllerRef(in, SecretPullResource.GroupVersion().WithKind(SecretPullKind))
+}
+
+// SetCondition sets a condition of the SecretPull, keeping its last transition time unless the status changes.
+func (in *SecretPull) SetCondition(conditionType string, status bool, reason, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if status {
+		conditionStatus = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&in.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: in.GetGeneration(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+func (in *SecretPull) ToUnstructured() (*unstructured.Unstructured, error) {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(in)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+func SecretPullFromUnstructured(object *unstructured.Unstructured) (*SecretPull, error) {
+	secretPull := &SecretPull{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), secretPull)
+	return secretPull, err
+}
@@ -0,0 +1,104 @@
+package kubernetes
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SecretSyncResource is the custom resource with the status of a Secret Manager secret synchronized by hunter2,
+// as defined in charts/crds/secretsync.yaml.
+var SecretSyncResource = schema.GroupVersionResource{Group: "hunter2.nais.io", Version: "v1alpha1", Resource: "secretsyncs"}
+
+const SecretSyncKind = "SecretSync"
+
+// Conditions of a SecretSync.
+const (
+	// ConditionSynced is true when the last sync succeeded.
+	ConditionSynced = "Synced"
+	// ConditionValid is true when the last version of the Secret Manager secret could be synchronized.
+	ConditionValid = "Valid"
+	// ConditionStale is true when the Kubernetes secret does not have the last version of the Secret Manager secret.
+	ConditionStale = "Stale"
+)
+
+type SecretSync struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SecretSyncSpec   `json:"spec"`
+	Status SecretSyncStatus `json:"status,omitempty"`
+}
+
+type SecretSyncSpec struct {
+	// ProjectID is the Google project of the Secret Manager secret.
+	ProjectID string `json:"projectID"`
+	// SecretName is the name of the Secret Manager secret.
+	SecretName string `json:"secretName"`
+	// Target is the name of the Kubernetes secret the Secret Manager secret is synchronized to.
+	Target string `json:"target"`
+}
+
+type SecretSyncStatus struct {
+	// AppliedVersion is the version of the Secret Manager secret in the Kubernetes secret.
+	AppliedVersion string `json:"appliedVersion,omitempty"`
+	// LastVersion is the last version of the Secret Manager secret that hunter2 has seen.
+	LastVersion   string       `json:"lastVersion,omitempty"`
+	LastSyncTime  *metav1.Time `json:"lastSyncTime,omitempty"`
+	LastPrincipal string       `json:"lastPrincipal,omitempty"`
+	// LastError is the error of the last sync, if it failed. It never contains secret values.
+	LastError          string             `json:"lastError,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+}
+
+// NewSecretSync returns a SecretSync for a Secret Manager secret, with the same name as the Secret Manager secret.
+func NewSecretSync(namespace string, spec SecretSyncSpec) *SecretSync {
+	return &SecretSync{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       SecretSyncKind,
+			APIVersion: SecretSyncResource.GroupVersion().String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      strings.ToLower(spec.SecretName),
+			Namespace: namespace,
+			Labels: map[string]string{
+				CreatedBy: CreatedByValue,
+			},
+		},
+		Spec: spec,
+	}
+}
+
+// SetCondition sets a condition of the SecretSync, keeping its last transition time unless the status changes.
+func (in *SecretSync) SetCondition(conditionType string, status bool, reason, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if status {
+		conditionStatus = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&in.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: in.GetGeneration(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+func (in *SecretSync) ToUnstructured() (*unstructured.Unstructured, error) {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(in)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+func SecretSyncFromUnstructured(object *unstructured.Unstructured) (*SecretSync, error) {
+	secretSync := &SecretSync{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), secretSync)
+	return secretSync, err
+}
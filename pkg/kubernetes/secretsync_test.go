@@ -0,0 +1,39 @@
+package kubernetes_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nais/hunter2/pkg/kubernetes"
+)
+
+func TestSecretSync(t *testing.T) {
+	secretSync := kubernetes.NewSecretSync("some-namespace", kubernetes.SecretSyncSpec{
+		ProjectID:  "some-project",
+		SecretName: "Some-Secret",
+		Target:     "some-secret",
+	})
+	assert.Equal(t, "some-secret", secretSync.GetName())
+	assert.Equal(t, "hunter2.nais.io/v1alpha1", secretSync.APIVersion)
+	assert.Equal(t, map[string]string{kubernetes.CreatedBy: kubernetes.CreatedByValue}, secretSync.GetLabels())
+
+	secretSync.SetCondition(kubernetes.ConditionSynced, true, "Synchronized", "")
+	transition := secretSync.Status.Conditions[0].LastTransitionTime
+	secretSync.SetCondition(kubernetes.ConditionSynced, true, "Synchronized", "")
+	assert.Equal(t, transition, secretSync.Status.Conditions[0].LastTransitionTime)
+	secretSync.SetCondition(kubernetes.ConditionSynced, false, "Failed", "some error")
+	assert.Equal(t, metav1.ConditionFalse, secretSync.Status.Conditions[0].Status)
+	assert.Len(t, secretSync.Status.Conditions, 1)
+
+	object, err := secretSync.ToUnstructured()
+	assert.NoError(t, err)
+	assert.Equal(t, "SecretSync", object.GetKind())
+	assert.Equal(t, "some-project", object.Object["spec"].(map[string]any)["projectID"])
+
+	roundtrip, err := kubernetes.SecretSyncFromUnstructured(object)
+	assert.NoError(t, err)
+	assert.Equal(t, secretSync.Spec, roundtrip.Spec)
+	assert.Equal(t, "some error", roundtrip.Status.Conditions[0].Message)
+}
@@ -0,0 +1,153 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+// secretTypes maps the values of the type label to Kubernetes secret types.
+// Label values cannot contain slashes or dots, so the Kubernetes names cannot be used directly.
+var secretTypes = map[string]corev1.SecretType{
+	"opaque":           corev1.SecretTypeOpaque,
+	"tls":              corev1.SecretTypeTLS,
+	"dockerconfigjson": corev1.SecretTypeDockerConfigJson,
+	"basic-auth":       corev1.SecretTypeBasicAuth,
+	"ssh-auth":         corev1.SecretTypeSSHAuth,
+}
+
+// ParseSecretType returns the Kubernetes secret type for a type label value. An empty value means Opaque.
+func ParseSecretType(value string) (corev1.SecretType, error) {
+	if value == "" {
+		return corev1.SecretTypeOpaque, nil
+	}
+	secretType, ok := secretTypes[value]
+	if !ok {
+		values := make([]string, 0, len(secretTypes))
+		for v := range secretTypes {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		return "", fmt.Errorf("unsupported secret type %q, must be one of: %s", value, strings.Join(values, ", "))
+	}
+	return secretType, nil
+}
+
+// TypedPayload converts a payload to the keys required by the secret type, and validates their contents.
+// Payloads that already contain the required keys are validated as-is. Payloads with a single key are
+// treated as the source for the required keys, e.g. a PEM bundle that is split into tls.crt and tls.key.
+// Error messages never contain payload data.
+func TypedPayload(secretType corev1.SecretType, payload map[string][]byte) (map[string][]byte, error) {
+	switch secretType {
+	case corev1.SecretTypeOpaque, "":
+		return payload, nil
+	case corev1.SecretTypeTLS:
+		return tlsPayload(payload)
+	case corev1.SecretTypeDockerConfigJson:
+		return dockerConfigJSONPayload(payload)
+	case corev1.SecretTypeBasicAuth:
+		return basicAuthPayload(payload)
+	case corev1.SecretTypeSSHAuth:
+		return sshAuthPayload(payload)
+	default:
+		return nil, fmt.Errorf("unsupported secret type %q", secretType)
+	}
+}
+
+func tlsPayload(data map[string][]byte) (map[string][]byte, error) {
+	_, hasCert := data[corev1.TLSCertKey]
+	_, hasKey := data[corev1.TLSPrivateKeyKey]
+	if !hasCert || !hasKey {
+		bundle, ok := singleValue(data)
+		if !ok {
+			return nil, fmt.Errorf("%s secrets need either the %s and %s keys, or a single PEM bundle", corev1.SecretTypeTLS, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		}
+		cert, key, err := payload.SplitPEMBundle(bundle)
+		if err != nil {
+			return nil, err
+		}
+		data = map[string][]byte{
+			corev1.TLSCertKey:       cert,
+			corev1.TLSPrivateKeyKey: key,
+		}
+	}
+
+	if _, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]); err != nil {
+		return nil, fmt.Errorf("invalid certificate and key pair: %w", err)
+	}
+
+	return data, nil
+}
+
+func dockerConfigJSONPayload(payload map[string][]byte) (map[string][]byte, error) {
+	config, ok := payload[corev1.DockerConfigJsonKey]
+	if !ok {
+		config, ok = singleValue(payload)
+		if !ok {
+			return nil, fmt.Errorf("%s secrets need either the %s key, or a single Docker config", corev1.SecretTypeDockerConfigJson, corev1.DockerConfigJsonKey)
+		}
+		payload = map[string][]byte{
+			corev1.DockerConfigJsonKey: config,
+		}
+	}
+
+	var dockerConfig struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(config, &dockerConfig); err != nil {
+		return nil, fmt.Errorf("invalid Docker config: not a JSON object with an auths map")
+	}
+	if len(dockerConfig.Auths) == 0 {
+		return nil, fmt.Errorf("invalid Docker config: no registries in auths")
+	}
+
+	return payload, nil
+}
+
+func basicAuthPayload(payload map[string][]byte) (map[string][]byte, error) {
+	_, hasUsername := payload[corev1.BasicAuthUsernameKey]
+	_, hasPassword := payload[corev1.BasicAuthPasswordKey]
+	if !hasUsername && !hasPassword {
+		return nil, fmt.Errorf("%s secrets need a %s or %s key", corev1.SecretTypeBasicAuth, corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)
+	}
+	return payload, nil
+}
+
+func sshAuthPayload(payload map[string][]byte) (map[string][]byte, error) {
+	key, ok := payload[corev1.SSHAuthPrivateKey]
+	if !ok {
+		key, ok = singleValue(payload)
+		if !ok {
+			return nil, fmt.Errorf("%s secrets need either the %s key, or a single private key", corev1.SecretTypeSSHAuth, corev1.SSHAuthPrivateKey)
+		}
+		payload = map[string][]byte{
+			corev1.SSHAuthPrivateKey: key,
+		}
+	}
+
+	// passphrase protected keys are valid, but cannot be inspected further
+	var passphraseMissing *ssh.PassphraseMissingError
+	if _, err := ssh.ParseRawPrivateKey(key); err != nil && !errors.As(err, &passphraseMissing) {
+		return nil, fmt.Errorf("invalid SSH private key: %w", err)
+	}
+
+	return payload, nil
+}
+
+func singleValue(payload map[string][]byte) ([]byte, bool) {
+	if len(payload) != 1 {
+		return nil, false
+	}
+	for _, value := range payload {
+		return value, true
+	}
+	return nil, false
+}
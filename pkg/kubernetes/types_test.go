@@ -0,0 +1,133 @@
+package kubernetes_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/nais/hunter2/pkg/kubernetes"
+)
+
+func certificateAndKey(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "some-host"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestParseSecretType(t *testing.T) {
+	secretType, err := kubernetes.ParseSecretType("")
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeOpaque, secretType)
+
+	secretType, err = kubernetes.ParseSecretType("dockerconfigjson")
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeDockerConfigJson, secretType)
+
+	_, err = kubernetes.ParseSecretType("kubernetes.io/tls")
+	assert.EqualError(t, err, `unsupported secret type "kubernetes.io/tls", must be one of: basic-auth, dockerconfigjson, opaque, ssh-auth, tls`)
+}
+
+func TestTypedPayload_TLS(t *testing.T) {
+	cert, key := certificateAndKey(t)
+
+	payload, err := kubernetes.TypedPayload(corev1.SecretTypeTLS, map[string][]byte{
+		"secret": append(append([]byte{}, key...), cert...),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		corev1.TLSCertKey:       cert,
+		corev1.TLSPrivateKeyKey: key,
+	}, payload)
+
+	payload, err = kubernetes.TypedPayload(corev1.SecretTypeTLS, map[string][]byte{
+		corev1.TLSCertKey:       cert,
+		corev1.TLSPrivateKeyKey: key,
+		"ca.crt":                cert,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, payload, 3)
+
+	_, otherKey := certificateAndKey(t)
+	_, err = kubernetes.TypedPayload(corev1.SecretTypeTLS, map[string][]byte{
+		"secret": append(append([]byte{}, cert...), otherKey...),
+	})
+	assert.EqualError(t, err, "invalid certificate and key pair: tls: private key does not match public key")
+
+	_, err = kubernetes.TypedPayload(corev1.SecretTypeTLS, map[string][]byte{"secret": cert})
+	assert.EqualError(t, err, "PEM bundle contains no private key")
+
+	_, err = kubernetes.TypedPayload(corev1.SecretTypeTLS, map[string][]byte{"secret": append(append(append([]byte{}, cert...), key...), otherKey...)})
+	assert.EqualError(t, err, "PEM bundle contains 2 private keys, expected one")
+}
+
+func TestTypedPayload_DockerConfigJSON(t *testing.T) {
+	config := []byte(`{"auths": {"europe-north1-docker.pkg.dev": {"auth": "dXNlcjpwYXNz"}}}`)
+
+	payload, err := kubernetes.TypedPayload(corev1.SecretTypeDockerConfigJson, map[string][]byte{"secret": config})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{corev1.DockerConfigJsonKey: config}, payload)
+
+	_, err = kubernetes.TypedPayload(corev1.SecretTypeDockerConfigJson, map[string][]byte{"secret": []byte(`{"auths": {}}`)})
+	assert.EqualError(t, err, "invalid Docker config: no registries in auths")
+
+	_, err = kubernetes.TypedPayload(corev1.SecretTypeDockerConfigJson, map[string][]byte{"secret": []byte(`hunter2`)})
+	assert.EqualError(t, err, "invalid Docker config: not a JSON object with an auths map")
+}
+
+func TestTypedPayload_BasicAuth(t *testing.T) {
+	payload := map[string][]byte{
+		corev1.BasicAuthUsernameKey: []byte("some-user"),
+		corev1.BasicAuthPasswordKey: []byte("hunter2"),
+	}
+	actual, err := kubernetes.TypedPayload(corev1.SecretTypeBasicAuth, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, actual)
+
+	_, err = kubernetes.TypedPayload(corev1.SecretTypeBasicAuth, map[string][]byte{"secret": []byte("hunter2")})
+	assert.EqualError(t, err, "kubernetes.io/basic-auth secrets need a username or password key")
+}
+
+func TestTypedPayload_SSHAuth(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	assert.NoError(t, err)
+	privateKey := pem.EncodeToMemory(block)
+
+	payload, err := kubernetes.TypedPayload(corev1.SecretTypeSSHAuth, map[string][]byte{"secret": privateKey})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{corev1.SSHAuthPrivateKey: privateKey}, payload)
+
+	_, err = kubernetes.TypedPayload(corev1.SecretTypeSSHAuth, map[string][]byte{"secret": []byte("hunter2")})
+	assert.EqualError(t, err, "invalid SSH private key: ssh: no key found")
+}
+
+func TestOpaqueSecret_Type(t *testing.T) {
+	typedSecretData := secretData
+	typedSecretData.Type = corev1.SecretTypeTLS
+
+	secret := kubernetes.OpaqueSecret(typedSecretData)
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+}
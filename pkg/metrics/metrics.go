@@ -7,6 +7,7 @@ const (
 	LabelStatus    = "status"
 	LabelSystem    = "system"
 	LabelOperation = "operation"
+	LabelPolicy    = "policy"
 )
 
 type Status = string
@@ -16,11 +17,19 @@ type Operation = string
 type System = string
 
 const (
-	StatusSuccess     Status = "success"
-	StatusError       Status = "error"
-	StatusNotManaged  Status = "not_managed"
-	StatusInvalidData Status = "invalid_data"
-	StatusNoSyncLabel Status = "no_sync_label"
+	StatusSuccess          Status = "success"
+	StatusError            Status = "error"
+	StatusNotManaged       Status = "not_managed"
+	StatusInvalidData      Status = "invalid_data"
+	StatusNoSyncLabel      Status = "no_sync_label"
+	StatusInvalidKey       Status = "invalid_key"
+	StatusInvalidTemplate  Status = "invalid_template"
+	StatusTooLarge         Status = "too_large"
+	StatusEmptyValue       Status = "empty_value"
+	StatusDecryptionFailed Status = "decryption_failed"
+	StatusConflict         Status = "conflict"
+	StatusUnchanged        Status = "unchanged"
+	StatusOtherShard       Status = "other_shard"
 
 	SystemKubernetes    System = "kubernetes"
 	SystemPubSub        System = "pubsub"
@@ -30,13 +39,14 @@ const (
 	OperationRead   Operation = "read"
 	OperationUpdate Operation = "update"
 	OperationDelete Operation = "delete"
+	OperationApply  Operation = "apply"
 )
 
 // Zero out all possible label combinations
 func InitLabels() {
-	statuses := []Status{StatusSuccess, StatusError, StatusNotManaged, StatusInvalidData, StatusNoSyncLabel}
+	statuses := []Status{StatusSuccess, StatusError, StatusNotManaged, StatusInvalidData, StatusNoSyncLabel, StatusInvalidKey, StatusInvalidTemplate, StatusTooLarge, StatusEmptyValue, StatusDecryptionFailed, StatusConflict, StatusUnchanged, StatusOtherShard}
 	systems := []System{SystemKubernetes, SystemPubSub, SystemSecretManager}
-	operations := []Operation{OperationCreate, OperationRead, OperationUpdate, OperationDelete}
+	operations := []Operation{OperationCreate, OperationRead, OperationUpdate, OperationDelete, OperationApply}
 
 	for _, status := range statuses {
 		for _, system := range systems {
@@ -74,6 +84,37 @@ var (
 			Help:      "Total number of managed secrets in namespace",
 		},
 	)
+	Leader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "leader",
+			Namespace: namespace,
+			Help:      "Whether this replica is the leader, which is the only one synchronizing secrets",
+		},
+	)
+	ShardMembers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "shard_members",
+			Namespace: namespace,
+			Help:      "Number of replicas sharing the projects in sharding mode",
+		},
+	)
+	PendingDeletions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "pending_deletions",
+			Namespace: namespace,
+			Help:      "Number of managed secrets marked for deletion after a grace period",
+		},
+	)
+	ReleasedSecrets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "released_secrets",
+			Namespace: namespace,
+			Help:      "Cumulative number of managed secrets released after the sync label was removed, by release policy",
+		},
+		[]string{
+			LabelPolicy,
+		},
+	)
 	Requests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name:      "requests",
@@ -0,0 +1,92 @@
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+const (
+	EncodingBase64     = "base64"
+	EncodingGzipBase64 = "gzip+base64"
+)
+
+// MaxDecodedSize limits the size of a decoded value, so that small compressed payloads cannot expand without bounds.
+const MaxDecodedSize = 1024 * 1024
+
+// DecodeError is returned when a value cannot be decoded. It never contains the value itself.
+type DecodeError struct {
+	Encoding string
+	Key      string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("invalid %s payload: %s", e.Encoding, e.Err)
+	}
+	return fmt.Sprintf("invalid %s value for key %q: %s", e.Encoding, e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Decode decodes a value in the given encoding. Surrounding whitespace and line breaks in base64 are ignored.
+func Decode(encoding string, value []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case EncodingBase64:
+		return decodeBase64(value)
+	case EncodingGzipBase64:
+		compressed, err := decodeBase64(value)
+		if err != nil {
+			return nil, err
+		}
+		return gunzip(compressed)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// DecodeValues decodes every value of an expanded payload in the given encoding.
+func DecodeValues(encoding string, data map[string][]byte) (map[string][]byte, error) {
+	decoded := make(map[string][]byte, len(data))
+	for key, value := range data {
+		var err error
+		decoded[key], err = Decode(encoding, value)
+		if err != nil {
+			return nil, &DecodeError{Encoding: encoding, Key: key, Err: err}
+		}
+	}
+	return decoded, nil
+}
+
+func decodeBase64(value []byte) ([]byte, error) {
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(value)))
+	n, err := base64.StdEncoding.Decode(decoded, bytes.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	return decoded[:n], nil
+}
+
+func gunzip(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, MaxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > MaxDecodedSize {
+		return nil, fmt.Errorf("decompressed value exceeds %d bytes", MaxDecodedSize)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,58 @@
+package payload_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+func gzipBase64(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func TestDecode(t *testing.T) {
+	binary := []byte{0x30, 0x82, 0x00, 0xff, 0x0a}
+
+	decoded, err := payload.Decode(payload.EncodingBase64, []byte("MIIA/wo=\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, binary, decoded)
+
+	decoded, err = payload.Decode(payload.EncodingGzipBase64, gzipBase64(t, binary))
+	assert.NoError(t, err)
+	assert.Equal(t, binary, decoded)
+
+	decoded, err = payload.Decode("", binary)
+	assert.NoError(t, err)
+	assert.Equal(t, binary, decoded)
+
+	_, err = payload.Decode(payload.EncodingBase64, []byte("not base64"))
+	assert.EqualError(t, err, "illegal base64 data at input byte 3")
+
+	_, err = payload.Decode(payload.EncodingGzipBase64, []byte("MIIA/wo="))
+	assert.EqualError(t, err, "unexpected EOF")
+
+	_, err = payload.Decode(payload.EncodingGzipBase64, gzipBase64(t, make([]byte, payload.MaxDecodedSize+1)))
+	assert.EqualError(t, err, "decompressed value exceeds 1048576 bytes")
+
+	_, err = payload.Decode("rot13", binary)
+	assert.EqualError(t, err, `unsupported encoding "rot13"`)
+}
+
+func TestDecodeValues(t *testing.T) {
+	decoded, err := payload.DecodeValues(payload.EncodingBase64, map[string][]byte{"a": []byte("aHVudGVyMg==")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"a": []byte("hunter2")}, decoded)
+
+	_, err = payload.DecodeValues(payload.EncodingBase64, map[string][]byte{"a": []byte("hunter2")})
+	assert.EqualError(t, err, `invalid base64 value for key "a": illegal base64 data at input byte 4`)
+}
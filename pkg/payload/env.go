@@ -0,0 +1,117 @@
+package payload
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// FromEnv expands a dotenv file into one key per variable.
+// Later definitions of a variable replace earlier ones, unless in strict mode.
+func FromEnv(raw []byte, opts Options) (map[string][]byte, error) {
+	stringMap, err := godotenv.UnmarshalBytes(raw)
+	// godotenv reads a last line without = as a variable without a name
+	if _, unnamed := stringMap[""]; err != nil || unnamed {
+		// godotenv errors quote the payload, so errors are reported by line instead
+		return nil, envError(raw)
+	}
+	if opts.Strict {
+		if err := checkDuplicates(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	byteMap := make(map[string][]byte)
+	for key, value := range stringMap {
+		byteMap[key] = []byte(value)
+	}
+
+	return byteMap, nil
+}
+
+type envStatement struct {
+	key  string
+	line int
+}
+
+// envStatements returns the variables defined in a dotenv file and the lines they start at. The statements are found by
+// godotenv itself, as the shortest runs of lines from the start of each statement that it parses on their own.
+func envStatements(raw []byte) ([]envStatement, error) {
+	lines := strings.SplitAfter(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+	var statements []envStatement
+	for start := 0; start < len(lines); {
+		var vars map[string]string
+		var err error
+		end := start + 1
+		for ; end <= len(lines); end++ {
+			// statements only continue on another line within quotes, so they can only end on lines with quotes
+			if end > start+1 && !strings.ContainsAny(lines[end-1], `"'`) {
+				continue
+			}
+			if vars, err = godotenv.Unmarshal(strings.Join(lines[start:end], "")); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, &ParseError{Format: FormatEnv, Line: start + 1, Message: envErrorMessage(err)}
+		}
+
+		keys := make([]string, 0, len(vars))
+		for key := range vars {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "" {
+				return nil, &ParseError{Format: FormatEnv, Line: start + 1, Message: "missing = after variable name"}
+			}
+			statements = append(statements, envStatement{key: key, line: start + 1})
+		}
+		start = end
+	}
+	return statements, nil
+}
+
+// checkDuplicates returns an error for the second definition of a variable.
+func checkDuplicates(raw []byte) error {
+	statements, err := envStatements(raw)
+	if err != nil {
+		return err
+	}
+	lines := make(map[string]int)
+	for _, statement := range statements {
+		if line, ok := lines[statement.key]; ok {
+			return &ParseError{Format: FormatEnv, Line: statement.line, Message: fmt.Sprintf("duplicate key %q, first defined at line %d", statement.key, line)}
+		}
+		lines[statement.key] = statement.line
+	}
+	return nil
+}
+
+// envError returns the error for the first statement in the payload that godotenv cannot parse.
+func envError(raw []byte) error {
+	if _, err := envStatements(raw); err != nil {
+		return err
+	}
+	return &ParseError{Format: FormatEnv, Message: "malformed dotenv payload"}
+}
+
+var unexpectedCharacter = regexp.MustCompile(`^unexpected character ("(?:[^"\\]|\\.)*") in variable name`)
+
+// envErrorMessage returns the error from godotenv without the part of the payload it quotes.
+func envErrorMessage(err error) string {
+	message := err.Error()
+	if match := unexpectedCharacter.FindStringSubmatch(message); match != nil {
+		if char, err := strconv.Unquote(match[1]); err == nil && char != "" {
+			return fmt.Sprintf("unexpected character %q in variable name", []rune(char)[0])
+		}
+	}
+	if strings.HasPrefix(message, "unterminated quoted value") {
+		return "unterminated quoted value"
+	}
+	return "malformed variable definition"
+}
@@ -0,0 +1,75 @@
+package payload_test
+
+import (
+	"testing"
+
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+func TestFromEnv(t *testing.T) {
+	raw := []byte("# comment\nexport FOO=bar # trailing\nMULTI=\"line one\nline two\"\nSINGLE='a # b'\nYAML: style\nFOO=baz\n")
+
+	actual, err := payload.FromEnv(raw, payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"FOO":    []byte("baz"),
+		"MULTI":  []byte("line one\nline two"),
+		"SINGLE": []byte("a # b"),
+		"YAML":   []byte("style"),
+	}, actual)
+
+	_, err = payload.FromEnv(raw, payload.Options{Strict: true})
+	assert.EqualError(t, err, `invalid env at line 7: duplicate key "FOO", first defined at line 2`)
+}
+
+func TestFromEnv_Errors(t *testing.T) {
+	for name, tt := range map[string]struct {
+		raw string
+		err string
+	}{
+		"invalid character": {raw: "A=b\nhunter2-password=hunter2\n", err: `invalid env at line 2: unexpected character '-' in variable name`},
+		"unterminated":      {raw: "A=b\nB=\"hunter2\n\n", err: "invalid env at line 2: unterminated quoted value"},
+		"missing separator": {raw: "A=b\nhunter2", err: "invalid env at line 2: missing = after variable name"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := payload.FromEnv([]byte(tt.raw), payload.Options{})
+			assert.EqualError(t, err, tt.err)
+			assert.NotContains(t, err.Error(), "hunter2")
+		})
+	}
+}
+
+func TestFromEnv_Godotenv(t *testing.T) {
+	for name, raw := range map[string]string{
+		"escaped quote":   "A=\"say \\\"hi\\\"\"\nB=c\n",
+		"expansion":       "A=b\nC=\"${A}/c\"\n",
+		"export":          "export A=b\nexportB=c\n",
+		"same line":       "A=\"b\" B=c\n",
+		"windows":         "A=b\r\nB='c\r\nd'\r\n",
+		"trailing spaces": "A = b   \n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			expected, err := godotenv.Unmarshal(raw)
+			assert.NoError(t, err)
+
+			for _, strict := range []bool{false, true} {
+				actual, err := payload.FromEnv([]byte(raw), payload.Options{Strict: strict})
+				assert.NoError(t, err)
+				assert.Len(t, actual, len(expected))
+				for key, value := range expected {
+					assert.Equal(t, value, string(actual[key]))
+				}
+			}
+		})
+	}
+}
+
+func TestFromEnv_StrictMultiline(t *testing.T) {
+	raw := []byte("A=\"one\ntwo\nthree\"\nB=c\nA=d\n")
+
+	_, err := payload.FromEnv(raw, payload.Options{Strict: true})
+	assert.EqualError(t, err, `invalid env at line 5: duplicate key "A", first defined at line 1`)
+}
@@ -0,0 +1,230 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// FromJSON expands a JSON object into secret keys.
+func FromJSON(raw []byte, opts Options) (map[string][]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, jsonError(raw, err)
+	}
+	if decoder.More() {
+		offset := decoder.InputOffset() + int64(len(raw[decoder.InputOffset():])-len(bytes.TrimLeft(raw[decoder.InputOffset():], " \t\r\n")))
+		line, column := position(raw, offset)
+		return nil, &ParseError{Format: FormatJSON, Line: line, Column: column, Message: "unexpected data after top-level object"}
+	}
+
+	object, ok := document.(map[string]any)
+	if !ok {
+		return nil, &ParseError{Format: FormatJSON, Message: fmt.Sprintf("top-level value must be an object, got %s", typeName(document))}
+	}
+	if opts.Strict {
+		// decoding keeps the last value of duplicate keys
+		if err := checkJSONDuplicates(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	return flatten(object, opts)
+}
+
+// jsonObject is an object being read by checkJSONDuplicates, with the offsets of its keys.
+type jsonObject struct {
+	keys map[string]int64
+	// expectKey is whether the next string is a key rather than a value.
+	expectKey bool
+}
+
+// checkJSONDuplicates returns an error for the second definition of a key in an object. The payload must be valid JSON.
+func checkJSONDuplicates(raw []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	// objects are nil for arrays
+	var stack []*jsonObject
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return jsonError(raw, err)
+		}
+		var top *jsonObject
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, &jsonObject{keys: make(map[string]int64), expectKey: true})
+			continue
+		case json.Delim('['):
+			stack = append(stack, nil)
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return nil
+			}
+			top = stack[len(stack)-1]
+		default:
+			if key, ok := token.(string); ok && top != nil && top.expectKey {
+				// the key starts after the separator before it
+				offset := start + int64(len(raw[start:])-len(bytes.TrimLeft(raw[start:], " \t\r\n,")))
+				if first, ok := top.keys[key]; ok {
+					line, column := position(raw, offset)
+					firstLine, firstColumn := position(raw, first)
+					return &ParseError{Format: FormatJSON, Line: line, Column: column,
+						Message: fmt.Sprintf("duplicate key %q, first defined at line %d, column %d", key, firstLine, firstColumn)}
+				}
+				top.keys[key] = offset
+				top.expectKey = false
+				continue
+			}
+		}
+		// a value has been read
+		if top != nil {
+			top.expectKey = true
+		}
+	}
+}
+
+// flatten writes a decoded JSON or YAML object to secret keys.
+// Numbers are expected as json.Number, so that they are written exactly as they appear in the payload.
+func flatten(object map[string]any, opts Options) (map[string][]byte, error) {
+	if opts.Nested == "" {
+		opts.Nested = NestedFlatten
+	}
+	if opts.NonString == "" {
+		opts.NonString = NonStringConvert
+	}
+	if opts.Nested != NestedFlatten && opts.Nested != NestedJSON {
+		return nil, fmt.Errorf("unsupported nested mode %q", opts.Nested)
+	}
+	if opts.NonString != NonStringConvert && opts.NonString != NonStringReject {
+		return nil, fmt.Errorf("unsupported non-string mode %q", opts.NonString)
+	}
+
+	result := make(map[string][]byte)
+	for key, value := range object {
+		if err := flattenValue(result, key, value, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func flattenValue(result map[string][]byte, key string, value any, opts Options) error {
+	switch v := value.(type) {
+	case map[string]any:
+		if opts.Nested == NestedJSON {
+			return setJSONKey(result, key, v)
+		}
+		for child, childValue := range v {
+			if err := flattenValue(result, key+"."+child, childValue, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		if opts.Nested == NestedJSON {
+			return setJSONKey(result, key, v)
+		}
+		for i, childValue := range v {
+			if err := flattenValue(result, key+"."+strconv.Itoa(i), childValue, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	case string:
+		return setKey(result, key, []byte(v))
+	}
+
+	if opts.NonString == NonStringReject {
+		return fmt.Errorf("key %q has a %s value, only strings are allowed", key, typeName(value))
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return setKey(result, key, []byte{})
+	case json.Number:
+		return setKey(result, key, []byte(v.String()))
+	case bool:
+		return setKey(result, key, []byte(strconv.FormatBool(v)))
+	default:
+		return fmt.Errorf("key %q has an unsupported value of type %T", key, value)
+	}
+}
+
+func setJSONKey(result map[string][]byte, key string, value any) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding key %q: %w", key, err)
+	}
+	return setKey(result, key, encoded)
+}
+
+func setKey(result map[string][]byte, key string, value []byte) error {
+	if _, ok := result[key]; ok {
+		return fmt.Errorf("duplicate key %q", key)
+	}
+	result[key] = value
+	return nil
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// jsonError converts decoding errors to a ParseError, without echoing the payload.
+func jsonError(raw []byte, err error) error {
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) {
+		// the offset points just past the offending character
+		line, column := position(raw, syntaxError.Offset-1)
+		return &ParseError{Format: FormatJSON, Line: line, Column: column, Message: syntaxError.Error()}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &ParseError{Format: FormatJSON, Message: "unexpected end of input"}
+	}
+	return &ParseError{Format: FormatJSON, Message: err.Error()}
+}
+
+// position returns the 1-indexed line and column of the byte at the given offset.
+func position(raw []byte, offset int64) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	before := raw[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
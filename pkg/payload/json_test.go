@@ -0,0 +1,90 @@
+package payload_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+var jsonDocument = []byte(`{
+  "USERNAME": "some-user",
+  "PORT": 5432,
+  "TLS": true,
+  "OPTIONAL": null,
+  "db": {"host": "localhost", "replicas": ["a", "b"]}
+}`)
+
+func TestFromJSON_Flatten(t *testing.T) {
+	result, err := payload.FromJSON(jsonDocument, payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"USERNAME":      []byte("some-user"),
+		"PORT":          []byte("5432"),
+		"TLS":           []byte("true"),
+		"OPTIONAL":      []byte(""),
+		"db.host":       []byte("localhost"),
+		"db.replicas.0": []byte("a"),
+		"db.replicas.1": []byte("b"),
+	}, result)
+}
+
+func TestFromJSON_NestedAsJSON(t *testing.T) {
+	result, err := payload.FromJSON(jsonDocument, payload.Options{Nested: payload.NestedJSON})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"host":"localhost","replicas":["a","b"]}`), result["db"])
+	assert.Len(t, result, 5)
+}
+
+func TestFromJSON_RejectNonString(t *testing.T) {
+	_, err := payload.FromJSON([]byte(`{"PORT": 5432}`), payload.Options{NonString: payload.NonStringReject})
+	assert.EqualError(t, err, `key "PORT" has a number value, only strings are allowed`)
+}
+
+func TestFromJSON_DuplicateFlattenedKey(t *testing.T) {
+	_, err := payload.FromJSON([]byte(`{"a.b": "x", "a": {"b": "y"}}`), payload.Options{})
+	assert.EqualError(t, err, `duplicate key "a.b"`)
+}
+
+func TestFromJSON_Strict(t *testing.T) {
+	for name, test := range map[string]struct {
+		input string
+		err   string
+	}{
+		"top-level": {input: `{"a": "1", "a": "2"}`, err: `invalid json at line 1, column 12: duplicate key "a", first defined at line 1, column 2`},
+		"nested":    {input: "{\n  \"a\": {\"b\": 1},\n  \"c\": [{\"b\": 1, \"d\": {}},\n    {\"d\": 2, \"d\": 3}]\n}", err: `invalid json at line 4, column 14: duplicate key "d", first defined at line 4, column 6`},
+		"valid":     {input: `{"a": {"b": ["b", {"b": "c"}]}, "b": {"a": "b"}, "c": "a"}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := payload.FromJSON([]byte(test.input), payload.Options{Strict: true})
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+
+	// later definitions replace earlier ones, unless in strict mode
+	result, err := payload.FromJSON([]byte(`{"a": "1", "a": "2"}`), payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"a": []byte("2")}, result)
+}
+
+func TestFromJSON_Invalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		input string
+		err   string
+	}{
+		"syntax":    {input: "{\n  \"a\": \"b\",\n  oops\n}", err: "invalid json at line 3, column 3: invalid character 'o' looking for beginning of object key string"},
+		"truncated": {input: `{"a": "b"`, err: "invalid json: unexpected end of input"},
+		"array":     {input: `["a"]`, err: "invalid json: top-level value must be an object, got array"},
+		"trailing":  {input: `{"a": "b"} {}`, err: "invalid json at line 1, column 12: unexpected data after top-level object"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := payload.FromJSON([]byte(test.input), payload.Options{})
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
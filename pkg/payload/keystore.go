@@ -0,0 +1,198 @@
+package payload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"golang.org/x/crypto/hkdf"
+	corev1 "k8s.io/api/core/v1"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	KeystoreP12Key      = "keystore.p12"
+	KeystoreJKSKey      = "keystore.jks"
+	TruststoreJKSKey    = "truststore.jks"
+	KeystorePasswordKey = "keystore.password"
+	CACertKey           = "ca.crt"
+
+	// KeystoreAlias is the alias of the private key entry in the keystores.
+	KeystoreAlias = "hunter2"
+)
+
+// Keystores adds PKCS#12 and JKS keystores, and a JKS truststore, for the certificate chain and private key in the payload.
+// The PEM input is either the tls.crt and tls.key keys, or a single PEM bundle. The truststore holds the certificates in
+// the ca.crt key if present, and otherwise the certificates following the leaf certificate in the chain.
+//
+// The password is taken from the keystore.password key. If there is none, it is derived from the PEM input and added to
+// the payload. All randomness is derived from the PEM input and the password as well, so that identical payloads always
+// produce identical keystores, and Kubernetes secrets are not rewritten needlessly.
+func Keystores(payload map[string][]byte) (map[string][]byte, error) {
+	certPEM, keyPEM, err := keystoreInput(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("invalid certificate and key pair: %w", err)
+	}
+
+	chain, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	trusted := chain[1:]
+	if caPEM, ok := payload[CACertKey]; ok {
+		if trusted, err = parseCertificates(caPEM); err != nil {
+			return nil, fmt.Errorf("%s: %w", CACertKey, err)
+		}
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	privateKey, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("encoding private key: %w", err)
+	}
+
+	seed := sha256.Sum256(append(append([]byte{}, certPEM...), keyPEM...))
+	result := make(map[string][]byte, len(payload)+4)
+	for key, value := range payload {
+		result[key] = value
+	}
+
+	password, ok := payload[KeystorePasswordKey]
+	if !ok {
+		password = make([]byte, 24)
+		if _, err := io.ReadFull(deterministicReader(seed[:], nil, "password"), password); err != nil {
+			return nil, err
+		}
+		password = []byte(base64.RawURLEncoding.EncodeToString(password))
+		result[KeystorePasswordKey] = password
+	}
+
+	p12, err := pkcs12.Modern.WithRand(deterministicReader(seed[:], password, KeystoreP12Key)).Encode(privateKey, chain[0], chain[1:], string(password))
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", KeystoreP12Key, err)
+	}
+	result[KeystoreP12Key] = p12
+
+	creationTime := chain[0].NotBefore
+	certificates := make([]keystore.Certificate, 0, len(chain))
+	for _, cert := range chain {
+		certificates = append(certificates, keystore.Certificate{Type: "X509", Content: cert.Raw})
+	}
+
+	ks := keystore.New(keystore.WithOrderedAliases(), keystore.WithCustomRandomNumberGenerator(deterministicReader(seed[:], password, KeystoreJKSKey)))
+	err = ks.SetPrivateKeyEntry(KeystoreAlias, keystore.PrivateKeyEntry{
+		CreationTime:     creationTime,
+		PrivateKey:       pkcs8,
+		CertificateChain: certificates,
+	}, bytes.Clone(password))
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", KeystoreJKSKey, err)
+	}
+	if result[KeystoreJKSKey], err = storeJKS(ks, password); err != nil {
+		return nil, fmt.Errorf("creating %s: %w", KeystoreJKSKey, err)
+	}
+
+	if len(trusted) > 0 {
+		ts := keystore.New(keystore.WithOrderedAliases())
+		for i, cert := range trusted {
+			err = ts.SetTrustedCertificateEntry(fmt.Sprintf("ca-%d", i), keystore.TrustedCertificateEntry{
+				CreationTime: creationTime,
+				Certificate:  keystore.Certificate{Type: "X509", Content: cert.Raw},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("creating %s: %w", TruststoreJKSKey, err)
+			}
+		}
+		if result[TruststoreJKSKey], err = storeJKS(ts, password); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", TruststoreJKSKey, err)
+		}
+	}
+
+	return result, nil
+}
+
+func keystoreInput(payload map[string][]byte) ([]byte, []byte, error) {
+	certPEM, hasCert := payload[corev1.TLSCertKey]
+	keyPEM, hasKey := payload[corev1.TLSPrivateKeyKey]
+	if hasCert && hasKey {
+		return certPEM, keyPEM, nil
+	}
+
+	var bundles [][]byte
+	for key, value := range payload {
+		if key != KeystorePasswordKey && key != CACertKey {
+			bundles = append(bundles, value)
+		}
+	}
+	if len(bundles) != 1 {
+		return nil, nil, fmt.Errorf("keystores need either the %s and %s keys, or a single PEM bundle", corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+	}
+
+	return SplitPEMBundle(bundles[0])
+}
+
+func parseCertificates(certPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return certs, nil
+}
+
+func parsePrivateKey(der []byte) (any, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key, must be PKCS#8, PKCS#1 or EC")
+}
+
+func storeJKS(ks keystore.KeyStore, password []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := ks.Store(&buf, bytes.Clone(password)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deterministicReader returns a pseudo-random stream derived from the seed, separated by purpose.
+func deterministicReader(seed, salt []byte, purpose string) io.Reader {
+	return hkdf.New(sha256.New, seed, salt, []byte("hunter2 "+purpose))
+}
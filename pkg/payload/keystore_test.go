@@ -0,0 +1,111 @@
+package payload_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+// certificateChain returns a PEM encoded leaf and CA certificate chain, and the PEM encoded leaf private key.
+func certificateChain(t *testing.T) ([]byte, []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "some-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "some-host"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})...)
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestKeystores(t *testing.T) {
+	chain, key := certificateChain(t)
+	input := map[string][]byte{"secret": append(append([]byte{}, chain...), key...)}
+
+	result, err := payload.Keystores(input)
+	assert.NoError(t, err)
+	assert.Equal(t, input["secret"], result["secret"])
+	password := result[payload.KeystorePasswordKey]
+	assert.Len(t, password, 32)
+
+	privateKey, cert, caCerts, err := pkcs12.DecodeChain(result[payload.KeystoreP12Key], string(password))
+	assert.NoError(t, err)
+	assert.NotNil(t, privateKey)
+	assert.Equal(t, "some-host", cert.Subject.CommonName)
+	assert.Len(t, caCerts, 1)
+
+	ks := keystore.New()
+	assert.NoError(t, ks.Load(bytes.NewReader(result[payload.KeystoreJKSKey]), password))
+	entry, err := ks.GetPrivateKeyEntry(payload.KeystoreAlias, password)
+	assert.NoError(t, err)
+	assert.Len(t, entry.CertificateChain, 2)
+
+	ts := keystore.New()
+	assert.NoError(t, ts.Load(bytes.NewReader(result[payload.TruststoreJKSKey]), password))
+	assert.Equal(t, []string{"ca-0"}, ts.Aliases())
+
+	again, err := payload.Keystores(input)
+	assert.NoError(t, err)
+	assert.Equal(t, result, again, "identical payloads must produce identical keystores")
+}
+
+func TestKeystores_CompanionPassword(t *testing.T) {
+	chain, key := certificateChain(t)
+	input := map[string][]byte{
+		"tls.crt":                   chain,
+		"tls.key":                   key,
+		payload.KeystorePasswordKey: []byte("changeit"),
+	}
+
+	result, err := payload.Keystores(input)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("changeit"), result[payload.KeystorePasswordKey])
+
+	_, _, _, err = pkcs12.DecodeChain(result[payload.KeystoreP12Key], "changeit")
+	assert.NoError(t, err)
+}
+
+func TestKeystores_Invalid(t *testing.T) {
+	chain, _ := certificateChain(t)
+	_, otherKey := certificateChain(t)
+
+	_, err := payload.Keystores(map[string][]byte{"tls.crt": chain, "tls.key": otherKey})
+	assert.EqualError(t, err, "invalid certificate and key pair: tls: private key does not match public key")
+
+	_, err = payload.Keystores(map[string][]byte{"a": chain, "b": otherKey})
+	assert.EqualError(t, err, "keystores need either the tls.crt and tls.key keys, or a single PEM bundle")
+}
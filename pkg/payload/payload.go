@@ -0,0 +1,87 @@
+package payload
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	FormatEnv        = "env"
+	FormatJSON       = "json"
+	FormatYAML       = "yaml"
+	FormatProperties = "properties"
+)
+
+// NestedMode controls how nested maps and lists in a structured payload are written to secret keys.
+type NestedMode = string
+
+// NonStringMode controls how numbers, booleans and nulls in a structured payload are written to secret keys.
+type NonStringMode = string
+
+const (
+	// NestedFlatten expands nested values into dotted keys, e.g. {"db":{"user":"x"}} becomes db.user=x.
+	NestedFlatten NestedMode = "flatten"
+	// NestedJSON keeps nested values as JSON strings under their top-level key.
+	NestedJSON NestedMode = "json"
+
+	// NonStringConvert writes numbers and booleans as text, and null as an empty value.
+	NonStringConvert NonStringMode = "convert"
+	// NonStringReject fails on any value that is not a string.
+	NonStringReject NonStringMode = "reject"
+)
+
+// Options apply to the structured formats, i.e. JSON and YAML, except Strict which applies to all formats.
+type Options struct {
+	Nested    NestedMode
+	NonString NonStringMode
+	// Strict rejects duplicate keys in the formats where later definitions otherwise replace earlier ones.
+	Strict bool
+}
+
+// Parser expands a payload into secret keys.
+type Parser func(raw []byte, opts Options) (map[string][]byte, error)
+
+var parsers = map[string]Parser{
+	FormatEnv:        FromEnv,
+	FormatJSON:       FromJSON,
+	FormatYAML:       FromYAML,
+	FormatProperties: FromProperties,
+}
+
+// Parse expands a payload using the parser registered for the given format.
+func Parse(format string, raw []byte, opts Options) (map[string][]byte, error) {
+	parser, ok := parsers[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	return parser(raw, opts)
+}
+
+// Formats returns the names of all registered formats.
+func Formats() []string {
+	formats := make([]string, 0, len(parsers))
+	for format := range parsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// ParseError describes a syntax error at a position in the payload. It never contains the payload itself.
+type ParseError struct {
+	Format  string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("invalid %s at line %d, column %d: %s", e.Format, e.Line, e.Column, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("invalid %s at line %d: %s", e.Format, e.Line, e.Message)
+	default:
+		return fmt.Sprintf("invalid %s: %s", e.Format, e.Message)
+	}
+}
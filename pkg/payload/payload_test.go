@@ -0,0 +1,29 @@
+package payload_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+func TestParse(t *testing.T) {
+	for _, format := range payload.Formats() {
+		t.Run(format, func(t *testing.T) {
+			_, err := payload.Parse(format, []byte("a: b\n"), payload.Options{})
+			if format == payload.FormatJSON {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	_, err := payload.Parse("toml", []byte("a = 'b'"), payload.Options{})
+	assert.EqualError(t, err, `unsupported format "toml"`)
+}
+
+func TestFormats(t *testing.T) {
+	assert.Equal(t, []string{"env", "json", "properties", "yaml"}, payload.Formats())
+}
@@ -0,0 +1,41 @@
+package payload
+
+import (
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// SplitPEMBundle returns the certificate chain and the private key from a PEM bundle, in the order they appear.
+func SplitPEMBundle(bundle []byte) ([]byte, []byte, error) {
+	var certs, key []byte
+	keys := 0
+
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certs = append(certs, pem.EncodeToMemory(block)...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			key = pem.EncodeToMemory(block)
+			keys++
+		default:
+			return nil, nil, fmt.Errorf("unsupported PEM block of type %q", block.Type)
+		}
+	}
+
+	switch {
+	case len(certs) == 0:
+		return nil, nil, fmt.Errorf("PEM bundle contains no certificates")
+	case keys == 0:
+		return nil, nil, fmt.Errorf("PEM bundle contains no private key")
+	case keys > 1:
+		return nil, nil, fmt.Errorf("PEM bundle contains %d private keys, expected one", keys)
+	}
+
+	return certs, key, nil
+}
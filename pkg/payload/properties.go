@@ -0,0 +1,200 @@
+package payload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// propertiesRune is a character of a logical line, along with its position in the payload.
+type propertiesRune struct {
+	r      rune
+	line   int
+	column int
+}
+
+// FromProperties expands a Java .properties file into one key per property.
+// As in Java, later definitions of a key replace earlier ones, unless in strict mode.
+func FromProperties(raw []byte, opts Options) (map[string][]byte, error) {
+	if !utf8.Valid(raw) {
+		return nil, &ParseError{Format: FormatProperties, Message: "payload is not valid UTF-8"}
+	}
+
+	result := make(map[string][]byte)
+	lines := make(map[string]int)
+	for _, logical := range propertiesLines(string(raw)) {
+		key, value, err := propertiesEntry(logical)
+		if err != nil {
+			return nil, err
+		}
+		if line, ok := lines[key]; ok && opts.Strict {
+			return nil, &ParseError{Format: FormatProperties, Line: logical[0].line, Message: fmt.Sprintf("duplicate key %q, first defined at line %d", key, line)}
+		}
+		lines[key] = logical[0].line
+		result[key] = []byte(value)
+	}
+
+	return result, nil
+}
+
+// propertiesLines joins continued lines and strips comments, blank lines and leading whitespace.
+func propertiesLines(raw string) [][]propertiesRune {
+	raw = strings.ReplaceAll(raw, "\r\n", "\n")
+	raw = strings.ReplaceAll(raw, "\r", "\n")
+
+	var logicalLines [][]propertiesRune
+	var current []propertiesRune
+	continuation := false
+
+	for i, physical := range strings.Split(raw, "\n") {
+		runes := make([]propertiesRune, 0, len(physical))
+		column := 1
+		for _, r := range physical {
+			runes = append(runes, propertiesRune{r: r, line: i + 1, column: column})
+			column++
+		}
+
+		start := 0
+		for start < len(runes) && isPropertiesWhitespace(runes[start].r) {
+			start++
+		}
+		runes = runes[start:]
+
+		if !continuation && (len(runes) == 0 || runes[0].r == '#' || runes[0].r == '!') {
+			continue
+		}
+
+		backslashes := 0
+		for j := len(runes) - 1; j >= 0 && runes[j].r == '\\'; j-- {
+			backslashes++
+		}
+		continuation = backslashes%2 == 1
+		if continuation {
+			runes = runes[:len(runes)-1]
+		}
+
+		current = append(current, runes...)
+		if !continuation {
+			logicalLines = append(logicalLines, current)
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		logicalLines = append(logicalLines, current)
+	}
+
+	return logicalLines
+}
+
+// propertiesEntry splits a logical line into an unescaped key and value.
+func propertiesEntry(line []propertiesRune) (string, string, error) {
+	keyEnd := len(line)
+	for i := 0; i < len(line); i++ {
+		r := line[i].r
+		if r == '\\' {
+			i++
+			continue
+		}
+		if r == '=' || r == ':' || isPropertiesWhitespace(r) {
+			keyEnd = i
+			break
+		}
+	}
+
+	valueStart := keyEnd
+	for valueStart < len(line) && isPropertiesWhitespace(line[valueStart].r) {
+		valueStart++
+	}
+	if valueStart < len(line) && (line[valueStart].r == '=' || line[valueStart].r == ':') {
+		valueStart++
+		for valueStart < len(line) && isPropertiesWhitespace(line[valueStart].r) {
+			valueStart++
+		}
+	}
+
+	if keyEnd == 0 {
+		return "", "", propertiesError(line[0], "missing key")
+	}
+
+	key, err := propertiesUnescape(line[:keyEnd])
+	if err != nil {
+		return "", "", err
+	}
+	value, err := propertiesUnescape(line[valueStart:])
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, value, nil
+}
+
+func propertiesUnescape(runes []propertiesRune) (string, error) {
+	var builder strings.Builder
+	var highSurrogate rune
+	write := func(r rune) {
+		if highSurrogate != 0 {
+			// characters outside the basic multilingual plane are escaped as UTF-16 surrogate pairs
+			r = utf16.DecodeRune(highSurrogate, r)
+			highSurrogate = 0
+		}
+		builder.WriteRune(r)
+	}
+
+	for i := 0; i < len(runes); i++ {
+		if runes[i].r != '\\' {
+			write(runes[i].r)
+			continue
+		}
+		if i+1 == len(runes) {
+			// a trailing backslash at the end of the payload is dropped
+			break
+		}
+		escape := runes[i]
+		i++
+		switch runes[i].r {
+		case 't':
+			write('\t')
+		case 'n':
+			write('\n')
+		case 'r':
+			write('\r')
+		case 'f':
+			write('\f')
+		case 'u':
+			if i+4 >= len(runes) {
+				return "", propertiesError(escape, `malformed \uxxxx escape`)
+			}
+			digits := make([]rune, 0, 4)
+			for _, hex := range runes[i+1 : i+5] {
+				digits = append(digits, hex.r)
+			}
+			code, err := strconv.ParseUint(string(digits), 16, 16)
+			if err != nil {
+				return "", propertiesError(escape, `malformed \uxxxx escape`)
+			}
+			i += 4
+
+			if r := rune(code); utf16.IsSurrogate(r) && highSurrogate == 0 {
+				highSurrogate = r
+			} else {
+				write(r)
+			}
+		default:
+			write(runes[i].r)
+		}
+	}
+	if highSurrogate != 0 {
+		builder.WriteRune(utf8.RuneError)
+	}
+	return builder.String(), nil
+}
+
+func isPropertiesWhitespace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\f'
+}
+
+func propertiesError(at propertiesRune, message string) error {
+	return &ParseError{Format: FormatProperties, Line: at.line, Column: at.column, Message: message}
+}
@@ -0,0 +1,73 @@
+package payload_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+var propertiesDocument = []byte(`# comment
+! another comment
+spring.datasource.username = some-user
+spring.datasource.password:some-password
+key\ with\ spaces value with spaces
+empty
+multiline = one, \
+            two, \
+            three
+escaped = tab\tnewline\nunicodeæ😀
+   indented=value
+override=first
+override=second
+`)
+
+func TestFromProperties(t *testing.T) {
+	result, err := payload.FromProperties(propertiesDocument, payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"spring.datasource.username": []byte("some-user"),
+		"spring.datasource.password": []byte("some-password"),
+		"key with spaces":            []byte("value with spaces"),
+		"empty":                      []byte(""),
+		"multiline":                  []byte("one, two, three"),
+		"escaped":                    []byte("tab\tnewline\nunicodeæ😀"),
+		"indented":                   []byte("value"),
+		"override":                   []byte("second"),
+	}, result)
+}
+
+func TestFromProperties_Strict(t *testing.T) {
+	_, err := payload.FromProperties(propertiesDocument, payload.Options{Strict: true})
+	assert.ErrorContains(t, err, `duplicate key "override", first defined at line`)
+
+	_, err = payload.FromProperties([]byte("a=b\\\n\n"), payload.Options{Strict: true})
+	assert.NoError(t, err)
+}
+
+func TestFromProperties_CRLF(t *testing.T) {
+	result, err := payload.FromProperties([]byte("a=b\r\nc=d\\\r\n  e\r\n"), payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"a": []byte("b"),
+		"c": []byte("de"),
+	}, result)
+}
+
+func TestFromProperties_Invalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		input string
+		err   string
+	}{
+		"unicode":   {input: "a=b\nkey = value\\u12x4\n", err: `invalid properties at line 2, column 12: malformed \uxxxx escape`},
+		"truncated": {input: "key = \\u12", err: `invalid properties at line 1, column 7: malformed \uxxxx escape`},
+		"key":       {input: "a=b\n  = value\n", err: "invalid properties at line 2, column 3: missing key"},
+		"encoding":  {input: "a=\xff", err: "invalid properties: payload is not valid UTF-8"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := payload.FromProperties([]byte(test.input), payload.Options{})
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package payload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/getsops/sops/v3/stores/dotenv"
+	"github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+)
+
+// sopsMetadataPrefix prefixes the SOPS metadata in dotenv files, flattened into variables such as sops_age__list_0__map_enc.
+const sopsMetadataPrefix = "sops_"
+
+// DecryptionError is returned when a SOPS payload cannot be decrypted. It never contains the payload itself.
+type DecryptionError struct {
+	Err error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("cannot decrypt SOPS payload: %s", e.Err)
+}
+
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
+// IsSOPS reports whether a dotenv, JSON or YAML payload is encrypted with SOPS.
+func IsSOPS(format string, raw []byte) bool {
+	switch format {
+	case FormatEnv:
+		for _, line := range strings.Split(string(raw), "\n") {
+			if strings.HasPrefix(line, sopsMetadataPrefix+"mac=") || strings.HasPrefix(line, sopsMetadataPrefix+"version=") {
+				return true
+			}
+		}
+		return false
+	case FormatJSON, FormatYAML:
+		var document struct {
+			SOPS *struct {
+				MAC     string `yaml:"mac"`
+				Version string `yaml:"version"`
+			} `yaml:"sops"`
+		}
+		if err := yaml.Unmarshal(raw, &document); err != nil {
+			return false
+		}
+		return document.SOPS != nil && (document.SOPS.MAC != "" || document.SOPS.Version != "")
+	default:
+		return false
+	}
+}
+
+// sopsStore is implemented by the SOPS stores for each format.
+type sopsStore interface {
+	LoadEncryptedFile(in []byte) (sops.Tree, error)
+	EmitPlainFile(branches sops.TreeBranches) ([]byte, error)
+}
+
+// DecryptSOPS decrypts a dotenv, JSON or YAML payload encrypted with SOPS for age recipients, and returns the plaintext
+// payload in the same format, without the SOPS metadata. The data key is decrypted with the given identities, and the
+// message authentication code over all values is verified, the same way as by sops itself.
+func DecryptSOPS(format string, raw []byte, identities []age.Identity) ([]byte, error) {
+	plaintext, err := decryptSOPS(format, raw, identities)
+	if err != nil {
+		return nil, &DecryptionError{Err: err}
+	}
+	return plaintext, nil
+}
+
+func decryptSOPS(format string, raw []byte, identities []age.Identity) ([]byte, error) {
+	var store sopsStore
+	stores := config.NewStoresConfig()
+	switch format {
+	case FormatEnv:
+		store = dotenv.NewStore(&stores.Dotenv)
+	case FormatJSON:
+		store = json.NewStore(&stores.JSON)
+	case FormatYAML:
+		store = sopsyaml.NewStore(&stores.YAML)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no age identities configured")
+	}
+
+	tree, err := store.LoadEncryptedFile(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s document: %w", format, err)
+	}
+	key, err := tree.Metadata.GetDataKeyWithKeyServices([]keyservice.KeyServiceClient{ageKeyService(identities)}, nil)
+	if err != nil {
+		return nil, errors.New("no configured identity matches the age recipients " + strings.Join(sopsRecipients(tree.Metadata), ", "))
+	}
+
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(key, cipher)
+	if err != nil {
+		// the errors of sops can contain values that are not encrypted
+		return nil, errors.New("values do not decrypt with the data key, the payload has been modified without it")
+	}
+	expected, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, key, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("MAC: %w", err)
+	}
+	if expected != mac {
+		return nil, errors.New("MAC mismatch, the payload has been modified without its data key")
+	}
+
+	if format == FormatEnv {
+		return emitEnv(tree.Branches[0]), nil
+	}
+	return store.EmitPlainFile(tree.Branches)
+}
+
+// envEscaper escapes values for double quotes in a dotenv file.
+var envEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+
+// emitEnv writes the variables of a decrypted dotenv file with double-quoted values, which FromEnv reads back as they
+// are. The unquoted values written by sops would lose their newlines, which it escapes as \n.
+func emitEnv(branch sops.TreeBranch) []byte {
+	var plaintext bytes.Buffer
+	for _, item := range branch {
+		// comments have no key
+		if key, ok := item.Key.(string); ok {
+			fmt.Fprintf(&plaintext, "%s=\"%s\"\n", key, envEscaper.Replace(fmt.Sprint(item.Value)))
+		}
+	}
+	return plaintext.Bytes()
+}
+
+// sopsRecipients returns the age recipients of the payload.
+func sopsRecipients(metadata sops.Metadata) []string {
+	var recipients []string
+	for _, group := range metadata.KeyGroups {
+		for _, key := range group {
+			if key, ok := key.(*sopsage.MasterKey); ok {
+				recipients = append(recipients, key.Recipient)
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return []string{"(none)"}
+	}
+	return recipients
+}
+
+// ageKeyService decrypts SOPS data keys with the configured age identities, rather than those sops reads from the
+// environment of the process.
+type ageKeyService []age.Identity
+
+func (s ageKeyService) Encrypt(context.Context, *keyservice.EncryptRequest, ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, errors.New("encryption is not supported")
+}
+
+func (s ageKeyService) Decrypt(_ context.Context, req *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	ageKey := req.GetKey().GetAgeKey()
+	if ageKey == nil {
+		return nil, errors.New("only age keys are supported")
+	}
+	key := &sopsage.MasterKey{Recipient: ageKey.GetRecipient(), EncryptedKey: string(req.GetCiphertext())}
+	sopsage.ParsedIdentities(s).ApplyToMasterKey(key)
+	plaintext, err := key.Decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
@@ -0,0 +1,305 @@
+package payload_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+const sopsLastModified = "2024-03-01T12:00:00Z"
+
+// sopsFixture encrypts values the way SOPS does, for a single age recipient.
+type sopsFixture struct {
+	t        *testing.T
+	identity *age.X25519Identity
+	key      []byte
+	mac      []byte
+}
+
+func newSOPSFixture(t *testing.T) *sopsFixture {
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	assert.NoError(t, err)
+	return &sopsFixture{t: t, identity: identity, key: key}
+}
+
+func (f *sopsFixture) encrypt(value, additionalData, valueType string) string {
+	block, err := aes.NewCipher(f.key)
+	assert.NoError(f.t, err)
+	gcm, err := cipher.NewGCMWithNonceSize(block, 32)
+	assert.NoError(f.t, err)
+	iv := make([]byte, 32)
+	_, err = rand.Read(iv)
+	assert.NoError(f.t, err)
+
+	sealed := gcm.Seal(nil, iv, []byte(value), []byte(additionalData))
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(data), base64.StdEncoding.EncodeToString(iv), base64.StdEncoding.EncodeToString(tag), valueType)
+}
+
+// macOf returns the encrypted message authentication code over the plaintext values, in document order.
+func (f *sopsFixture) macOf(values ...string) string {
+	hash := sha512.New()
+	for _, value := range values {
+		hash.Write([]byte(value))
+	}
+	return f.encrypt(fmt.Sprintf("%X", hash.Sum(nil)), sopsLastModified, "str")
+}
+
+func (f *sopsFixture) enc() string {
+	var buf bytes.Buffer
+	armored := armor.NewWriter(&buf)
+	writer, err := age.Encrypt(armored, f.identity.Recipient())
+	assert.NoError(f.t, err)
+	_, err = writer.Write(f.key)
+	assert.NoError(f.t, err)
+	assert.NoError(f.t, writer.Close())
+	assert.NoError(f.t, armored.Close())
+	return buf.String()
+}
+
+func (f *sopsFixture) yaml(body, mac string) []byte {
+	return []byte(body + fmt.Sprintf(`sops:
+    age:
+        - recipient: %s
+          enc: |
+%s
+    lastmodified: "%s"
+    mac: %s
+    version: 3.8.1
+`, f.identity.Recipient(), indent(f.enc(), "            "), sopsLastModified, mac))
+}
+
+func indent(text, prefix string) string {
+	return prefix + strings.ReplaceAll(strings.TrimSuffix(text, "\n"), "\n", "\n"+prefix)
+}
+
+func TestDecryptSOPS_YAML(t *testing.T) {
+	f := newSOPSFixture(t)
+	raw := f.yaml(fmt.Sprintf(`database:
+    user: %s
+    port: %s
+    hosts:
+        - %s
+        - %s
+enabled: %s
+public_unencrypted: visible
+`,
+		f.encrypt("app", "database:user:", "str"),
+		f.encrypt("5432", "database:port:", "int"),
+		f.encrypt("db-1", "database:hosts:", "str"),
+		f.encrypt("db-2", "database:hosts:", "str"),
+		f.encrypt("True", "enabled:", "bool"),
+	), f.macOf("app", "5432", "db-1", "db-2", "True", "visible"))
+
+	assert.True(t, payload.IsSOPS(payload.FormatYAML, raw))
+
+	plaintext, err := payload.DecryptSOPS(payload.FormatYAML, raw, []age.Identity{f.identity})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(plaintext), "sops")
+
+	result, err := payload.FromYAML(plaintext, payload.Options{Nested: payload.NestedFlatten})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"database.user":      []byte("app"),
+		"database.port":      []byte("5432"),
+		"database.hosts.0":   []byte("db-1"),
+		"database.hosts.1":   []byte("db-2"),
+		"enabled":            []byte("true"),
+		"public_unencrypted": []byte("visible"),
+	}, result)
+}
+
+func TestDecryptSOPS_JSON(t *testing.T) {
+	f := newSOPSFixture(t)
+	raw := []byte(fmt.Sprintf(`{"password": %q, "nested": {"token": %q}, "sops": {"age": [{"recipient": %q, "enc": %q}], "lastmodified": %q, "mac": %q, "version": "3.8.1"}}`,
+		f.encrypt("hunter2", "password:", "str"),
+		f.encrypt("some-token", "nested:token:", "str"),
+		f.identity.Recipient().String(), f.enc(), sopsLastModified, f.macOf("hunter2", "some-token"),
+	))
+
+	assert.True(t, payload.IsSOPS(payload.FormatJSON, raw))
+
+	plaintext, err := payload.DecryptSOPS(payload.FormatJSON, raw, []age.Identity{f.identity})
+	assert.NoError(t, err)
+
+	result, err := payload.FromJSON(plaintext, payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"password":     []byte("hunter2"),
+		"nested.token": []byte("some-token"),
+	}, result)
+}
+
+func TestDecryptSOPS_Env(t *testing.T) {
+	f := newSOPSFixture(t)
+	raw := []byte(fmt.Sprintf("PASSWORD=%s\nCERT=%s\nGREETING=%s\nsops_age__list_0__map_enc=%s\nsops_age__list_0__map_recipient=%s\nsops_lastmodified=%s\nsops_mac=%s\nsops_version=3.8.1\n",
+		f.encrypt("hunter2", "PASSWORD:", "str"),
+		f.encrypt("line one\nline two", "CERT:", "str"),
+		f.encrypt(`say "$USER" \o/`, "GREETING:", "str"),
+		strings.ReplaceAll(f.enc(), "\n", `\n`), f.identity.Recipient(), sopsLastModified,
+		f.macOf("hunter2", "line one\nline two", `say "$USER" \o/`),
+	))
+
+	assert.True(t, payload.IsSOPS(payload.FormatEnv, raw))
+	assert.False(t, payload.IsSOPS(payload.FormatEnv, []byte("PASSWORD=hunter2\n")))
+
+	plaintext, err := payload.DecryptSOPS(payload.FormatEnv, raw, []age.Identity{f.identity})
+	assert.NoError(t, err)
+	assert.Equal(t, "PASSWORD=\"hunter2\"\nCERT=\"line one\\nline two\"\nGREETING=\"say \\\"\\$USER\\\" \\\\o/\"\n", string(plaintext))
+
+	result, err := payload.FromEnv(plaintext, payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"PASSWORD": []byte("hunter2"),
+		"CERT":     []byte("line one\nline two"),
+		"GREETING": []byte(`say "$USER" \o/`),
+	}, result)
+}
+
+func TestDecryptSOPS_Errors(t *testing.T) {
+	f := newSOPSFixture(t)
+	password := f.encrypt("hunter2", "password:", "str")
+	username := f.encrypt("app", "username:", "str")
+	mac := f.macOf("hunter2", "app")
+	other, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+
+	for name, tt := range map[string]struct {
+		raw        []byte
+		identities []age.Identity
+		err        string
+	}{
+		"no identities": {
+			raw: f.yaml(fmt.Sprintf("password: %s\nusername: %s\n", password, username), mac),
+			err: "cannot decrypt SOPS payload: no age identities configured",
+		},
+		"wrong identity": {
+			raw:        f.yaml(fmt.Sprintf("password: %s\nusername: %s\n", password, username), mac),
+			identities: []age.Identity{other},
+			err:        "cannot decrypt SOPS payload: no configured identity matches the age recipients " + f.identity.Recipient().String(),
+		},
+		"moved value": {
+			raw:        f.yaml(fmt.Sprintf("password: %s\nusername: %s\n", username, password), mac),
+			identities: []age.Identity{f.identity},
+			err:        "cannot decrypt SOPS payload: values do not decrypt with the data key, the payload has been modified without it",
+		},
+		"removed value": {
+			raw:        f.yaml(fmt.Sprintf("password: %s\n", password), mac),
+			identities: []age.Identity{f.identity},
+			err:        "cannot decrypt SOPS payload: MAC mismatch, the payload has been modified without its data key",
+		},
+		"added value": {
+			raw:        f.yaml(fmt.Sprintf("password: %s\nusername: %s\nextra: hunter3\n", password, username), mac),
+			identities: []age.Identity{f.identity},
+			err:        "cannot decrypt SOPS payload: values do not decrypt with the data key, the payload has been modified without it",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := payload.DecryptSOPS(payload.FormatYAML, tt.raw, tt.identities)
+			assert.EqualError(t, err, tt.err)
+			assert.ErrorAs(t, err, new(*payload.DecryptionError))
+			assert.NotContains(t, err.Error(), "hunter2")
+		})
+	}
+}
+
+// sopsTestdata reads the payloads in testdata/sops, which are encrypted by the sops CLI for the identity in age.key:
+//
+//	sops encrypt --age <recipient> --input-type <format> --output-type <format> <plaintext> > testdata/sops/secrets.<ext>
+func sopsTestdata(t *testing.T, name string) []byte {
+	raw, err := os.ReadFile(filepath.Join("testdata", "sops", name))
+	assert.NoError(t, err)
+	return raw
+}
+
+func sopsTestdataIdentities(t *testing.T) []age.Identity {
+	identities, err := age.ParseIdentities(bytes.NewReader(sopsTestdata(t, "age.key")))
+	assert.NoError(t, err)
+	return identities
+}
+
+func TestDecryptSOPS_Testdata(t *testing.T) {
+	identities := sopsTestdataIdentities(t)
+	for _, tt := range []struct {
+		file     string
+		format   string
+		expected map[string][]byte
+	}{
+		{
+			file:   "secrets.json",
+			format: payload.FormatJSON,
+			expected: map[string][]byte{
+				"password":     []byte("hunter2"),
+				"port":         []byte("5432"),
+				"nested.token": []byte("some-token"),
+			},
+		},
+		{
+			file:   "secrets.yaml",
+			format: payload.FormatYAML,
+			expected: map[string][]byte{
+				"password":     []byte("hunter2"),
+				"port":         []byte("5432"),
+				"nested.token": []byte("some-token"),
+				"certificate":  []byte("line one\nline two\n"),
+			},
+		},
+		{
+			file:   "secrets.env",
+			format: payload.FormatEnv,
+			expected: map[string][]byte{
+				"PASSWORD": []byte("hunter2"),
+				"CERT":     []byte("line one\nline two"),
+			},
+		},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			raw := sopsTestdata(t, tt.file)
+			assert.True(t, payload.IsSOPS(tt.format, raw))
+
+			plaintext, err := payload.DecryptSOPS(tt.format, raw, identities)
+			assert.NoError(t, err)
+			result, err := payload.Parse(tt.format, plaintext, payload.Options{NonString: payload.NonStringConvert})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestDecryptSOPS_TestdataTampered(t *testing.T) {
+	identities := sopsTestdataIdentities(t)
+	for file, expected := range map[string]string{
+		"secrets.tampered-mac.yaml":  "cannot decrypt SOPS payload: MAC: Could not decrypt with AES_GCM: cipher: message authentication failed",
+		"secrets.removed-value.yaml": "cannot decrypt SOPS payload: MAC mismatch, the payload has been modified without its data key",
+	} {
+		t.Run(file, func(t *testing.T) {
+			_, err := payload.DecryptSOPS(payload.FormatYAML, sopsTestdata(t, file), identities)
+			assert.EqualError(t, err, expected)
+			assert.ErrorAs(t, err, new(*payload.DecryptionError))
+		})
+	}
+}
+
+func TestIsSOPS(t *testing.T) {
+	assert.False(t, payload.IsSOPS(payload.FormatYAML, []byte("sops: not metadata\n")))
+	assert.False(t, payload.IsSOPS(payload.FormatJSON, []byte(`{"password": "hunter2"}`)))
+	assert.False(t, payload.IsSOPS(payload.FormatProperties, []byte("sops_mac=x\n")))
+}
@@ -0,0 +1,95 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// MaxTemplateOutput is the largest rendered template allowed, equal to the size limit of a Kubernetes secret.
+const MaxTemplateOutput = 1024 * 1024
+
+var errTemplateOutputTooLarge = fmt.Errorf("rendered template exceeds %d bytes", MaxTemplateOutput)
+
+// templateFuncs is the complete set of functions available to templates in addition to the text/template builtins.
+// None of them have access to anything but their arguments, so templates cannot read files, environment or network.
+var templateFuncs = template.FuncMap{
+	"b64enc": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"b64dec": func(s string) (string, error) {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		return string(decoded), err
+	},
+	"quote":  strconv.Quote,
+	"upper":  strings.ToUpper,
+	"lower":  strings.ToLower,
+	"trim":   strings.TrimSpace,
+	"indent": indent,
+	"nindent": func(spaces int, s string) string {
+		return "\n" + indent(spaces, s)
+	},
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+	"required": func(name, value string) (string, error) {
+		if value == "" {
+			return "", fmt.Errorf("%s is required", name)
+		}
+		return value, nil
+	},
+	"toJson": func(s string) (string, error) {
+		encoded, err := json.Marshal(s)
+		return string(encoded), err
+	},
+}
+
+// Render executes a Go text/template with the payload keys as data, e.g. {{ .PASSWORD }} or {{ index . "db.password" }}.
+// Referencing a key that does not exist is an error.
+func Render(name, text string, payload map[string][]byte) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(payload))
+	for key, value := range payload {
+		data[key] = string(value)
+	}
+
+	output := &limitedBuffer{limit: MaxTemplateOutput}
+	if err := tmpl.Execute(output, data); err != nil {
+		if errors.Is(err, errTemplateOutputTooLarge) {
+			return nil, errTemplateOutputTooLarge
+		}
+		return nil, err
+	}
+
+	return output.Bytes(), nil
+}
+
+func indent(spaces int, s string) string {
+	padding := strings.Repeat(" ", spaces)
+	return padding + strings.ReplaceAll(s, "\n", "\n"+padding)
+}
+
+// limitedBuffer fails writes beyond its limit, which stops execution of runaway templates.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errTemplateOutputTooLarge
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,54 @@
+package payload_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+func TestRender(t *testing.T) {
+	data := map[string][]byte{
+		"DB_USER":     []byte("some-user"),
+		"DB_PASSWORD": []byte(`hunter"2`),
+		"db.host":     []byte("localhost"),
+	}
+	text := `spring:
+  datasource:
+    url: jdbc:postgresql://{{ index . "db.host" }}/db
+    username: {{ .DB_USER | upper }}
+    password: {{ .DB_PASSWORD | quote }}
+    token: {{ .DB_USER | b64enc }}
+`
+
+	output, err := payload.Render("application.yaml", text, data)
+	assert.NoError(t, err)
+	assert.Equal(t, `spring:
+  datasource:
+    url: jdbc:postgresql://localhost/db
+    username: SOME-USER
+    password: "hunter\"2"
+    token: c29tZS11c2Vy
+`, string(output))
+}
+
+func TestRender_Errors(t *testing.T) {
+	data := map[string][]byte{"EMPTY": {}}
+
+	for name, test := range map[string]struct {
+		text string
+		err  string
+	}{
+		"syntax":   {text: "{{ .EMPTY ", err: `template: config:1: unclosed action`},
+		"missing":  {text: "{{ .MISSING }}", err: `template: config:1:3: executing "config" at <.MISSING>: map has no entry for key "MISSING"`},
+		"function": {text: `{{ env "HOME" }}`, err: `template: config:1: function "env" not defined`},
+		"required": {text: `{{ required "EMPTY" .EMPTY }}`, err: `template: config:1:3: executing "config" at <required "EMPTY" .EMPTY>: error calling required: EMPTY is required`},
+		"size":     {text: `{{ range 2000000 }}xx{{ end }}`, err: "rendered template exceeds 1048576 bytes"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := payload.Render("config", test.text, data)
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// yamlNodeLimit is the number of nodes a document may expand to. Payloads of Secret Manager secrets are at most 64 KiB,
+// which is less than one node for every byte without aliases, so only documents that expand aliases many times over
+// reach the limit.
+const yamlNodeLimit = 100_000
+
+// FromYAML expands a YAML map into secret keys.
+func FromYAML(raw []byte, opts Options) (map[string][]byte, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+
+	var document yaml.Node
+	if err := decoder.Decode(&document); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, &ParseError{Format: FormatYAML, Message: "document is empty"}
+		}
+		return nil, yamlError(err)
+	}
+
+	var next yaml.Node
+	if err := decoder.Decode(&next); !errors.Is(err, io.EOF) {
+		if err != nil {
+			return nil, yamlError(err)
+		}
+		return nil, &ParseError{Format: FormatYAML, Line: next.Line, Column: next.Column, Message: "multiple documents are not supported"}
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nodeError(root, "top-level value must be a map, got %s", yamlKind(root))
+	}
+
+	budget := yamlNodeLimit
+	object, err := yamlValue(root, &budget)
+	if err != nil {
+		return nil, err
+	}
+
+	return flatten(object.(map[string]any), opts)
+}
+
+// yamlValue converts a node to the same representation as JSON decoded with json.Number. Every node converted, including
+// those expanded from aliases, is taken from the budget, so that aliases of aliases cannot expand exponentially.
+func yamlValue(node *yaml.Node, budget *int) (any, error) {
+	if *budget--; *budget < 0 {
+		return nil, nodeError(node, "aliases expand to more than %d values", yamlNodeLimit)
+	}
+	switch node.Kind {
+	case yaml.AliasNode:
+		return yamlValue(node.Alias, budget)
+	case yaml.MappingNode:
+		object := make(map[string]any)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			if keyNode.Kind != yaml.ScalarNode {
+				return nil, nodeError(keyNode, "map keys must be scalars, got %s", yamlKind(keyNode))
+			}
+			if keyNode.Tag == "!!merge" {
+				return nil, nodeError(keyNode, "merge keys are not supported")
+			}
+			if _, ok := object[keyNode.Value]; ok {
+				return nil, nodeError(keyNode, "duplicate key %q", keyNode.Value)
+			}
+			value, err := yamlValue(valueNode, budget)
+			if err != nil {
+				return nil, err
+			}
+			object[keyNode.Value] = value
+		}
+		return object, nil
+	case yaml.SequenceNode:
+		list := make([]any, 0, len(node.Content))
+		for _, child := range node.Content {
+			value, err := yamlValue(child, budget)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case yaml.ScalarNode:
+		switch node.ShortTag() {
+		case "!!null":
+			return nil, nil
+		case "!!bool":
+			var value bool
+			if err := node.Decode(&value); err != nil {
+				return nil, nodeError(node, "invalid boolean")
+			}
+			return value, nil
+		case "!!int", "!!float":
+			return json.Number(node.Value), nil
+		default:
+			return node.Value, nil
+		}
+	default:
+		return nil, nodeError(node, "unsupported %s", yamlKind(node))
+	}
+}
+
+func yamlKind(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "map"
+	case yaml.SequenceNode:
+		return "list"
+	case yaml.ScalarNode:
+		return "scalar"
+	case yaml.AliasNode:
+		return "alias"
+	default:
+		return "node"
+	}
+}
+
+func nodeError(node *yaml.Node, format string, args ...any) error {
+	return &ParseError{Format: FormatYAML, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+// yamlError converts decoding errors to a ParseError. The YAML decoder only reports the line of syntax errors.
+func yamlError(err error) error {
+	if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return &ParseError{Format: FormatYAML, Line: line, Message: match[2]}
+	}
+	return &ParseError{Format: FormatYAML, Message: err.Error()}
+}
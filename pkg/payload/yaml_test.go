@@ -0,0 +1,86 @@
+package payload_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+var yamlDocument = []byte(`# some comment
+USERNAME: some-user
+PORT: 5432
+TLS: true
+OPTIONAL: ~
+QUOTED: "0755"
+db: &db
+  host: localhost
+  replicas:
+    - a
+    - b
+replica: *db
+multiline: |
+  one line
+  two line
+`)
+
+func TestFromYAML(t *testing.T) {
+	result, err := payload.FromYAML(yamlDocument, payload.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"USERNAME":           []byte("some-user"),
+		"PORT":               []byte("5432"),
+		"TLS":                []byte("true"),
+		"OPTIONAL":           []byte(""),
+		"QUOTED":             []byte("0755"),
+		"db.host":            []byte("localhost"),
+		"db.replicas.0":      []byte("a"),
+		"db.replicas.1":      []byte("b"),
+		"replica.host":       []byte("localhost"),
+		"replica.replicas.0": []byte("a"),
+		"replica.replicas.1": []byte("b"),
+		"multiline":          []byte("one line\ntwo line\n"),
+	}, result)
+}
+
+func TestFromYAML_NestedAsJSON(t *testing.T) {
+	result, err := payload.FromYAML(yamlDocument, payload.Options{Nested: payload.NestedJSON})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"host":"localhost","replicas":["a","b"]}`), result["db"])
+}
+
+func TestFromYAML_AliasBomb(t *testing.T) {
+	// every level is a list of ten aliases of the level before, expanding to 10^9 values
+	var document strings.Builder
+	document.WriteString("a: &a [x, x, x, x, x, x, x, x, x, x]\n")
+	previous := "a"
+	for _, level := range []string{"b", "c", "d", "e", "f", "g", "h", "i"} {
+		fmt.Fprintf(&document, "%s: &%s [%s]\n", level, level, strings.TrimSuffix(strings.Repeat("*"+previous+", ", 10), ", "))
+		previous = level
+	}
+
+	_, err := payload.FromYAML([]byte(document.String()), payload.Options{})
+	assert.ErrorContains(t, err, "aliases expand to more than 100000 values")
+}
+
+func TestFromYAML_Invalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		input string
+		err   string
+	}{
+		"syntax":    {input: "a: b\nc: d\n  e: f\n", err: "invalid yaml at line 3: mapping values are not allowed in this context"},
+		"list":      {input: "- a\n- b\n", err: "invalid yaml at line 1, column 1: top-level value must be a map, got list"},
+		"duplicate": {input: "a: b\nnested:\n  c: d\n  c: e\n", err: `invalid yaml at line 4, column 3: duplicate key "c"`},
+		"key":       {input: "[a]: b\n", err: "invalid yaml at line 1, column 1: map keys must be scalars, got list"},
+		"empty":     {input: "# only a comment\n", err: "invalid yaml: document is empty"},
+		"multiple":  {input: "a: b\n---\nc: d\n", err: "invalid yaml at line 2, column 1: multiple documents are not supported"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := payload.FromYAML([]byte(test.input), payload.Options{})
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
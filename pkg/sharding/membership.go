@@ -0,0 +1,220 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+// GroupLabel is the label on the Leases of the replicas sharing the projects, with the name of the group as its value.
+const GroupLabel = "hunter2.nais.io/shard-group"
+
+// Membership keeps a Lease for this replica, and assigns projects to the replicas with live Leases in the same group.
+type Membership struct {
+	logger        *log.Entry
+	client        coordinationclient.LeasesGetter
+	namespace     string
+	group         string
+	identity      string
+	leaseDuration time.Duration
+	onChange      func(members []string)
+
+	lock    sync.RWMutex
+	members []string
+	ring    *Ring
+	// renewed is when the Lease of this replica was last renewed. Once the Lease has expired, the other replicas take over
+	// the shard of this replica.
+	renewed time.Time
+}
+
+// NewMembership returns the membership of the replica with the identity in the group. onChange is called with the
+// members whenever replicas join or leave, and the shards are rebalanced.
+func NewMembership(logger *log.Entry, client coordinationclient.LeasesGetter, namespace, group, identity string, leaseDuration time.Duration, onChange func(members []string)) *Membership {
+	return &Membership{
+		logger:        logger,
+		client:        client,
+		namespace:     namespace,
+		group:         group,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		onChange:      onChange,
+	}
+}
+
+// Owns reports whether the project belongs to the shard of this replica. No project is owned until the replicas are known,
+// or while the Lease of this replica has expired.
+func (in *Membership) Owns(projectID string) bool {
+	in.lock.RLock()
+	defer in.lock.RUnlock()
+	return in.ring != nil && time.Since(in.renewed) < in.leaseDuration && in.ring.Owner(projectID) == in.identity
+}
+
+// Members returns the identities of the live replicas, sorted.
+func (in *Membership) Members() []string {
+	in.lock.RLock()
+	defer in.lock.RUnlock()
+	return slices.Clone(in.members)
+}
+
+// Run renews the Lease of this replica and follows the other replicas until the context is done. The Lease is then
+// deleted, so that the other replicas take over the shard right away.
+func (in *Membership) Run(ctx context.Context) {
+	ticker := time.NewTicker(in.leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		if err := in.Refresh(ctx); err != nil {
+			in.logger.Errorf("refreshing shard membership: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			in.leave()
+			return
+		}
+	}
+}
+
+// Refresh renews the Lease of this replica, and rebalances the shards if replicas have joined or left.
+func (in *Membership) Refresh(ctx context.Context) error {
+	renewed := time.Now()
+	if err := in.renew(ctx); err != nil {
+		in.expire()
+		return err
+	}
+	in.lock.Lock()
+	in.renewed = renewed
+	in.lock.Unlock()
+
+	leases, err := in.client.Leases(in.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", GroupLabel, in.group),
+	})
+	if err != nil {
+		return fmt.Errorf("listing leases: %w", err)
+	}
+
+	now := time.Now()
+	members := []string{in.identity}
+	for _, lease := range leases.Items {
+		holder := lease.Spec.HolderIdentity
+		if holder == nil || *holder == in.identity {
+			continue
+		}
+		expiry := expiryOf(lease)
+		switch {
+		case now.Before(expiry):
+			members = append(members, *holder)
+		case now.Sub(expiry) > 10*in.leaseDuration:
+			// replicas that did not leave cleanly, e.g. after a crash
+			err := in.client.Leases(in.namespace).Delete(ctx, lease.GetName(), metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				in.logger.Warnf("deleting expired lease %s: %v", lease.GetName(), err)
+			}
+		}
+	}
+	slices.Sort(members)
+
+	in.lock.Lock()
+	changed := !slices.Equal(in.members, members)
+	if changed {
+		in.members = members
+		in.ring = NewRing(members, VirtualNodes)
+	}
+	in.lock.Unlock()
+
+	if changed {
+		in.logger.Infof("rebalancing shards between %d replicas: %v", len(members), members)
+		metrics.ShardMembers.Set(float64(len(members)))
+		if in.onChange != nil {
+			in.onChange(members)
+		}
+	}
+	return nil
+}
+
+// expire forgets the replicas once the Lease of this replica has expired, as the other replicas have rebalanced the shards
+// without it. They are rebalanced again once the Lease is renewed.
+func (in *Membership) expire() {
+	in.lock.Lock()
+	expired := in.ring != nil && time.Since(in.renewed) >= in.leaseDuration
+	if expired {
+		in.members = nil
+		in.ring = nil
+	}
+	in.lock.Unlock()
+
+	if expired {
+		in.logger.Warnf("lease has expired, no longer synchronizing any shard until it is renewed")
+		metrics.ShardMembers.Set(0)
+	}
+}
+
+func (in *Membership) leaseName() string {
+	return in.group + "-" + in.identity
+}
+
+func (in *Membership) renew(ctx context.Context) error {
+	leases := in.client.Leases(in.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(in.leaseDuration.Seconds())
+
+	lease, err := leases.Get(ctx, in.leaseName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      in.leaseName(),
+				Namespace: in.namespace,
+				Labels:    map[string]string{GroupLabel: in.group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &in.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating lease: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting lease: %w", err)
+	}
+
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("renewing lease: %w", err)
+	}
+	return nil
+}
+
+func (in *Membership) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := in.client.Leases(in.namespace).Delete(ctx, in.leaseName(), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		in.logger.Errorf("deleting lease on leaving: %v", err)
+		return
+	}
+	in.logger.Info("left shard group")
+}
+
+func expiryOf(lease coordinationv1.Lease) time.Time {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return time.Time{}
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+}
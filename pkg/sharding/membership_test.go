@@ -0,0 +1,106 @@
+package sharding_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubernetesFake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/nais/hunter2/pkg/sharding"
+)
+
+func TestMembership(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewEntry(log.StandardLogger())
+	expired := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	crashed := "hunter2-crashed"
+	duration := int32(15)
+	clientset := kubernetesFake.NewClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "hunter2-" + crashed, Namespace: "nais-system", Labels: map[string]string{sharding.GroupLabel: "hunter2"}},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &crashed, LeaseDurationSeconds: &duration, RenewTime: &expired},
+	})
+
+	var rebalanced [][]string
+	a := sharding.NewMembership(logger, clientset.CoordinationV1(), "nais-system", "hunter2", "hunter2-a", 15*time.Second, func(members []string) {
+		rebalanced = append(rebalanced, members)
+	})
+	b := sharding.NewMembership(logger, clientset.CoordinationV1(), "nais-system", "hunter2", "hunter2-b", 15*time.Second, nil)
+
+	assert.False(t, a.Owns("some-project"), "no project is owned before the replicas are known")
+
+	assert.NoError(t, a.Refresh(ctx))
+	assert.NoError(t, b.Refresh(ctx))
+	assert.NoError(t, a.Refresh(ctx))
+	assert.Equal(t, []string{"hunter2-a", "hunter2-b"}, a.Members())
+	assert.Equal(t, []string{"hunter2-a", "hunter2-b"}, b.Members())
+	assert.Equal(t, [][]string{{"hunter2-a"}, {"hunter2-a", "hunter2-b"}}, rebalanced)
+
+	// every project is owned by exactly one replica
+	for i := 0; i < 100; i++ {
+		project := fmt.Sprintf("project-%d", i)
+		assert.NotEqual(t, a.Owns(project), b.Owns(project), project)
+	}
+
+	// a replica that leaves deletes its Lease, and its shard is taken over
+	bCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	b.Run(bCtx)
+	assert.NoError(t, a.Refresh(ctx))
+	assert.Equal(t, []string{"hunter2-a"}, a.Members())
+	assert.True(t, a.Owns("some-project"))
+
+	leases, err := clientset.CoordinationV1().Leases("nais-system").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	names := make([]string, 0, len(leases.Items))
+	for _, lease := range leases.Items {
+		names = append(names, lease.GetName())
+	}
+	assert.ElementsMatch(t, []string{"hunter2-hunter2-a", "hunter2-" + crashed}, names, "recently expired Leases are kept")
+}
+
+func TestMembership_ExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewEntry(log.StandardLogger())
+	clientset := kubernetesFake.NewClientset()
+	failing := false
+	clientset.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+
+	var rebalanced [][]string
+	leaseDuration := 100 * time.Millisecond
+	a := sharding.NewMembership(logger, clientset.CoordinationV1(), "nais-system", "hunter2", "hunter2-a", leaseDuration, func(members []string) {
+		rebalanced = append(rebalanced, members)
+	})
+	assert.NoError(t, a.Refresh(ctx))
+	assert.True(t, a.Owns("some-project"))
+
+	// the shard is kept while the Lease has not expired
+	failing = true
+	assert.ErrorContains(t, a.Refresh(ctx), "connection refused")
+	assert.True(t, a.Owns("some-project"))
+
+	// the other replicas take over the shard once the Lease has expired
+	time.Sleep(leaseDuration)
+	assert.False(t, a.Owns("some-project"))
+	assert.ErrorContains(t, a.Refresh(ctx), "connection refused")
+	assert.False(t, a.Owns("some-project"))
+	assert.Empty(t, a.Members())
+
+	failing = false
+	assert.NoError(t, a.Refresh(ctx))
+	assert.True(t, a.Owns("some-project"))
+	assert.Equal(t, [][]string{{"hunter2-a"}, {"hunter2-a"}}, rebalanced)
+}
@@ -0,0 +1,59 @@
+// Package sharding splits the projects between hunter2 replicas, which discover each other through Leases.
+package sharding
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// VirtualNodes is the number of points on the ring per replica, which evens out the size of the shards.
+const VirtualNodes = 100
+
+// ErrOtherShard is returned for work on a project that belongs to the shard of another replica.
+var ErrOtherShard = errors.New("project belongs to the shard of another replica")
+
+// Ring assigns keys to members by consistent hashing, so that only the keys of a member move when it joins or leaves.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func NewRing(members []string, virtualNodes int) *Ring {
+	ring := &Ring{owners: make(map[uint32]string, len(members)*virtualNodes)}
+	for _, member := range members {
+		for i := 0; i < virtualNodes; i++ {
+			point := hash(member + "#" + strconv.Itoa(i))
+			// on collisions, the point goes to the first member by name, the same on every replica
+			if owner, ok := ring.owners[point]; ok && owner < member {
+				continue
+			}
+			if _, ok := ring.owners[point]; !ok {
+				ring.points = append(ring.points, point)
+			}
+			ring.owners[point] = member
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Owner returns the member the key is assigned to, or an empty string if the ring has no members.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	point := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func hash(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,40 @@
+package sharding_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais/hunter2/pkg/sharding"
+)
+
+func TestRing(t *testing.T) {
+	assert.Empty(t, sharding.NewRing(nil, sharding.VirtualNodes).Owner("some-project"))
+
+	members := []string{"hunter2-a", "hunter2-b", "hunter2-c"}
+	ring := sharding.NewRing(members, sharding.VirtualNodes)
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		project := fmt.Sprintf("project-%d", i)
+		owners[project] = ring.Owner(project)
+		counts[owners[project]]++
+	}
+	for _, member := range members {
+		assert.InDelta(t, 1000, counts[member], 300, "shard of %s", member)
+	}
+
+	// the ring is the same on every replica
+	assert.Equal(t, owners["project-1"], sharding.NewRing([]string{"hunter2-c", "hunter2-a", "hunter2-b"}, sharding.VirtualNodes).Owner("project-1"))
+
+	// only the projects of a member that leaves are moved
+	ring = sharding.NewRing([]string{"hunter2-a", "hunter2-c"}, sharding.VirtualNodes)
+	for project, owner := range owners {
+		if owner != "hunter2-b" {
+			assert.Equal(t, owner, ring.Owner(project), project)
+		} else {
+			assert.NotEqual(t, "hunter2-b", ring.Owner(project), project)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+// adopt takes over a secret that is not managed by hunter2, but has opted in with the adopt annotation, by replacing its
+// type and data with those of the desired secret in place. The other labels and annotations of the existing secret are
+// kept, and the hash of its previous contents is recorded in an annotation for audit. The secret is written with an
+// update that resets its managed fields, so that hunter2 owns all of them, and applies to it from then on.
+func (in *Synchronizer) adopt(ctx context.Context, existing, desired *corev1.Secret) (*corev1.Secret, error) {
+	if !kubernetes.IsAdoptable(*existing) {
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusNotManaged)
+		return nil, fmt.Errorf("secret %s exists, but is not managed by hunter2", existing.GetName())
+	}
+	if existing.Type != desired.Type {
+		return nil, fmt.Errorf("secret %s of type %s cannot be adopted as type %s, as the type of a secret cannot be changed", existing.GetName(), existing.Type, desired.Type)
+	}
+
+	hash := kubernetes.DataHash(*existing)
+	adopted := desired.DeepCopy()
+	adopted.ResourceVersion = existing.GetResourceVersion()
+	adopted.ManagedFields = []metav1.ManagedFieldsEntry{{}}
+	adopted.Labels = maps.Clone(existing.GetLabels())
+	if adopted.Labels == nil {
+		adopted.Labels = make(map[string]string, len(desired.GetLabels()))
+	}
+	maps.Copy(adopted.Labels, desired.GetLabels())
+	adopted.Annotations = maps.Clone(existing.GetAnnotations())
+	maps.Copy(adopted.Annotations, desired.GetAnnotations())
+	delete(adopted.Annotations, kubernetes.Adopt)
+	adopted.Annotations[kubernetes.AdoptedDataHash] = hash
+
+	in.logger.Infof("adopting k8s secret '%s', which had contents with hash %s", existing.GetName(), hash)
+	updated, err := in.clientset.CoreV1().Secrets(existing.GetNamespace()).Update(ctx, adopted, metav1.UpdateOptions{FieldManager: kubernetes.FieldManager})
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationUpdate, metrics.ErrorStatus(err, metrics.StatusError))
+	if err != nil {
+		return nil, fmt.Errorf("adopting secret %s: %w", existing.GetName(), err)
+	}
+	// the hash is only kept on the secret, as events are readable by more users than secrets
+	in.eventf(updated, corev1.EventTypeNormal, EventReasonAdopted, "Adopted by hunter2, and updated from %s. The hash of the previous contents is in the %s annotation",
+		describeSource(desired), kubernetes.AdoptedDataHash)
+	return updated, nil
+}
@@ -0,0 +1,208 @@
+package synchronizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/nais/hunter2/pkg/google"
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+// DeletionPolicy decides what happens to a Kubernetes secret when its Secret Manager secret is deleted.
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyImmediate deletes the secret right away.
+	DeletionPolicyImmediate DeletionPolicy = "immediate"
+	// DeletionPolicyDelayed marks the secret for deletion after a grace period, unless the Secret Manager secret reappears.
+	DeletionPolicyDelayed DeletionPolicy = "delayed"
+	// DeletionPolicyOrphan keeps the secret and its data, but no longer manages it.
+	DeletionPolicyOrphan DeletionPolicy = "orphan"
+
+	DefaultDeletionGracePeriod = 24 * time.Hour
+
+	// deletionFieldManager marks secrets for deletion or as stale, and orphans them. It differs from the field manager for
+	// applying secrets, so that conflicts with it are never mistaken for fields written before server-side apply.
+	deletionFieldManager = "hunter2-deletion"
+)
+
+func ParseDeletionPolicy(policy string) (DeletionPolicy, error) {
+	switch DeletionPolicy(policy) {
+	case DeletionPolicyImmediate, DeletionPolicyDelayed, DeletionPolicyOrphan:
+		return DeletionPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown deletion policy %q, must be one of %s, %s or %s", policy, DeletionPolicyImmediate, DeletionPolicyDelayed, DeletionPolicyOrphan)
+	}
+}
+
+// WithDeletionPolicy sets what happens to Kubernetes secrets when their Secret Manager secrets are deleted. The grace
+// period applies to the delayed policy.
+func WithDeletionPolicy(policy DeletionPolicy, gracePeriod time.Duration) Option {
+	return func(in *Synchronizer) {
+		in.deletionPolicy = policy
+		in.deletionGracePeriod = gracePeriod
+	}
+}
+
+// deleteAccordingToPolicy deletes, marks for deletion or orphans the secret for the message and all its versions.
+func (in *Synchronizer) deleteAccordingToPolicy(ctx context.Context, msg google.PubSubMessage, why string) error {
+	if in.deletionPolicy == "" || in.deletionPolicy == DeletionPolicyImmediate {
+		return in.deleteKubernetesSecret(ctx, msg, why)
+	}
+
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		return fmt.Errorf("getting namespace: %+v", err)
+	}
+	secrets, err := in.managedSecretsOf(ctx, namespace, strings.ToLower(msg.GetSecretName()))
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		if in.deletionPolicy == DeletionPolicyOrphan {
+			err = in.orphan(ctx, secret, why)
+		} else {
+			err = in.scheduleDeletion(ctx, secret, why)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// managedSecretsOf returns the managed secret with the name in the namespace, if any, and all its versions.
+func (in *Synchronizer) managedSecretsOf(ctx context.Context, namespace, name string) ([]corev1.Secret, error) {
+	secrets, err := in.versionsOf(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := in.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case err == nil && kubernetes.IsOwned(*secret):
+		secrets = append(secrets, *secret)
+	case err != nil && !errors.IsNotFound(err):
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusError)
+		return nil, fmt.Errorf("getting Kubernetes secret %s: %w", name, err)
+	}
+	return secrets, nil
+}
+
+// scheduleDeletion marks the secret for deletion after the grace period. Secrets that are already marked keep their deadline.
+func (in *Synchronizer) scheduleDeletion(ctx context.Context, secret corev1.Secret, why string) error {
+	if _, ok := kubernetes.PendingDeletion(secret); ok {
+		return nil
+	}
+
+	deleteAfter := time.Now().Add(in.deletionGracePeriod).UTC().Format(time.RFC3339)
+	in.logger.Infof("k8s secret '%s' will be deleted after %s, as %s", secret.GetName(), deleteAfter, why)
+	patched, err := in.patchMetadata(ctx, secret, nil, map[string]any{
+		kubernetes.DeleteAfter:    deleteAfter,
+		kubernetes.DeletionReason: why,
+	})
+	if err != nil {
+		return fmt.Errorf("scheduling deletion of %s: %w", secret.GetName(), err)
+	}
+	in.eventf(patched, corev1.EventTypeWarning, EventReasonDeletionScheduled,
+		"Will be deleted after %s, as %s. Remove the %s annotation to keep it", deleteAfter, why, kubernetes.DeleteAfter)
+	return nil
+}
+
+// cancelDeletion removes the mark for deletion from the secret, e.g. when its Secret Manager secret reappears.
+func (in *Synchronizer) cancelDeletion(ctx context.Context, secret corev1.Secret, why string) error {
+	in.logger.Infof("cancelling deletion of k8s secret '%s', as %s", secret.GetName(), why)
+	patched, err := in.patchMetadata(ctx, secret, nil, map[string]any{
+		kubernetes.DeleteAfter:    nil,
+		kubernetes.DeletionReason: nil,
+	})
+	if err != nil {
+		return fmt.Errorf("cancelling deletion of %s: %w", secret.GetName(), err)
+	}
+	in.eventf(patched, corev1.EventTypeNormal, EventReasonDeletionCancelled, "Deletion cancelled, as %s", why)
+	return nil
+}
+
+// orphan removes the created-by label from the secret, so that it is kept with its data, but no longer managed by hunter2.
+func (in *Synchronizer) orphan(ctx context.Context, secret corev1.Secret, why string) error {
+	in.logger.Infof("orphaning k8s secret '%s', as %s", secret.GetName(), why)
+	patched, err := in.patchMetadata(ctx, secret, map[string]any{kubernetes.CreatedBy: nil}, nil)
+	if err != nil {
+		return fmt.Errorf("orphaning %s: %w", secret.GetName(), err)
+	}
+	in.eventf(patched, corev1.EventTypeWarning, EventReasonOrphaned, "No longer managed by hunter2, as %s. The data is kept", why)
+	return nil
+}
+
+// patchMetadata sets the labels and annotations of the secret with a merge patch, removing those with nil values.
+func (in *Synchronizer) patchMetadata(ctx context.Context, secret corev1.Secret, labels, annotations map[string]any) (*corev1.Secret, error) {
+	metadata := make(map[string]any)
+	if labels != nil {
+		metadata["labels"] = labels
+	}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+	patch, err := json.Marshal(map[string]any{"metadata": metadata})
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := in.clientset.CoreV1().Secrets(secret.GetNamespace()).Patch(ctx, secret.GetName(), types.MergePatchType, patch, metav1.PatchOptions{FieldManager: deletionFieldManager})
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationUpdate, metrics.ErrorStatus(err, metrics.StatusError))
+	return patched, err
+}
+
+// DeleteExpired deletes the managed secrets whose grace period for deletion has passed, and removes the keys of deleted
+// members of merged secrets whose grace period has passed. Both are counted as pending deletions until then.
+func (in *Synchronizer) DeleteExpired(ctx context.Context, managed []corev1.Secret) error {
+	var pending int
+	var errs []error
+	for _, secret := range managed {
+		if in.ownsNamespace(secret.GetNamespace()) {
+			removing, err := in.removeExpiredSources(ctx, secret)
+			pending += removing
+			if err != nil {
+				errs = append(errs, fmt.Errorf("removing expired members of %s: %w", secret.GetName(), err))
+			}
+		}
+
+		deleteAfter, ok := kubernetes.PendingDeletion(secret)
+		if !ok || !in.ownsNamespace(secret.GetNamespace()) {
+			continue
+		}
+		if time.Now().Before(deleteAfter) {
+			pending++
+			continue
+		}
+
+		why := secret.GetAnnotations()[kubernetes.DeletionReason]
+		in.logger.Infof("deleting k8s secret '%s/%s' after the grace period, as %s", secret.GetNamespace(), secret.GetName(), why)
+		err := in.clientset.CoreV1().Secrets(secret.GetNamespace()).Delete(ctx, secret.GetName(), metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationDelete, metrics.ErrorStatus(err, metrics.StatusError))
+		if err != nil {
+			pending++
+			errs = append(errs, err)
+			continue
+		}
+		in.recordNamespaceEvent(ctx, secret.GetNamespace(), corev1.EventTypeNormal, EventReasonDeleted,
+			"Deleted secret %s after the grace period, as %s", secret.GetName(), why)
+	}
+	metrics.PendingDeletions.Set(float64(pending))
+
+	if len(errs) > 0 {
+		return fmt.Errorf("deleting secrets after the grace period: %v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package synchronizer
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/nais/hunter2/pkg/google"
+	"github.com/nais/hunter2/pkg/kubernetes"
+)
+
+// Event reasons, as shown by kubectl describe and kubectl get events.
+const (
+	EventReasonCreated           = "Created"
+	EventReasonUpdated           = "Updated"
+	EventReasonDeleted           = "Deleted"
+	EventReasonNoSyncLabel       = "NoSyncLabel"
+	EventReasonNotManaged        = "NotManaged"
+	EventReasonUnknownProject    = "UnknownProject"
+	EventReasonSyncFailed        = "SyncFailed"
+	EventReasonInvalidKey        = "InvalidKey"
+	EventReasonInvalidType       = "InvalidType"
+	EventReasonInvalidTemplate   = "InvalidTemplate"
+	EventReasonInvalidReference  = "InvalidReference"
+	EventReasonInvalidTarget     = "InvalidTarget"
+	EventReasonInvalidMember     = "InvalidMember"
+	EventReasonKeyConflict       = "KeyConflict"
+	EventReasonInvalidPayload    = "InvalidPayload"
+	EventReasonTooLarge          = "TooLarge"
+	EventReasonDecryptionFailed  = "DecryptionFailed"
+	EventReasonConflict          = "Conflict"
+	EventReasonDeletionScheduled = "DeletionScheduled"
+	EventReasonDeletionCancelled = "DeletionCancelled"
+	EventReasonOrphaned          = "Orphaned"
+	EventReasonReleased          = "Released"
+	EventReasonAdopted           = "Adopted"
+)
+
+// recordEvent records an event on the Kubernetes secret for the message, or on its namespace if the secret does not exist.
+// The message must never contain secret values, as events are readable by anyone with access to the namespace.
+func (in *Synchronizer) recordEvent(ctx context.Context, msg google.PubSubMessage, eventType, reason, messageFmt string, args ...any) {
+	if in.recorder == nil {
+		return
+	}
+
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		in.logger.Debugf("not recording event %s: %v", reason, err)
+		return
+	}
+
+	secret, err := in.clientset.CoreV1().Secrets(namespace).Get(ctx, strings.ToLower(msg.GetSecretName()), metav1.GetOptions{})
+	if err != nil {
+		in.recordNamespaceEvent(ctx, namespace, eventType, reason, messageFmt, args...)
+		return
+	}
+	in.eventf(secret, eventType, reason, messageFmt, args...)
+}
+
+// recordNamespaceEvent records an event on the namespace, e.g. for secrets that have been deleted.
+func (in *Synchronizer) recordNamespaceEvent(ctx context.Context, namespace, eventType, reason, messageFmt string, args ...any) {
+	if in.recorder == nil || namespace == "" {
+		return
+	}
+
+	ns, err := in.clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		in.logger.Debugf("not recording event %s: getting namespace: %v", reason, err)
+		return
+	}
+	in.eventf(ns, eventType, reason, messageFmt, args...)
+}
+
+func (in *Synchronizer) eventf(object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	if in.recorder == nil {
+		return
+	}
+	in.recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// describeSource describes where the contents of a secret written by hunter2 come from, for events.
+func describeSource(secret *corev1.Secret) string {
+	if sources := secret.GetAnnotations()[kubernetes.Sources]; sources != "" {
+		return "Secret Manager secrets " + strings.ReplaceAll(sources, ",", ", ")
+	}
+	return "version " + secret.GetAnnotations()[kubernetes.SecretVersion] + " of the Secret Manager secret"
+}
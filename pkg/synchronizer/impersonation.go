@@ -0,0 +1,88 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubernetes2 "k8s.io/client-go/kubernetes"
+)
+
+const (
+	ImpersonateServiceAccountAnnotation = "hunter2.nais.io/impersonate-service-account"
+)
+
+// ServiceAccounts resolves the service account to impersonate for a project, either from the static mapping
+// or from the ImpersonateServiceAccountAnnotation on the namespace mapped to the project.
+// The static mapping takes precedence over namespace annotations.
+type ServiceAccounts struct {
+	clientset kubernetes2.Interface
+	static    map[string]string
+	lock      sync.RWMutex
+	// cache holds the service account of every known project, empty for projects without one.
+	cache map[string]string
+}
+
+func NewServiceAccounts(clientset kubernetes2.Interface, static map[string]string) *ServiceAccounts {
+	return &ServiceAccounts{
+		clientset: clientset,
+		static:    static,
+		cache:     make(map[string]string),
+	}
+}
+
+// Resolve returns the service account to impersonate for the project, or an empty string for the ambient credentials.
+// Namespaces are listed on the first lookup of a project only, until the next Refresh.
+func (in *ServiceAccounts) Resolve(ctx context.Context, projectID string) (string, error) {
+	if serviceAccount, ok := in.static[projectID]; ok {
+		return serviceAccount, nil
+	}
+
+	in.lock.RLock()
+	serviceAccount, ok := in.cache[projectID]
+	in.lock.RUnlock()
+	if ok {
+		return serviceAccount, nil
+	}
+
+	log.Infof("cache miss for service account of project id: %s, updating cache", projectID)
+	if err := in.Refresh(ctx); err != nil {
+		return "", err
+	}
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if _, ok := in.cache[projectID]; !ok {
+		// projects without a namespace are remembered as well, until the next refresh
+		in.cache[projectID] = ""
+	}
+	return in.cache[projectID], nil
+}
+
+// Refresh replaces the cached service accounts with those of the namespaces, so that annotations that are changed or
+// removed are picked up.
+func (in *ServiceAccounts) Refresh(ctx context.Context) error {
+	namespaces, err := in.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing namespaces: %+v", err)
+	}
+
+	cache := make(map[string]string, len(namespaces.Items))
+	for _, namespace := range namespaces.Items {
+		projectID, ok := namespace.Annotations[ProjectIDAnnotation]
+		if !ok {
+			continue
+		}
+		cache[projectID] = namespace.Annotations[ImpersonateServiceAccountAnnotation]
+		if cache[projectID] != "" {
+			log.Debugf("caching service account: %s=%s", projectID, cache[projectID])
+		}
+	}
+
+	in.lock.Lock()
+	in.cache = cache
+	in.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,130 @@
+package synchronizer
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+// Annotations with rules for the keys of expanded payloads, applied in the order listed.
+const (
+	IncludeKeysKey = "hunter2-include"
+	ExcludeKeysKey = "hunter2-exclude"
+	RenameKeysKey  = "hunter2-rename"
+	PrefixKeysKey  = "hunter2-prefix"
+)
+
+// KeyRulesPayload filters, renames and prefixes the keys of an expanded payload according to the annotations of the secret.
+// Include and exclude take comma-separated globs, rename takes comma-separated OLD=NEW pairs. The resulting keys must be valid
+// Kubernetes secret keys, and for the env format also valid environment variable names.
+func KeyRulesPayload(metadata *secretmanagerpb.Secret, data map[string][]byte) (map[string][]byte, error) {
+	format := secretFormat(metadata)
+	if format == "" {
+		return data, nil
+	}
+
+	annotations := metadata.GetAnnotations()
+	include := splitList(annotations[IncludeKeysKey])
+	exclude := splitList(annotations[ExcludeKeysKey])
+	renames, err := parseRenames(annotations[RenameKeysKey])
+	if err != nil {
+		return nil, err
+	}
+	prefix := annotations[PrefixKeysKey]
+
+	result := make(map[string][]byte, len(data))
+	sources := make(map[string]string, len(data))
+	for key, value := range data {
+		if len(include) > 0 {
+			included, err := matchesAny(include, key)
+			if err != nil {
+				return nil, err
+			}
+			if !included {
+				continue
+			}
+		}
+		excluded, err := matchesAny(exclude, key)
+		if err != nil {
+			return nil, err
+		}
+		if excluded {
+			continue
+		}
+
+		name := key
+		if renamed, ok := renames[key]; ok {
+			name = renamed
+		}
+		name = prefix + name
+
+		if source, ok := sources[name]; ok {
+			return nil, &InvalidKeyError{Key: name, Reason: fmt.Sprintf("both %q and %q are mapped to this key", source, key)}
+		}
+		if err := validateKey(format, name); err != nil {
+			return nil, err
+		}
+		sources[name] = key
+		result[name] = value
+	}
+
+	return result, nil
+}
+
+func validateKey(format, key string) error {
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return &InvalidKeyError{Key: key, Reason: strings.Join(errs, "; ")}
+	}
+	if format != payload.FormatEnv {
+		return nil
+	}
+	if errs := validation.IsEnvVarName(key); len(errs) > 0 {
+		return &InvalidKeyError{Key: key, Reason: strings.Join(errs, "; ")}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, key string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, key)
+		if err != nil {
+			return false, &InvalidKeyError{Key: pattern, Reason: "malformed glob pattern"}
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func parseRenames(value string) (map[string]string, error) {
+	renames := make(map[string]string)
+	for _, pair := range splitList(value) {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, &InvalidKeyError{Key: pair, Reason: fmt.Sprintf("%s must be a comma-separated list of OLD=NEW pairs", RenameKeysKey)}
+		}
+		if _, ok := renames[from]; ok {
+			return nil, &InvalidKeyError{Key: from, Reason: "renamed more than once"}
+		}
+		renames[from] = to
+	}
+	return renames, nil
+}
+
+// splitList splits a comma-separated annotation value, ignoring whitespace and empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
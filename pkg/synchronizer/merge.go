@@ -0,0 +1,430 @@
+package synchronizer
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/nais/hunter2/pkg/google"
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+// TargetLabelKey names the Kubernetes secret that the secret is merged into, together with all other secrets with the same target.
+const TargetLabelKey = "hunter2-target"
+
+// InvalidTargetError is returned when the target of a secret is not a valid Kubernetes secret name.
+type InvalidTargetError struct {
+	Target string
+	Reason string
+}
+
+func (e *InvalidTargetError) Error() string {
+	return fmt.Sprintf("invalid target %q: %s", e.Target, e.Reason)
+}
+
+func secretTarget(metadata *secretmanagerpb.Secret) string {
+	return metadata.GetLabels()[TargetLabelKey]
+}
+
+// syncTarget merges the secret into the Kubernetes secret named by its target, and removes it from wherever it was synchronized to before.
+func (in *Synchronizer) syncTarget(ctx context.Context, msg google.PubSubMessage, target string) error {
+	if errs := validation.IsDNS1123Subdomain(target); len(errs) > 0 {
+		err := &InvalidTargetError{Target: target, Reason: strings.Join(errs, "; ")}
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusInvalidData)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidTarget, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+		return &FormatError{Err: err}
+	}
+
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		return fmt.Errorf("getting namespace: %+v", err)
+	}
+
+	// the secret may have been synchronized on its own before it was given a target
+	secret, err := in.clientset.CoreV1().Secrets(namespace).Get(ctx, strings.ToLower(msg.GetSecretName()), metav1.GetOptions{})
+	if err == nil && kubernetes.IsOwned(*secret) && len(kubernetes.SourcesOf(*secret)) == 0 {
+		if err := in.deleteKubernetesSecret(ctx, msg, "the Secret Manager secret is merged into "+target); err != nil {
+			return err
+		}
+	}
+
+	if err := in.removeFromTargets(ctx, msg, target); err != nil {
+		return err
+	}
+
+	return in.mergeTarget(ctx, msg, namespace, target)
+}
+
+// removeFromTargets merges the targets that the secret in the message was merged into again, except the given target.
+// The secret is left out if it has been deleted, or no longer has the target.
+func (in *Synchronizer) removeFromTargets(ctx context.Context, msg google.PubSubMessage, except string) error {
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		return fmt.Errorf("getting namespace: %+v", err)
+	}
+
+	secrets, err := in.clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", kubernetes.CreatedBy, kubernetes.CreatedByValue),
+	})
+	if err != nil {
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusError)
+		return fmt.Errorf("listing merged secrets: %w", err)
+	}
+
+	for _, secret := range secrets.Items {
+		if _, ok := kubernetes.SourcesOf(secret)[msg.GetSecretName()]; !ok || secret.GetName() == except {
+			continue
+		}
+		in.logger.Infof("removing %s from merged secret %s", msg.GetSecretName(), secret.GetName())
+		if err := in.mergeTarget(ctx, msg, namespace, secret.GetName()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeTarget writes the merged payloads of the secrets with the target to the Kubernetes secret named by the target.
+// The members are the secrets already merged into it, and the secret in the message. Keys are taken from the members
+// in order of their names, so that if more than one member has a key, the value of the first member is used.
+// Members that cannot be synchronized are left out and reported, and the error of the secret in the message is returned.
+// Members that have been deleted or released keep their keys according to the deletion or release policy, after the keys
+// of the other members.
+// The Kubernetes secret is deleted when it no longer has any members, and kept as it is if its members are all invalid.
+func (in *Synchronizer) mergeTarget(ctx context.Context, msg google.PubSubMessage, namespace, target string) error {
+	secrets := in.clientset.CoreV1().Secrets(namespace)
+
+	merged := make(map[string]string)
+	removedBefore := make(map[string]kubernetes.RemovedSource)
+	existing, err := secrets.Get(ctx, target, metav1.GetOptions{})
+	switch {
+	case err == nil && (!kubernetes.IsOwned(*existing) || len(kubernetes.SourcesOf(*existing)) == 0):
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusNotManaged)
+		return fmt.Errorf("secret %s exists in cluster, but is not merged by hunter2", target)
+	case err == nil:
+		merged = kubernetes.SourcesOf(*existing)
+		removedBefore = kubernetes.RemovedSourcesOf(*existing)
+	case !errors.IsNotFound(err):
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusError)
+		return fmt.Errorf("error while getting Kubernetes secret %s: %w", target, err)
+	}
+	found := err == nil
+	versions := maps.Clone(merged)
+	versions[msg.GetSecretName()] = msg.GetSecretVersion()
+
+	names := sortedNames(versions)
+
+	sources := make(map[string]string)
+	payload := make(map[string][]byte)
+	owners := make(map[string]string)
+	removed := make(map[string]kubernetes.RemovedSource)
+	var references, conflicts, invalid []string
+	var msgErr error
+	for _, name := range names {
+		member := &internalMessage{
+			projectID:      msg.GetProjectID(),
+			secretName:     name,
+			secretVersion:  versions[name],
+			principalEmail: msg.GetPrincipalEmail(),
+			timestamp:      msg.GetTimestamp(),
+		}
+		contents, removal, err := in.memberContents(ctx, member, target)
+		if stderrors.As(err, new(*FormatError)) {
+			// invalid members must not hold back the others
+			invalid = append(invalid, name)
+			if name == msg.GetSecretName() {
+				msgErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", name, err)
+		}
+		if contents == nil {
+			if _, ok := merged[name]; ok && removal != nil {
+				removed[name] = *removal
+				sources[name] = merged[name]
+			}
+			continue
+		}
+
+		sources[name] = contents.Version
+		for _, key := range sortedKeys(contents.Payload) {
+			if owner, ok := owners[key]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s (%s, %s)", key, owner, name))
+				continue
+			}
+			owners[key] = name
+			payload[key] = contents.Payload[key]
+		}
+		for _, reference := range contents.References {
+			if !contains(references, reference) {
+				references = append(references, reference)
+			}
+		}
+	}
+
+	targetMsg := &internalMessage{projectID: msg.GetProjectID(), secretName: target}
+	if found {
+		in.keepRemovedKeys(ctx, targetMsg, existing, removedBefore, removed, sources, payload, owners)
+	}
+	if len(invalid) > 0 {
+		in.logger.Warnf("leaving out members of merged secret %s that cannot be synchronized: %s", target, strings.Join(invalid, ", "))
+		in.recordEvent(ctx, targetMsg, corev1.EventTypeWarning, EventReasonInvalidMember,
+			"Left out secrets that cannot be synchronized, see their events: %s", strings.Join(invalid, ", "))
+	}
+
+	if len(sources) == 0 {
+		if !found || len(invalid) > 0 {
+			return msgErr
+		}
+		in.logger.Infof("deleting merged k8s secret '%s', as it has no members", target)
+		err = secrets.Delete(ctx, target, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationDelete, metrics.ErrorStatus(err, metrics.StatusError))
+		if err == nil {
+			in.recordNamespaceEvent(ctx, namespace, corev1.EventTypeNormal, EventReasonDeleted, "Deleted merged secret %s, as it has no members", target)
+		}
+		return err
+	}
+
+	// the members are valid on their own, but may be too large together
+	if _, err := ValidatePayload(payload, false); err != nil {
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationUpdate, metrics.StatusTooLarge)
+		in.recordEvent(ctx, targetMsg, corev1.EventTypeWarning, EventReasonTooLarge, "Merged secret %s: %s", target, err)
+		return &FormatError{Err: err}
+	}
+
+	sort.Strings(references)
+	in.logger.Debugf("creating/updating merged k8s secret '%s'", target)
+	err = in.applySecret(ctx, kubernetes.OpaqueSecret(kubernetes.SecretData{
+		Name:           target,
+		Namespace:      namespace,
+		Payload:        payload,
+		LastModified:   msg.GetTimestamp(),
+		LastModifiedBy: msg.GetPrincipalEmail(),
+		References:     references,
+		Sources:        sources,
+		RemovedSources: removed,
+	}))
+	if err != nil {
+		return err
+	}
+
+	if len(conflicts) > 0 {
+		in.logger.Warnf("merged secret %s has keys defined by more than one secret: %s", target, strings.Join(conflicts, ", "))
+		in.recordEvent(ctx, targetMsg, corev1.EventTypeWarning, EventReasonKeyConflict,
+			"Keys defined by more than one secret, using the value from the first by name: %s", strings.Join(conflicts, ", "))
+	}
+
+	return msgErr
+}
+
+// keepRemovedKeys adds the keys of the removed members to the payload, unless other members have them. Members that were
+// removed before keep their keys and deadline, and the keys of members removed now are those of the existing secret that
+// no other member has. Members are dropped once their deadline has passed.
+func (in *Synchronizer) keepRemovedKeys(ctx context.Context, targetMsg google.PubSubMessage, existing *corev1.Secret, removedBefore, removed map[string]kubernetes.RemovedSource, sources map[string]string, payload map[string][]byte, owners map[string]string) {
+	var names, added []string
+	for name, removal := range removed {
+		if before, ok := removedBefore[name]; ok {
+			if before.Policy == removal.Policy {
+				removal = before
+			} else {
+				removal.Keys = before.Keys
+			}
+		} else {
+			added = append(added, name)
+		}
+		if removal.DeleteAfter != nil && !time.Now().Before(*removal.DeleteAfter) {
+			in.logger.Infof("removing keys of %s from merged secret %s after the grace period, as %s", name, existing.GetName(), removal.Reason)
+			delete(removed, name)
+			delete(sources, name)
+			continue
+		}
+		removed[name] = removal
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.Strings(added)
+
+	// the keys of members removed before are known, so those of members removed now are found after them
+	for _, name := range names {
+		if !contains(added, name) {
+			in.keepKeys(existing, name, removed, payload, owners)
+		}
+	}
+	for _, name := range added {
+		removal := removed[name]
+		removal.Keys = sortedKeys(existing.Data)
+		removed[name] = removal
+		in.keepKeys(existing, name, removed, payload, owners)
+
+		removal = removed[name]
+		keys := strings.Join(removal.Keys, ", ")
+		switch {
+		case removal.DeleteAfter != nil:
+			in.recordEvent(ctx, targetMsg, corev1.EventTypeWarning, EventReasonDeletionScheduled,
+				"Keys of %s will be removed after %s, as %s: %s", name, removal.DeleteAfter.Format(time.RFC3339), removal.Reason, keys)
+		case removal.Policy == string(ReleasePolicyStale):
+			in.recordEvent(ctx, targetMsg, corev1.EventTypeWarning, EventReasonReleased,
+				"Keeping the keys of %s as stale until it is synchronized again, as %s: %s", name, removal.Reason, keys)
+		default:
+			in.recordEvent(ctx, targetMsg, corev1.EventTypeWarning, EventReasonOrphaned,
+				"Keeping the keys of %s, as %s: %s", name, removal.Reason, keys)
+		}
+	}
+}
+
+// keepKeys adds the keys of the removed member that no other member has to the payload, with their existing values.
+func (in *Synchronizer) keepKeys(existing *corev1.Secret, name string, removed map[string]kubernetes.RemovedSource, payload map[string][]byte, owners map[string]string) {
+	removal := removed[name]
+	var keys []string
+	for _, key := range removal.Keys {
+		value, ok := existing.Data[key]
+		if _, owned := owners[key]; owned || !ok {
+			continue
+		}
+		owners[key] = name
+		payload[key] = value
+		keys = append(keys, key)
+	}
+	removal.Keys = keys
+	removed[name] = removal
+}
+
+// memberContents returns the payload of the latest version of the secret in the message, or nil if it is no longer a
+// member of the target. The keys of members that have been deleted or released are kept according to the deletion or
+// release policy, as described by the returned removal. Members that are typed or versioned on their own are invalid, as merged secrets are
+// always mutable and of type Opaque.
+func (in *Synchronizer) memberContents(ctx context.Context, msg google.PubSubMessage, target string) (*secretContents, *kubernetes.RemovedSource, error) {
+	metadata, err := in.secretManagerClient.GetSecretMetadata(ctx, msg.GetProjectID(), msg.GetSecretName())
+	if err != nil {
+		if err = in.ignoreNotFound(err); err != nil {
+			metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+			return nil, nil, fmt.Errorf("while getting secret manager secret metadata: %w", err)
+		}
+		return nil, in.deletedMember(), nil
+	}
+	if !secretContainsMatchingLabels(metadata) {
+		return nil, in.releasedMember(metadata), nil
+	}
+	if secretTarget(metadata) != target {
+		return nil, nil, nil
+	}
+
+	msg, raw, err := in.latestVersion(ctx, msg)
+	if err != nil {
+		if err = in.ignoreNotFound(err); err != nil {
+			metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+			return nil, nil, fmt.Errorf("while accessing secret manager secret: %w", err)
+		}
+		return nil, in.deletedMember(), nil
+	}
+
+	contents, err := in.buildPayload(ctx, msg, metadata, raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	var reasons []string
+	if contents.Type != corev1.SecretTypeOpaque {
+		reasons = append(reasons, fmt.Sprintf("it has type %s", contents.Type))
+	}
+	if contents.Retain > 0 {
+		reasons = append(reasons, fmt.Sprintf("it has the %s label", VersionedLabelKey))
+	}
+	if len(reasons) > 0 {
+		err := &InvalidTargetError{Target: target, Reason: "merged secrets are mutable and of type Opaque, but " + strings.Join(reasons, " and ")}
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusInvalidData)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidTarget, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+		return nil, nil, &FormatError{Err: err}
+	}
+	return contents, nil, nil
+}
+
+// deletedMember returns how the keys of a member whose Secret Manager secret has been deleted are kept according to the
+// deletion policy, or nil if they are removed right away.
+func (in *Synchronizer) deletedMember() *kubernetes.RemovedSource {
+	const why = "the Secret Manager secret has been deleted"
+	switch in.deletionPolicy {
+	case DeletionPolicyDelayed:
+		deleteAfter := time.Now().Add(in.deletionGracePeriod).UTC().Truncate(time.Second)
+		return &kubernetes.RemovedSource{Policy: string(DeletionPolicyDelayed), Reason: why, DeleteAfter: &deleteAfter}
+	case DeletionPolicyOrphan:
+		return &kubernetes.RemovedSource{Policy: string(DeletionPolicyOrphan), Reason: why}
+	default:
+		return nil
+	}
+}
+
+// releasedMember returns how the keys of a member that no longer has the sync label are kept according to the release
+// policy, or nil if they are removed right away.
+func (in *Synchronizer) releasedMember(metadata *secretmanagerpb.Secret) *kubernetes.RemovedSource {
+	policy := in.releasePolicyOf(metadata)
+	if policy == ReleasePolicyDelete {
+		return nil
+	}
+	why := fmt.Sprintf("the Secret Manager secret no longer has the %s=true label", MatchingSecretLabelKey)
+	return &kubernetes.RemovedSource{Policy: string(policy), Reason: why}
+}
+
+// removeExpiredSources merges the secret again once the grace period of any of its removed sources has passed, and
+// returns the number of removed sources whose keys are kept until their grace period has passed.
+func (in *Synchronizer) removeExpiredSources(ctx context.Context, secret corev1.Secret) (int, error) {
+	var pending int
+	var expired string
+	for name, removal := range kubernetes.RemovedSourcesOf(secret) {
+		switch {
+		case removal.DeleteAfter == nil:
+		case time.Now().Before(*removal.DeleteAfter):
+			pending++
+		default:
+			expired = name
+		}
+	}
+	if expired == "" {
+		return pending, nil
+	}
+
+	projectID, err := in.projectOfNamespace(ctx, secret.GetNamespace())
+	if err != nil {
+		return pending, err
+	}
+	msg := &internalMessage{
+		projectID:      projectID,
+		secretName:     expired,
+		principalEmail: kubernetes.CreatedByValue,
+		timestamp:      time.Now(),
+	}
+	return pending, in.mergeTarget(ctx, msg, secret.GetNamespace(), secret.GetName())
+}
+
+func sortedKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedNames(versions map[string]string) []string {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,97 @@
+package synchronizer
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/nais/hunter2/pkg/google"
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+// PreviousLabelKey enables writing the previous enabled version of the secret alongside the current one.
+const PreviousLabelKey = "previous"
+
+// previousVersion is the expanded payload of the previous enabled version of a secret.
+type previousVersion struct {
+	Version string
+	Data    map[string][]byte
+	// References are the names of other Secret Manager secrets that the payload was built from.
+	References []string
+}
+
+// fetchPrevious returns the enabled version of the secret before the version in the message, if enabled by the previous
+// label. The message must carry the version that is synchronized, i.e. the latest enabled version.
+// The previous version is expanded like the current one, but is not templated or converted to other types. Secrets
+// without a previous version, or whose previous version cannot be expanded, e.g. because the format of the secret has
+// changed since, return nil.
+func (in *Synchronizer) fetchPrevious(ctx context.Context, msg google.PubSubMessage, metadata *secretmanagerpb.Secret) (*previousVersion, error) {
+	if !secretLabelEnabled(metadata, PreviousLabelKey) {
+		return nil, nil
+	}
+
+	version, raw, err := in.secretManagerClient.GetPreviousSecretData(ctx, msg.GetProjectID(), msg.GetSecretName(), msg.GetSecretVersion())
+	if grpcerr, ok := status.FromError(err); ok && grpcerr.Code() == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err = in.decryptPayload(ctx, metadata, raw)
+	var data map[string][]byte
+	var references []string
+	if err == nil {
+		data, err = SecretPayload(metadata, raw)
+	}
+	if err == nil && secretFormat(metadata) != "" {
+		data, references, err = in.resolveReferences(ctx, msg.GetProjectID(), msg.GetSecretName(), data)
+		var invalidReference *ReferenceError
+		if err != nil && !stderrors.As(err, &invalidReference) {
+			return nil, fmt.Errorf("while resolving references: %w", err)
+		}
+	}
+	if err == nil {
+		data, err = KeyRulesPayload(metadata, data)
+	}
+	if err != nil {
+		in.logger.Warnf("leaving out previous version %s: %v", version, err)
+		return nil, nil
+	}
+
+	return &previousVersion{Version: version, Data: data, References: references}, nil
+}
+
+// PreviousKey returns the key for the previous value of a key: KEY_PREVIOUS for the env format, and key.previous otherwise.
+func PreviousKey(format, key string) string {
+	if format == payload.FormatEnv {
+		return key + "_PREVIOUS"
+	}
+	return key + ".previous"
+}
+
+// previousPayload adds the keys of the previous version to the payload, under the keys given by PreviousKey.
+func previousPayload(metadata *secretmanagerpb.Secret, previous *previousVersion, data map[string][]byte) (map[string][]byte, error) {
+	if previous == nil {
+		return data, nil
+	}
+
+	format := secretFormat(metadata)
+	result := make(map[string][]byte, len(data)+len(previous.Data))
+	for key, value := range data {
+		result[key] = value
+	}
+	for key, value := range previous.Data {
+		previousKey := PreviousKey(format, key)
+		if _, ok := result[previousKey]; ok {
+			return nil, &InvalidKeyError{Key: previousKey, Reason: fmt.Sprintf("key is used by the current version, and cannot hold the previous value of %q", key)}
+		}
+		result[previousKey] = value
+	}
+
+	return result, nil
+}
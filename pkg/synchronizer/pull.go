@@ -0,0 +1,209 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/metrics"
+	"github.com/nais/hunter2/pkg/sharding"
+)
+
+// Pull synchronizes the Secret Manager secrets named by the SecretPull to Kubernetes secrets in its namespace, and deletes
+// the secrets it pulled before, but no longer names. Only secrets in the project mapped to the namespace can be pulled.
+// Returns the status of every secret named by the SecretPull, or an error if none could be pulled, which is
+// sharding.ErrOtherShard if the project belongs to the shard of another replica.
+func (in *Synchronizer) Pull(ctx context.Context, pull *kubernetes.SecretPull) ([]kubernetes.SecretPullSourceStatus, error) {
+	in.syncLock.Lock()
+	defer in.syncLock.Unlock()
+
+	projectID, err := in.projectOfNamespace(ctx, pull.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	if !in.owns(projectID) {
+		return nil, sharding.ErrOtherShard
+	}
+
+	statuses := make([]kubernetes.SecretPullSourceStatus, 0, len(pull.Spec.Secrets))
+	pulled := make(map[string]bool, len(pull.Spec.Secrets))
+	for _, source := range pull.Spec.Secrets {
+		status := kubernetes.SecretPullSourceStatus{Name: source.Name}
+		name, err := sourceName(projectID, source.Name)
+		if err == nil {
+			// secrets that fail to synchronize are kept with their previous contents
+			pulled[strings.ToLower(name)] = true
+			status.AppliedVersion, err = in.pullSecret(ctx, pull, projectID, name, source)
+		}
+		if err != nil {
+			in.logger.Warnf("SecretPull %s/%s: pulling %s: %v", pull.GetNamespace(), pull.GetName(), source.Name, err)
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, in.deleteUnpulled(ctx, pull, pulled)
+}
+
+// projectOfNamespace returns the Google project mapped to the namespace, which must in turn map to the namespace.
+func (in *Synchronizer) projectOfNamespace(ctx context.Context, namespace string) (string, error) {
+	ns, err := in.clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("getting namespace %s: %w", namespace, err)
+	}
+	projectID, ok := ns.GetAnnotations()[ProjectIDAnnotation]
+	if !ok {
+		return "", fmt.Errorf("namespace %s is not mapped to a Google project", namespace)
+	}
+	mapped, err := in.getNamespaceFromProjectID(ctx, projectID)
+	if err != nil {
+		return "", err
+	}
+	if mapped != namespace {
+		return "", fmt.Errorf("project %s is mapped to namespace %s, not %s", projectID, mapped, namespace)
+	}
+	return projectID, nil
+}
+
+// sourceName returns the name of the Secret Manager secret, given as a name or as a resource name in the project.
+func sourceName(projectID, name string) (string, error) {
+	if !strings.Contains(name, "/") {
+		return name, nil
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "secrets" || parts[3] == "" {
+		return "", fmt.Errorf("invalid secret name %q, must be a name or projects/<project>/secrets/<name>", name)
+	}
+	if parts[1] != projectID {
+		return "", fmt.Errorf("secret %s is not in project %s, which is mapped to this namespace", name, projectID)
+	}
+	return parts[3], nil
+}
+
+// pullSecret synchronizes a version of the Secret Manager secret to the Kubernetes secret with the same name, owned by
+// the SecretPull. Returns the version that was synchronized.
+func (in *Synchronizer) pullSecret(ctx context.Context, pull *kubernetes.SecretPull, projectID, name string, source kubernetes.SecretPullSource) (string, error) {
+	secretName := strings.ToLower(name)
+	existing, err := in.clientset.CoreV1().Secrets(pull.GetNamespace()).Get(ctx, secretName, metav1.GetOptions{})
+	switch {
+	case err == nil && kubernetes.IsAdoptable(*existing):
+		// adopted when applied
+	case err == nil && !kubernetes.IsOwned(*existing):
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusNotManaged)
+		return "", fmt.Errorf("secret %s exists in namespace, but is not managed by hunter2", secretName)
+	case err == nil && existing.GetAnnotations()[kubernetes.PulledBy] == "":
+		return "", fmt.Errorf("secret %s is already synchronized from the labels of the Secret Manager secret", secretName)
+	case err == nil && existing.GetAnnotations()[kubernetes.PulledBy] != pull.GetName():
+		return "", fmt.Errorf("secret %s is already pulled by SecretPull %s", secretName, existing.GetAnnotations()[kubernetes.PulledBy])
+	case err != nil && !errors.IsNotFound(err):
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusError)
+		return "", fmt.Errorf("getting Kubernetes secret %s: %w", secretName, err)
+	}
+
+	metadata, err := in.secretManagerClient.GetSecretMetadata(ctx, projectID, name)
+	if err != nil {
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+		return "", fmt.Errorf("getting secret manager secret metadata: %w", err)
+	}
+	version := source.Version
+	if version == "" {
+		version = "latest"
+	}
+	version, raw, err := in.secretManagerClient.GetSecretVersionData(ctx, projectID, name, version)
+	if err != nil {
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+		return "", fmt.Errorf("accessing secret manager secret version: %w", err)
+	}
+
+	msg := &internalMessage{
+		projectID:      projectID,
+		secretName:     name,
+		secretVersion:  version,
+		principalEmail: "SecretPull/" + pull.GetName(),
+		timestamp:      time.Now(),
+	}
+	contents, err := in.buildPayload(ctx, msg, pulledMetadata(metadata, source), raw)
+	if err != nil {
+		return "", err
+	}
+
+	owner := pull.OwnerReference()
+	secretData := ToSecretData(msg, pull.GetNamespace(), contents.Payload)
+	secretData.Type = contents.Type
+	secretData.References = contents.References
+	secretData.PreviousSecretVersion = contents.PreviousVersion
+	secretData.PulledBy = pull.GetName()
+	secretData.Owner = &owner
+	if err := in.applySecret(ctx, kubernetes.OpaqueSecret(secretData)); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// pulledMetadata returns a copy of the metadata with the settings of the SecretPull applied. Pulled secrets are always
+// synchronized to a single mutable secret, regardless of the sync, target and versioned labels.
+func pulledMetadata(metadata *secretmanagerpb.Secret, source kubernetes.SecretPullSource) *secretmanagerpb.Secret {
+	pulled := proto.Clone(metadata).(*secretmanagerpb.Secret)
+	labels := make(map[string]string, len(pulled.GetLabels()))
+	for key, value := range pulled.GetLabels() {
+		labels[key] = value
+	}
+	delete(labels, TargetLabelKey)
+	delete(labels, VersionedLabelKey)
+	labels[MatchingSecretLabelKey] = "true"
+	if source.Format != "" {
+		labels[FormatLabelKey] = source.Format
+	}
+	pulled.Labels = labels
+
+	if len(source.Keys) > 0 {
+		annotations := make(map[string]string, len(pulled.GetAnnotations())+1)
+		for key, value := range pulled.GetAnnotations() {
+			annotations[key] = value
+		}
+		renames := make([]string, 0, len(source.Keys))
+		for _, key := range sortedNames(source.Keys) {
+			renames = append(renames, key+"="+source.Keys[key])
+		}
+		annotations[RenameKeysKey] = strings.Join(renames, ",")
+		pulled.Annotations = annotations
+	}
+	return pulled
+}
+
+// deleteUnpulled deletes the secrets pulled by the SecretPull that it no longer names.
+func (in *Synchronizer) deleteUnpulled(ctx context.Context, pull *kubernetes.SecretPull, pulled map[string]bool) error {
+	secrets, err := in.clientset.CoreV1().Secrets(pull.GetNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", kubernetes.CreatedBy, kubernetes.CreatedByValue),
+	})
+	if err != nil {
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusError)
+		return fmt.Errorf("listing pulled secrets: %w", err)
+	}
+
+	for _, secret := range secrets.Items {
+		if secret.GetAnnotations()[kubernetes.PulledBy] != pull.GetName() || pulled[secret.GetName()] {
+			continue
+		}
+		in.logger.Infof("deleting k8s secret '%s/%s', as SecretPull %s no longer names it", secret.GetNamespace(), secret.GetName(), pull.GetName())
+		err := in.clientset.CoreV1().Secrets(secret.GetNamespace()).Delete(ctx, secret.GetName(), metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationDelete, metrics.ErrorStatus(err, metrics.StatusError))
+		if err != nil {
+			return fmt.Errorf("deleting secret %s: %w", secret.GetName(), err)
+		}
+		in.recordNamespaceEvent(ctx, secret.GetNamespace(), corev1.EventTypeNormal, EventReasonDeleted,
+			"Deleted secret %s, as SecretPull %s no longer names it", secret.GetName(), pull.GetName())
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package synchronizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nais/hunter2/pkg/google"
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+// referencePattern matches ${sm://secret-name} and ${sm://secret-name#KEY}.
+var referencePattern = regexp.MustCompile(`\$\{sm://([a-zA-Z0-9_-]+)(?:#([^}]+))?}`)
+
+// ReferenceError is returned when a reference cannot be resolved because of the contents of Secret Manager,
+// e.g. a missing secret or key, or a cycle of references.
+type ReferenceError struct {
+	Err error
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("invalid reference: %s", e.Err)
+}
+
+func (e *ReferenceError) Unwrap() error {
+	return e.Err
+}
+
+// referenceResolver resolves references to other secrets in the same project, and remembers which secrets were referenced.
+type referenceResolver struct {
+	client     google.SecretManagerClient
+	decrypt    func(ctx context.Context, metadata *secretmanagerpb.Secret, raw []byte) ([]byte, error)
+	projectID  string
+	referenced map[string]bool
+}
+
+// resolveReferences replaces references in the values of the payload with the referenced secret,
+// or the given key of the referenced secret's payload. References are resolved recursively.
+// Returns the names of all secrets the payload depends on.
+func (in *Synchronizer) resolveReferences(ctx context.Context, projectID, secretName string, data map[string][]byte) (map[string][]byte, []string, error) {
+	resolver := &referenceResolver{
+		client:     in.secretManagerClient,
+		decrypt:    in.decryptPayload,
+		projectID:  projectID,
+		referenced: make(map[string]bool),
+	}
+
+	result, err := resolver.resolve(ctx, data, []string{secretName})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	references := make([]string, 0, len(resolver.referenced))
+	for name := range resolver.referenced {
+		references = append(references, name)
+	}
+	sort.Strings(references)
+
+	return result, references, nil
+}
+
+func (r *referenceResolver) resolve(ctx context.Context, data map[string][]byte, chain []string) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(data))
+	for key, value := range data {
+		var resolveErr error
+		result[key] = referencePattern.ReplaceAllFunc(value, func(match []byte) []byte {
+			if resolveErr != nil {
+				return nil
+			}
+			groups := referencePattern.FindSubmatch(match)
+			var resolved []byte
+			resolved, resolveErr = r.value(ctx, string(groups[1]), string(groups[2]), chain)
+			return resolved
+		})
+		if resolveErr != nil {
+			return nil, resolveErr
+		}
+	}
+	return result, nil
+}
+
+// value returns the payload of the referenced secret, or the value of the given key in its parsed payload. Either is
+// decrypted and decoded like the payload of a synchronized secret, and its references are resolved in turn.
+func (r *referenceResolver) value(ctx context.Context, secretName, key string, chain []string) ([]byte, error) {
+	for _, name := range chain {
+		if name == secretName {
+			return nil, &ReferenceError{Err: fmt.Errorf("cycle of references: %s -> %s", strings.Join(chain, " -> "), secretName)}
+		}
+	}
+	r.referenced[secretName] = true
+
+	raw, err := r.client.GetSecretData(ctx, r.projectID, secretName)
+	if err != nil {
+		return nil, notFoundAsReferenceError(err, secretName)
+	}
+	metadata, err := r.client.GetSecretMetadata(ctx, r.projectID, secretName)
+	if err != nil {
+		return nil, notFoundAsReferenceError(err, secretName)
+	}
+	raw, err = r.decrypt(ctx, metadata, raw)
+	var decryptionFailed *payload.DecryptionError
+	if err != nil && !errors.As(err, &decryptionFailed) {
+		return nil, fmt.Errorf("decrypting referenced secret %s: %w", secretName, err)
+	}
+	var value []byte
+	var ok bool
+	if err == nil {
+		value, ok, err = referencedValue(metadata, raw, key)
+	}
+	if err != nil {
+		return nil, &ReferenceError{Err: fmt.Errorf("secret %s: %w", secretName, err)}
+	}
+	if !ok {
+		return nil, &ReferenceError{Err: fmt.Errorf("secret %s has no key %q", secretName, key)}
+	}
+
+	resolved, err := r.resolve(ctx, map[string][]byte{secretName: value}, append(chain[:len(chain):len(chain)], secretName))
+	if err != nil {
+		return nil, err
+	}
+	return resolved[secretName], nil
+}
+
+// referencedValue returns the value of the key in the parsed payload, or the whole payload without a key. The whole
+// payload is only decoded for raw secrets, as the encoding applies to each value of a formatted payload.
+func referencedValue(metadata *secretmanagerpb.Secret, raw []byte, key string) ([]byte, bool, error) {
+	if key == "" {
+		if secretFormat(metadata) != "" {
+			return raw, true, nil
+		}
+		encoding := secretEncoding(metadata)
+		decoded, err := payload.Decode(encoding, raw)
+		if err != nil {
+			return nil, false, &payload.DecodeError{Encoding: encoding, Err: err}
+		}
+		return decoded, true, nil
+	}
+
+	data, err := SecretPayload(metadata, raw)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := data[key]
+	return value, ok, nil
+}
+
+func notFoundAsReferenceError(err error, secretName string) error {
+	if grpcerr, ok := status.FromError(err); ok && grpcerr.Code() == codes.NotFound {
+		return &ReferenceError{Err: fmt.Errorf("secret %s not found", secretName)}
+	}
+	return fmt.Errorf("accessing referenced secret %s: %w", secretName, err)
+}
+
+type dependentsChainKey struct{}
+
+// syncDependents synchronizes the managed secrets in the namespace that reference the secret in the message,
+// so that they pick up its changes. Secrets already synchronized in this chain of dependents are skipped.
+func (in *Synchronizer) syncDependents(ctx context.Context, msg google.PubSubMessage) {
+	chain, _ := ctx.Value(dependentsChainKey{}).([]string)
+	chain = append(chain[:len(chain):len(chain)], msg.GetSecretName())
+	ctx = context.WithValue(ctx, dependentsChainKey{}, chain)
+
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		return
+	}
+
+	secrets, err := in.clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", kubernetes.CreatedBy, kubernetes.CreatedByValue),
+	})
+	if err != nil {
+		in.logger.Errorf("listing secrets to find dependents of %s: %v", msg.GetSecretName(), err)
+		return
+	}
+
+	for _, secret := range secrets.Items {
+		// versioned secrets are immutable, and change only with new versions
+		if _, ok := kubernetes.IsVersioned(secret); ok {
+			continue
+		}
+		// pulled secrets are synchronized by their SecretPull
+		if secret.GetAnnotations()[kubernetes.PulledBy] != "" {
+			continue
+		}
+		// merged secrets are synchronized through one of their members
+		name, version := kubernetes.SecretNameOf(secret), secret.GetAnnotations()[kubernetes.SecretVersion]
+		if sources := kubernetes.SourcesOf(secret); len(sources) > 0 {
+			name = sortedNames(sources)[0]
+			version = sources[name]
+		}
+		if !dependsOn(secret, msg.GetSecretName()) || contains(chain, name) {
+			continue
+		}
+
+		in.logger.Infof("synchronizing %s, as it references %s", secret.GetName(), msg.GetSecretName())
+		dependent := &internalMessage{
+			projectID:      msg.GetProjectID(),
+			secretName:     name,
+			secretVersion:  version,
+			principalEmail: msg.GetPrincipalEmail(),
+			timestamp:      msg.GetTimestamp(),
+		}
+		if err := in.sync(ctx, dependent); err != nil {
+			in.logger.WithFields(log.Fields{"dependent": secret.GetName()}).Errorf("synchronizing dependent secret: %v", err)
+		}
+	}
+}
+
+func dependsOn(secret corev1.Secret, secretName string) bool {
+	return contains(kubernetes.ReferencesOf(secret), secretName)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// internalMessage triggers synchronization of a secret from within hunter2, e.g. when its references have changed.
+// The secret's own version is unchanged, so the message carries the version already in the cluster.
+type internalMessage struct {
+	projectID      string
+	secretName     string
+	secretVersion  string
+	principalEmail string
+	timestamp      time.Time
+}
+
+func (m *internalMessage) Ack() {
+	// not received from pubsub
+}
+
+func (m *internalMessage) Nack() {
+	// not received from pubsub
+}
+
+func (m *internalMessage) GetPrincipalEmail() string {
+	return m.principalEmail
+}
+
+func (m *internalMessage) GetProjectID() string {
+	return m.projectID
+}
+
+func (m *internalMessage) GetSecretName() string {
+	return m.secretName
+}
+
+func (m *internalMessage) GetSecretVersion() string {
+	return m.secretVersion
+}
+
+func (m *internalMessage) GetTimestamp() time.Time {
+	return m.timestamp
+}
@@ -0,0 +1,154 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/nais/hunter2/pkg/google"
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+// ReleasePolicy decides what happens to a Kubernetes secret when the sync label is removed from its Secret Manager secret.
+type ReleasePolicy string
+
+const (
+	// ReleasePolicyDelete deletes the secret as if its Secret Manager secret had been deleted, following the deletion policy.
+	ReleasePolicyDelete ReleasePolicy = "delete"
+	// ReleasePolicyOrphan keeps the secret and its data, but no longer manages it.
+	ReleasePolicyOrphan ReleasePolicy = "orphan"
+	// ReleasePolicyStale keeps the secret managed, but marks it as stale until the sync label is added back.
+	ReleasePolicyStale ReleasePolicy = "stale"
+
+	// ReleaseLabelKey overrides the release policy for a single Secret Manager secret.
+	ReleaseLabelKey = "hunter2-release"
+)
+
+func ParseReleasePolicy(policy string) (ReleasePolicy, error) {
+	switch ReleasePolicy(policy) {
+	case ReleasePolicyDelete, ReleasePolicyOrphan, ReleasePolicyStale:
+		return ReleasePolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown release policy %q, must be one of %s, %s or %s", policy, ReleasePolicyDelete, ReleasePolicyOrphan, ReleasePolicyStale)
+	}
+}
+
+// WithReleasePolicy sets what happens to Kubernetes secrets when the sync label is removed from their Secret Manager
+// secrets, unless overridden by the release label.
+func WithReleasePolicy(policy ReleasePolicy) Option {
+	return func(in *Synchronizer) {
+		in.releasePolicy = policy
+	}
+}
+
+// releasePolicyOf returns the release policy for the Secret Manager secret.
+func (in *Synchronizer) releasePolicyOf(metadata *secretmanagerpb.Secret) ReleasePolicy {
+	fallback := in.releasePolicy
+	if fallback == "" {
+		fallback = ReleasePolicyStale
+	}
+	value, ok := metadata.GetLabels()[ReleaseLabelKey]
+	if !ok {
+		return fallback
+	}
+	policy, err := ParseReleasePolicy(value)
+	if err != nil {
+		in.logger.Warnf("secret manager secret %s: %v, using the %s policy", metadata.GetName(), err, fallback)
+		return fallback
+	}
+	return policy
+}
+
+// release applies the release policy to the managed secret for the message and all its versions, once the sync label
+// has been removed from the Secret Manager secret. Secrets that are already released are left as they are.
+func (in *Synchronizer) release(ctx context.Context, msg google.PubSubMessage, metadata *secretmanagerpb.Secret) error {
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		return fmt.Errorf("getting namespace: %+v", err)
+	}
+	name := strings.ToLower(msg.GetSecretName())
+	secrets, err := in.managedSecretsOf(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	var unreleased []corev1.Secret
+	for _, secret := range secrets {
+		if !released(secret) {
+			unreleased = append(unreleased, secret)
+		}
+	}
+	if len(unreleased) == 0 {
+		return nil
+	}
+
+	policy := in.releasePolicyOf(metadata)
+	why := fmt.Sprintf("the Secret Manager secret no longer has the %s=true label", MatchingSecretLabelKey)
+	in.logger.Infof("releasing k8s secret '%s' with the %s policy, as %s", name, policy, why)
+	switch policy {
+	case ReleasePolicyDelete:
+		err = in.deleteAccordingToPolicy(ctx, msg, why)
+	case ReleasePolicyOrphan:
+		for _, secret := range unreleased {
+			if err = in.orphan(ctx, secret, why); err != nil {
+				break
+			}
+		}
+	default:
+		for _, secret := range unreleased {
+			if err = in.markStale(ctx, secret); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if policy != ReleasePolicyStale {
+		in.deleteStatus(ctx, msg)
+	}
+
+	metrics.ReleasedSecrets.WithLabelValues(string(policy)).Inc()
+	in.recordNamespaceEvent(ctx, namespace, corev1.EventTypeWarning, EventReasonReleased,
+		"Released secret %s with the %s policy, as %s", name, policy, why)
+	return nil
+}
+
+// released reports whether the secret is already marked as stale or for deletion.
+func released(secret corev1.Secret) bool {
+	_, stale := secret.GetAnnotations()[kubernetes.StaleSince]
+	_, pending := kubernetes.PendingDeletion(secret)
+	return stale || pending
+}
+
+// markStale marks the secret as no longer synchronized, keeping its data.
+func (in *Synchronizer) markStale(ctx context.Context, secret corev1.Secret) error {
+	_, err := in.patchMetadata(ctx, secret, nil, map[string]any{
+		kubernetes.StaleSince: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("marking %s as stale: %w", secret.GetName(), err)
+	}
+	return nil
+}
+
+// resume cancels the pending deletion of a secret and removes its stale mark, as it is synchronized again.
+func (in *Synchronizer) resume(ctx context.Context, secret corev1.Secret) error {
+	const why = "it is synchronized again"
+	if _, pending := kubernetes.PendingDeletion(secret); pending {
+		if err := in.cancelDeletion(ctx, secret, why); err != nil {
+			return err
+		}
+	}
+	if _, stale := secret.GetAnnotations()[kubernetes.StaleSince]; stale {
+		in.logger.Infof("k8s secret '%s' is no longer stale, as %s", secret.GetName(), why)
+		if _, err := in.patchMetadata(ctx, secret, nil, map[string]any{kubernetes.StaleSince: nil}); err != nil {
+			return fmt.Errorf("removing stale mark from %s: %w", secret.GetName(), err)
+		}
+	}
+	return nil
+}
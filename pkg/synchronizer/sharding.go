@@ -0,0 +1,34 @@
+package synchronizer
+
+// Shard decides which projects this replica synchronizes, when the projects are split between replicas.
+type Shard interface {
+	Owns(projectID string) bool
+}
+
+// WithShard makes the synchronizer synchronize only the projects in the shard, and leave the others to other replicas.
+func WithShard(shard Shard) Option {
+	return func(in *Synchronizer) {
+		in.shard = shard
+	}
+}
+
+func (in *Synchronizer) owns(projectID string) bool {
+	return in.shard == nil || in.shard.Owns(projectID)
+}
+
+// ownsNamespace reports whether the project mapped to the namespace is in the shard of this replica.
+// Namespaces that are not mapped to a project are sharded by their name.
+func (in *Synchronizer) ownsNamespace(namespace string) bool {
+	if in.shard == nil {
+		return true
+	}
+
+	in.lock.RLock()
+	defer in.lock.RUnlock()
+	for projectID, mapped := range in.projectNamespaceCache {
+		if mapped == namespace {
+			return in.shard.Owns(projectID)
+		}
+	}
+	return in.shard.Owns(namespace)
+}
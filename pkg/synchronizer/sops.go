@@ -0,0 +1,90 @@
+package synchronizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"filippo.io/age"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubernetes2 "k8s.io/client-go/kubernetes"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+// AgeIdentitySource returns age identities for decrypting SOPS payloads. Sources are read for every SOPS payload,
+// so that rotated keys are picked up without a restart.
+type AgeIdentitySource func(ctx context.Context) ([]age.Identity, error)
+
+// WithAgeIdentities enables decryption of SOPS payloads with the identities from the given sources.
+func WithAgeIdentities(sources ...AgeIdentitySource) Option {
+	return func(in *Synchronizer) {
+		in.ageIdentities = append(in.ageIdentities, sources...)
+	}
+}
+
+// AgeIdentityFile reads age identities from a file, e.g. a mounted Kubernetes secret, in the format written by age-keygen.
+func AgeIdentityFile(path string) AgeIdentitySource {
+	return func(context.Context) ([]age.Identity, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading age identities: %w", err)
+		}
+		defer file.Close()
+
+		identities, err := age.ParseIdentities(file)
+		if err != nil {
+			return nil, fmt.Errorf("parsing age identities from %s: %w", path, err)
+		}
+		return identities, nil
+	}
+}
+
+// AgeIdentitySecret reads age identities from every key of a Kubernetes secret.
+func AgeIdentitySecret(clientset kubernetes2.Interface, namespace, name string) AgeIdentitySource {
+	return func(ctx context.Context) ([]age.Identity, error) {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("reading age identities: %w", err)
+		}
+
+		keys := make([]string, 0, len(secret.Data))
+		for key := range secret.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var identities []age.Identity
+		for _, key := range keys {
+			parsed, err := age.ParseIdentities(bytes.NewReader(secret.Data[key]))
+			if err != nil {
+				return nil, fmt.Errorf("parsing age identities from %s/%s, key %s: %w", namespace, name, key, err)
+			}
+			identities = append(identities, parsed...)
+		}
+		return identities, nil
+	}
+}
+
+// decryptPayload decrypts dotenv, JSON and YAML payloads encrypted with SOPS, and returns other payloads as is.
+// Errors reading the identities are returned as is, and decryption errors as a payload.DecryptionError.
+func (in *Synchronizer) decryptPayload(ctx context.Context, metadata *secretmanagerpb.Secret, raw []byte) ([]byte, error) {
+	format := secretFormat(metadata)
+	if !payload.IsSOPS(format, raw) {
+		return raw, nil
+	}
+
+	var identities []age.Identity
+	for _, source := range in.ageIdentities {
+		sourceIdentities, err := source(ctx)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, sourceIdentities...)
+	}
+
+	return payload.DecryptSOPS(format, raw, identities)
+}
@@ -0,0 +1,146 @@
+package synchronizer
+
+import (
+	"context"
+	stderrors "errors"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/nais/hunter2/pkg/google"
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+// Reasons for the conditions of a SecretSync.
+const (
+	StatusReasonSynchronized = "Synchronized"
+	StatusReasonInvalid      = "Invalid"
+	StatusReasonFailed       = "Failed"
+	StatusReasonOutdated     = "Outdated"
+)
+
+// WithStatus makes the synchronizer maintain a SecretSync resource with the status of every synchronized secret.
+func WithStatus(client dynamic.Interface) Option {
+	return func(in *Synchronizer) {
+		in.statusClient = client
+	}
+}
+
+// recordStatus records the outcome of synchronizing the secret in the message to the target in its SecretSync.
+// Failing to record the status is logged, but does not fail the sync.
+func (in *Synchronizer) recordStatus(ctx context.Context, msg google.PubSubMessage, target string, syncErr error) {
+	if in.statusClient == nil {
+		return
+	}
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		return
+	}
+
+	secretSync, err := in.secretSync(ctx, namespace, kubernetes.SecretSyncSpec{
+		ProjectID:  msg.GetProjectID(),
+		SecretName: msg.GetSecretName(),
+		Target:     target,
+	})
+	if err != nil {
+		in.logger.Warnf("recording status: %v", err)
+		return
+	}
+
+	now := metav1.Now()
+	status := &secretSync.Status
+	status.LastVersion = msg.GetSecretVersion()
+	status.LastSyncTime = &now
+	status.LastPrincipal = msg.GetPrincipalEmail()
+	status.ObservedGeneration = secretSync.GetGeneration()
+
+	switch {
+	case syncErr == nil:
+		status.AppliedVersion = msg.GetSecretVersion()
+		status.LastError = ""
+		secretSync.SetCondition(kubernetes.ConditionSynced, true, StatusReasonSynchronized, "")
+		secretSync.SetCondition(kubernetes.ConditionValid, true, StatusReasonSynchronized, "")
+	case stderrors.As(syncErr, new(*FormatError)):
+		status.LastError = syncErr.Error()
+		secretSync.SetCondition(kubernetes.ConditionSynced, false, StatusReasonInvalid, syncErr.Error())
+		secretSync.SetCondition(kubernetes.ConditionValid, false, StatusReasonInvalid, syncErr.Error())
+	default:
+		status.LastError = syncErr.Error()
+		secretSync.SetCondition(kubernetes.ConditionSynced, false, StatusReasonFailed, syncErr.Error())
+	}
+
+	if status.AppliedVersion != status.LastVersion {
+		secretSync.SetCondition(kubernetes.ConditionStale, true, StatusReasonOutdated,
+			"the Kubernetes secret does not have the last version of the Secret Manager secret")
+	} else {
+		secretSync.SetCondition(kubernetes.ConditionStale, false, StatusReasonSynchronized, "")
+	}
+
+	object, err := secretSync.ToUnstructured()
+	if err == nil {
+		_, err = in.statusClient.Resource(kubernetes.SecretSyncResource).Namespace(namespace).UpdateStatus(ctx, object, metav1.UpdateOptions{FieldManager: kubernetes.FieldManager})
+	}
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationUpdate, metrics.ErrorStatus(err, metrics.StatusError))
+	if err != nil {
+		in.logger.Warnf("recording status: %v", err)
+	}
+}
+
+// secretSync returns the SecretSync for a Secret Manager secret, creating it or updating its spec as needed.
+func (in *Synchronizer) secretSync(ctx context.Context, namespace string, spec kubernetes.SecretSyncSpec) (*kubernetes.SecretSync, error) {
+	resource := in.statusClient.Resource(kubernetes.SecretSyncResource).Namespace(namespace)
+	desired := kubernetes.NewSecretSync(namespace, spec)
+
+	object, err := resource.Get(ctx, desired.GetName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		object, err = desired.ToUnstructured()
+		if err != nil {
+			return nil, err
+		}
+		object, err = resource.Create(ctx, object, metav1.CreateOptions{FieldManager: kubernetes.FieldManager})
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationCreate, metrics.ErrorStatus(err, metrics.StatusError))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secretSync, err := kubernetes.SecretSyncFromUnstructured(object)
+	if err != nil || secretSync.Spec == spec {
+		return secretSync, err
+	}
+
+	secretSync.Spec = spec
+	object, err = secretSync.ToUnstructured()
+	if err != nil {
+		return nil, err
+	}
+	object, err = resource.Update(ctx, object, metav1.UpdateOptions{FieldManager: kubernetes.FieldManager})
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationUpdate, metrics.ErrorStatus(err, metrics.StatusError))
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.SecretSyncFromUnstructured(object)
+}
+
+// deleteStatus deletes the SecretSync of a Secret Manager secret that no longer exists.
+func (in *Synchronizer) deleteStatus(ctx context.Context, msg google.PubSubMessage) {
+	if in.statusClient == nil {
+		return
+	}
+	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
+	if err != nil {
+		return
+	}
+
+	err = in.statusClient.Resource(kubernetes.SecretSyncResource).Namespace(namespace).Delete(ctx, strings.ToLower(msg.GetSecretName()), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return
+	}
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationDelete, metrics.ErrorStatus(err, metrics.StatusError))
+	if err != nil {
+		in.logger.Warnf("deleting status: %v", err)
+	}
+}
@@ -2,11 +2,13 @@ package synchronizer
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
 	"google.golang.org/grpc/codes"
@@ -14,17 +16,28 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	kubernetes2 "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/nais/hunter2/pkg/google"
 	"github.com/nais/hunter2/pkg/kubernetes"
 	"github.com/nais/hunter2/pkg/metrics"
+	"github.com/nais/hunter2/pkg/payload"
 )
 
 const (
 	StaticSecretDataKey    = "secret"
 	MatchingSecretLabelKey = "sync"
 	SecretContainsEnvKey   = "env"
+	FormatLabelKey         = "format"
+	NestedLabelKey         = "nested"
+	NonStringLabelKey      = "non-string"
+	DataKeyKey             = "hunter2-key"
+	SecretTypeLabelKey     = "type"
+	KeystoreLabelKey       = "keystore"
+	EncodingKey            = "encoding"
 	ProjectIDAnnotation    = "cnrm.cloud.google.com/project-id"
 )
 
@@ -33,20 +46,75 @@ type Synchronizer struct {
 	secretManagerClient   google.SecretManagerClient
 	clientset             kubernetes2.Interface
 	projectNamespaceCache map[string]string
+	recorder              record.EventRecorder
+	eventNamespace        string
+	statusClient          dynamic.Interface
+	ageIdentities         []AgeIdentitySource
+	shard                 Shard
+	deletionPolicy        DeletionPolicy
+	deletionGracePeriod   time.Duration
+	releasePolicy         ReleasePolicy
 	lock                  sync.RWMutex
+	// syncLock serializes syncs from Pub/Sub messages and SecretPull resources.
+	syncLock sync.Mutex
 }
 
-func NewSynchronizer(logger *log.Entry, secretManagerClient google.SecretManagerClient, clientSet kubernetes2.Interface, projectNamespaceCache map[string]string) *Synchronizer {
+type Option func(*Synchronizer)
+
+// WithEventRecorder makes the synchronizer record Kubernetes events for the outcome of every sync.
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(in *Synchronizer) {
+		in.recorder = recorder
+	}
+}
+
+// WithEventNamespace sets the namespace for events about secrets that cannot be mapped to a namespace, typically the
+// namespace hunter2 runs in.
+func WithEventNamespace(namespace string) Option {
+	return func(in *Synchronizer) {
+		in.eventNamespace = namespace
+	}
+}
+
+// UnknownProjectError is returned when no namespace is mapped to the project of a secret.
+type UnknownProjectError struct {
+	ProjectID string
+}
+
+func (e *UnknownProjectError) Error() string {
+	return fmt.Sprintf("no namespace found for project ID: %s", e.ProjectID)
+}
+
+// FormatError is returned when a Secret Manager secret cannot be synchronized because of its payload or labels,
+// i.e. when retrying will not help until a new version or new labels are added.
+type FormatError struct {
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	return "wrong secret format: " + e.Err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+func NewSynchronizer(logger *log.Entry, secretManagerClient google.SecretManagerClient, clientSet kubernetes2.Interface, projectNamespaceCache map[string]string, opts ...Option) *Synchronizer {
 	if projectNamespaceCache == nil {
 		projectNamespaceCache = make(map[string]string)
 	}
 
-	return &Synchronizer{
+	synchronizer := &Synchronizer{
 		logger:                logger,
 		secretManagerClient:   secretManagerClient,
 		clientset:             clientSet,
 		projectNamespaceCache: projectNamespaceCache,
 	}
+	for _, opt := range opts {
+		opt(synchronizer)
+	}
+
+	return synchronizer
 }
 
 func (in *Synchronizer) ManagedSecrets(ctx context.Context) ([]corev1.Secret, error) {
@@ -63,6 +131,20 @@ func (in *Synchronizer) ManagedSecrets(ctx context.Context) ([]corev1.Secret, er
 }
 
 func (in *Synchronizer) Sync(ctx context.Context, msg google.PubSubMessage) error {
+	if !in.owns(msg.GetProjectID()) {
+		// redelivered until it reaches the replica with the project in its shard
+		log.Debugf("project %s belongs to another shard, returning message", msg.GetProjectID())
+		metrics.LogRequest(metrics.SystemPubSub, metrics.OperationRead, metrics.StatusOtherShard)
+		msg.Nack()
+		return nil
+	}
+
+	in.syncLock.Lock()
+	defer in.syncLock.Unlock()
+	return in.sync(ctx, msg)
+}
+
+func (in *Synchronizer) sync(ctx context.Context, msg google.PubSubMessage) error {
 	in.logger = in.logger.WithFields(log.Fields{
 		"secretName":     msg.GetSecretName(),
 		"secretVersion":  msg.GetSecretVersion(),
@@ -71,6 +153,11 @@ func (in *Synchronizer) Sync(ctx context.Context, msg google.PubSubMessage) erro
 	})
 
 	if err := in.skipNonOwnedSecrets(ctx, msg); err != nil {
+		var unknownProject *UnknownProjectError
+		if stderrors.As(err, &unknownProject) {
+			in.recordNamespaceEvent(ctx, in.eventNamespace, corev1.EventTypeWarning, EventReasonUnknownProject,
+				"Secret Manager secret %s was not synchronized: %s", msg.GetSecretName(), unknownProject)
+		}
 		return err
 	}
 
@@ -80,6 +167,16 @@ func (in *Synchronizer) Sync(ctx context.Context, msg google.PubSubMessage) erro
 		if !secretContainsMatchingLabels(metadata) {
 			metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusNoSyncLabel)
 			in.logger.Debugf("secret does not contain matching labels, skipping...")
+			in.recordEvent(ctx, msg, corev1.EventTypeNormal, EventReasonNoSyncLabel,
+				"Secret Manager secret %s was not synchronized, as it does not have the %s=true label", msg.GetSecretName(), MatchingSecretLabelKey)
+			if err := in.release(ctx, msg, metadata); err != nil {
+				return fmt.Errorf("while releasing k8s secret: %w", err)
+			}
+			if err := in.removeFromTargets(ctx, msg, ""); err != nil {
+				return fmt.Errorf("while synchronizing k8s secret: %w", err)
+			}
+			// secrets that are not synchronized themselves can still be referenced by others
+			in.syncDependents(ctx, msg)
 			msg.Ack()
 			return nil
 		}
@@ -90,45 +187,271 @@ func (in *Synchronizer) Sync(ctx context.Context, msg google.PubSubMessage) erro
 		}
 	}
 
+	if target := secretTarget(metadata); target != "" {
+		// the status records the version that is merged, which is the latest enabled version
+		resolved, _, err := in.latestVersion(ctx, msg)
+		if err != nil {
+			if err = in.ignoreNotFound(err); err != nil {
+				metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+				return fmt.Errorf("while accessing secret manager secret: %w", err)
+			}
+		}
+		msg = resolved
+		err = in.syncTarget(ctx, msg, target)
+		in.recordStatus(ctx, msg, target, err)
+		if in.ackConflict(msg, err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("while synchronizing k8s secret: %w", err)
+		}
+		in.syncDependents(ctx, msg)
+		in.logger.Info("successfully processed message, acking")
+		msg.Ack()
+		return nil
+	}
+	if err := in.removeFromTargets(ctx, msg, ""); err != nil {
+		return fmt.Errorf("while synchronizing k8s secret: %w", err)
+	}
+
 	in.logger.Debugf("fetching secret data for secret: %s", msg.GetSecretName())
-	raw, err := in.secretManagerClient.GetSecretData(ctx, msg.GetProjectID(), msg.GetSecretName())
+	msg, raw, err := in.latestVersion(ctx, msg)
 	if err != nil {
 		if err = in.ignoreNotFound(err); err != nil {
 			metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
 			return fmt.Errorf("while accessing secret manager secret: %w", err)
 		}
 		// delete secret if not found in secret manager
-		err = in.deleteKubernetesSecret(ctx, msg)
+		err = in.deleteAccordingToPolicy(ctx, msg, "the Secret Manager secret has been deleted")
+		if err == nil {
+			in.deleteStatus(ctx, msg)
+		}
 	} else {
-		payload, err := SecretPayload(metadata, raw)
-		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.ErrorStatus(err, metrics.StatusInvalidData))
+		var contents *secretContents
+		contents, err = in.buildPayload(ctx, msg, metadata, raw)
 		if err != nil {
-			return fmt.Errorf("wrong secret format: %s", err)
+			in.recordStatus(ctx, msg, strings.ToLower(msg.GetSecretName()), err)
+			return err
 		}
-		err = in.createOrUpdateKubernetesSecret(ctx, msg, payload)
+		err = in.createOrUpdateKubernetesSecret(ctx, msg, contents)
+		in.recordStatus(ctx, msg, contents.target(msg), err)
 	}
 
+	if in.ackConflict(msg, err) {
+		return nil
+	}
 	if err != nil {
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonSyncFailed, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
 		return fmt.Errorf("while synchronizing k8s secret: %w", err)
 	}
 
+	in.syncDependents(ctx, msg)
+
 	in.logger.Info("successfully processed message, acking")
 	msg.Ack()
 
 	return nil
 }
 
+// ackConflict acks the message if the error is a conflict, which has already been reported with the Conflict event and
+// metric. A conflict lasts until the fields changed by others are removed, so redelivering the message would fail the
+// same way until then, and the secret is synchronized again by the next message after that.
+func (in *Synchronizer) ackConflict(msg google.PubSubMessage, err error) bool {
+	var conflict *ConflictError
+	if !stderrors.As(err, &conflict) {
+		return false
+	}
+	in.logger.Warnf("not synchronizing k8s secret, acking: %v", conflict)
+	msg.Ack()
+	return true
+}
+
+// latestVersion returns the payload of the latest enabled version of the secret in the message, and the message with
+// that version, as the latest version is what is synchronized. Messages for changes to the secret itself rather than to
+// a version carry no version, and messages for a version may arrive after newer versions have been added.
+func (in *Synchronizer) latestVersion(ctx context.Context, msg google.PubSubMessage) (google.PubSubMessage, []byte, error) {
+	version, raw, err := in.secretManagerClient.GetSecretVersionData(ctx, msg.GetProjectID(), msg.GetSecretName(), "latest")
+	if err != nil {
+		return msg, nil, err
+	}
+	return &resolvedMessage{PubSubMessage: msg, version: version}, raw, nil
+}
+
+// resolvedMessage is a message with the version of its secret that is synchronized.
+type resolvedMessage struct {
+	google.PubSubMessage
+	version string
+}
+
+func (m *resolvedMessage) GetSecretVersion() string {
+	return m.version
+}
+
+// secretContents is the result of building the payload of a Secret Manager secret.
+type secretContents struct {
+	// Version is the version of the Secret Manager secret the payload was built from.
+	Version string
+	Type    corev1.SecretType
+	Payload map[string][]byte
+	// References are the names of other Secret Manager secrets that the payload was built from.
+	References []string
+	// PreviousVersion is the version of the previous values in the payload, if any.
+	PreviousVersion string
+	// Retain is the number of versions to keep for versioned secrets, or zero for mutable secrets.
+	Retain int
+}
+
+// target returns the name of the Kubernetes secret the contents are written to.
+func (c *secretContents) target(msg google.PubSubMessage) string {
+	if c.Retain > 0 {
+		return kubernetes.VersionedName(msg.GetSecretName(), msg.GetSecretVersion())
+	}
+	return strings.ToLower(msg.GetSecretName())
+}
+
+// buildPayload runs the payload through decryption, parsing, reference resolution, key rules, templating,
+// type conversion, keystore generation, previous versions and validation.
+// Errors caused by the contents of the secret are counted and recorded as events.
+func (in *Synchronizer) buildPayload(ctx context.Context, msg google.PubSubMessage, metadata *secretmanagerpb.Secret, raw []byte) (*secretContents, error) {
+	templateText, err := in.fetchTemplate(ctx, msg.GetProjectID(), metadata)
+	if err != nil {
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+		return nil, fmt.Errorf("while accessing template secret: %w", err)
+	}
+	previous, err := in.fetchPrevious(ctx, msg, metadata)
+	if err != nil {
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+		return nil, fmt.Errorf("while accessing previous secret version: %w", err)
+	}
+
+	var decryptionFailed *payload.DecryptionError
+	raw, err = in.decryptPayload(ctx, metadata, raw)
+	if err != nil && !stderrors.As(err, &decryptionFailed) {
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+		return nil, fmt.Errorf("while decrypting payload: %w", err)
+	}
+
+	var secretType corev1.SecretType
+	var references []string
+	var payload map[string][]byte
+	if err == nil {
+		payload, err = SecretPayload(metadata, raw)
+	}
+	if err == nil && secretFormat(metadata) != "" {
+		payload, references, err = in.resolveReferences(ctx, msg.GetProjectID(), msg.GetSecretName(), payload)
+		var invalidReference *ReferenceError
+		if err != nil && !stderrors.As(err, &invalidReference) {
+			metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusError)
+			return nil, fmt.Errorf("while resolving references: %w", err)
+		}
+	}
+	if err == nil {
+		payload, err = KeyRulesPayload(metadata, payload)
+	}
+	if templateSecret, ok := metadata.GetAnnotations()[TemplateSecretKey]; ok && !contains(references, templateSecret) {
+		references = append(references, templateSecret)
+	}
+	if err == nil {
+		payload, err = TemplatePayload(metadata, templateText, payload)
+	}
+	if err == nil {
+		secretType, payload, err = TypedSecretPayload(metadata, payload)
+	}
+	if err == nil {
+		payload, err = KeystorePayload(metadata, payload)
+	}
+	if err == nil {
+		payload, err = previousPayload(metadata, previous, payload)
+	}
+	if previous != nil {
+		for _, reference := range previous.References {
+			if !contains(references, reference) {
+				references = append(references, reference)
+			}
+		}
+	}
+	var retain int
+	if err == nil {
+		retain, err = secretRetain(metadata, msg.GetSecretVersion())
+	}
+	if err == nil {
+		var warnings []string
+		warnings, err = ValidatePayload(payload, secretStrict(metadata))
+		for _, warning := range warnings {
+			in.logger.Warnf("secret manager secret %s: %s", msg.GetSecretName(), warning)
+		}
+	}
+
+	var invalidKey *InvalidKeyError
+	var invalidType *InvalidTypeError
+	var invalidTemplate *TemplateError
+	var invalidReference *ReferenceError
+	var invalidPayload *ValidationError
+	switch {
+	case stderrors.As(err, &invalidKey):
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusInvalidKey)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidKey, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	case stderrors.As(err, &invalidType):
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusInvalidData)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidType, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	case stderrors.As(err, &invalidTemplate):
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusInvalidTemplate)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidTemplate, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	case stderrors.As(err, &invalidReference):
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusInvalidData)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidReference, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	case stderrors.As(err, &decryptionFailed):
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusDecryptionFailed)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonDecryptionFailed, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	case stderrors.As(err, &invalidPayload) && invalidPayload.Status == metrics.StatusTooLarge:
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, invalidPayload.Status)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonTooLarge, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	case stderrors.As(err, &invalidPayload):
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, invalidPayload.Status)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidPayload, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	case err != nil:
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusInvalidData)
+		in.recordEvent(ctx, msg, corev1.EventTypeWarning, EventReasonInvalidPayload, "Secret Manager secret %s: %s", msg.GetSecretName(), err)
+	default:
+		metrics.LogRequest(metrics.SystemSecretManager, metrics.OperationRead, metrics.StatusSuccess)
+	}
+	if err != nil {
+		return nil, &FormatError{Err: err}
+	}
+
+	contents := &secretContents{
+		Version:    msg.GetSecretVersion(),
+		Type:       secretType,
+		Payload:    payload,
+		References: references,
+		Retain:     retain,
+	}
+	if previous != nil {
+		contents.PreviousVersion = previous.Version
+	}
+	return contents, nil
+}
+
 func (in *Synchronizer) skipNonOwnedSecrets(ctx context.Context, msg google.PubSubMessage) error {
 	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
 	if err != nil {
-		return fmt.Errorf("getting namespace: %+v", err)
+		return fmt.Errorf("getting namespace: %w", err)
 	}
 	secret, err := in.clientset.CoreV1().Secrets(namespace).Get(ctx, msg.GetSecretName(), metav1.GetOptions{})
 	switch {
+	case err == nil && kubernetes.IsAdoptable(*secret):
+		in.logger.Debugf("secret %s is not managed by hunter2, but will be adopted", msg.GetSecretName())
+		return nil
 	case err == nil && !kubernetes.IsOwned(*secret):
 		msg.Ack()
 		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusNotManaged)
+		in.eventf(secret, corev1.EventTypeWarning, EventReasonNotManaged,
+			"Secret Manager secret %s was not synchronized, as this secret is not managed by hunter2", msg.GetSecretName())
 		return fmt.Errorf("secret %s exists in cluster, but is not managed by hunter2", msg.GetSecretName())
+	case err == nil && secret.GetAnnotations()[kubernetes.PulledBy] != "":
+		msg.Ack()
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusNotManaged)
+		return fmt.Errorf("secret %s is pulled by SecretPull %s", msg.GetSecretName(), secret.GetAnnotations()[kubernetes.PulledBy])
 	case err != nil && !errors.IsNotFound(err):
 		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusError)
 		return fmt.Errorf("error while getting Kubernetes secret %s: %w", msg.GetSecretName(), err)
@@ -147,37 +470,155 @@ func (in *Synchronizer) ignoreNotFound(err error) error {
 	return fmt.Errorf("error while performing secret manager operation: %w", err)
 }
 
-func (in *Synchronizer) createOrUpdateKubernetesSecret(ctx context.Context, msg google.PubSubMessage, payload map[string][]byte) error {
+func (in *Synchronizer) createOrUpdateKubernetesSecret(ctx context.Context, msg google.PubSubMessage, contents *secretContents) error {
 	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
 	if err != nil {
 		return fmt.Errorf("getting namespace: %+v", err)
 	}
-	secret := kubernetes.OpaqueSecret(ToSecretData(msg, namespace, payload))
-	in.logger.Debugf("creating/updating k8s secret '%s'", msg.GetSecretName())
+	secretData := ToSecretData(msg, namespace, contents.Payload)
+	secretData.Type = contents.Type
+	secretData.References = contents.References
+	secretData.PreviousSecretVersion = contents.PreviousVersion
+	secretData.Retain = contents.Retain
+	if contents.Retain > 0 {
+		return in.createVersionedSecret(ctx, kubernetes.OpaqueSecret(secretData))
+	}
+	in.logger.Debugf("applying k8s secret '%s'", msg.GetSecretName())
+
+	return in.applySecret(ctx, kubernetes.OpaqueSecret(secretData))
+}
+
+// ConflictError is returned when fields of a secret set by hunter2 are managed by another field manager,
+// e.g. after someone has edited the secret with kubectl.
+type ConflictError struct {
+	Name string
+	Err  error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("fields of secret %s written by hunter2 have been changed by others: %s", e.Name, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// applySecret creates or updates the secret with server-side apply, so that only the data, labels and annotations set by
+// hunter2 are changed, and fields added by others are kept. Writes that would not change the secret are skipped, as every
+// write triggers a rollout of the workloads using the secret.
+func (in *Synchronizer) applySecret(ctx context.Context, secret *corev1.Secret) error {
+	existing, err := in.clientset.CoreV1().Secrets(secret.GetNamespace()).Get(ctx, secret.GetName(), metav1.GetOptions{})
+	if err == nil && !kubernetes.IsOwned(*existing) {
+		_, err := in.adopt(ctx, existing, secret)
+		return err
+	}
+	if err == nil {
+		if err := in.resume(ctx, *existing); err != nil {
+			return err
+		}
+	}
+	if err == nil && kubernetes.Unchanged(existing, secret) {
+		in.logger.Debugf("k8s secret '%s' is unchanged, skipping write", secret.GetName())
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationApply, metrics.StatusUnchanged)
+		return nil
+	}
+	created := errors.IsNotFound(err)
 
-	_, err = in.clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
-	if err != nil && errors.IsAlreadyExists(err) {
-		_, err = in.clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
-		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationUpdate, metrics.ErrorStatus(err, metrics.StatusError))
+	applied, err := in.apply(ctx, secret, false)
+	if errors.IsConflict(err) {
+		applied, err = in.resolveConflict(ctx, secret, err)
+	}
+	if errors.IsInvalid(err) {
+		applied, err = in.replaceOnTypeChange(ctx, secret, err)
+	}
+
+	status := metrics.ErrorStatus(err, metrics.StatusError)
+	if stderrors.As(err, new(*ConflictError)) {
+		status = metrics.StatusConflict
+	}
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationApply, status)
+	if err != nil {
 		return err
 	}
 
-	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationCreate, metrics.ErrorStatus(err, metrics.StatusError))
-	return err
+	if created {
+		in.eventf(applied, corev1.EventTypeNormal, EventReasonCreated, "Created from %s", describeSource(secret))
+	} else {
+		in.eventf(applied, corev1.EventTypeNormal, EventReasonUpdated, "Updated from %s", describeSource(secret))
+	}
+	return nil
+}
+
+func (in *Synchronizer) apply(ctx context.Context, secret *corev1.Secret, force bool) (*corev1.Secret, error) {
+	return in.clientset.CoreV1().Secrets(secret.GetNamespace()).Apply(ctx, kubernetes.ApplyConfiguration(secret), metav1.ApplyOptions{
+		FieldManager: kubernetes.FieldManager,
+		Force:        force,
+	})
+}
+
+// resolveConflict takes over the fields that hunter2 wrote with updates before using server-side apply, which are
+// managed by hunter2 with the update operation. Conflicts with other field managers are reported with an event.
+func (in *Synchronizer) resolveConflict(ctx context.Context, secret *corev1.Secret, applyErr error) (*corev1.Secret, error) {
+	existing, err := in.clientset.CoreV1().Secrets(secret.GetNamespace()).Get(ctx, secret.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return nil, applyErr
+	}
+
+	for _, entry := range existing.GetManagedFields() {
+		if entry.Manager == kubernetes.FieldManager && entry.Operation == metav1.ManagedFieldsOperationUpdate {
+			in.logger.Infof("taking over fields of k8s secret '%s' written before server-side apply", secret.GetName())
+			return in.apply(ctx, secret, true)
+		}
+	}
+
+	err = &ConflictError{Name: secret.GetName(), Err: applyErr}
+	in.eventf(existing, corev1.EventTypeWarning, EventReasonConflict, "%s", err)
+	return nil, err
+}
+
+// replaceOnTypeChange deletes and recreates the secret if its type has changed, as the type of a secret is immutable.
+// Otherwise, the original apply error is returned.
+func (in *Synchronizer) replaceOnTypeChange(ctx context.Context, secret *corev1.Secret, applyErr error) (*corev1.Secret, error) {
+	secrets := in.clientset.CoreV1().Secrets(secret.GetNamespace())
+
+	existing, err := secrets.Get(ctx, secret.GetName(), metav1.GetOptions{})
+	if err != nil || existing.Type == secret.Type {
+		return nil, applyErr
+	}
+
+	in.logger.Infof("secret type changed from %s to %s, replacing k8s secret '%s'", existing.Type, secret.Type, secret.GetName())
+	err = secrets.Delete(ctx, secret.GetName(), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("deleting secret to change its type: %w", err)
+	}
+	return in.apply(ctx, secret, false)
 }
 
-func (in *Synchronizer) deleteKubernetesSecret(ctx context.Context, msg google.PubSubMessage) error {
+// deleteKubernetesSecret deletes the secret for the message and all its versions, recording why in an event on the namespace.
+func (in *Synchronizer) deleteKubernetesSecret(ctx context.Context, msg google.PubSubMessage, why string) error {
 	namespace, err := in.getNamespaceFromProjectID(ctx, msg.GetProjectID())
 	if err != nil {
 		return fmt.Errorf("getting namespace: %+v", err)
 	}
+	if err := in.deleteVersionedSecrets(ctx, namespace, strings.ToLower(msg.GetSecretName()), why); err != nil {
+		return err
+	}
+	secrets := in.clientset.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(ctx, msg.GetSecretName(), metav1.GetOptions{})
+	if err == nil && !kubernetes.IsOwned(*secret) {
+		// not adopted yet
+		return nil
+	}
 	in.logger.Debugf("deleting k8s secret '%s'", msg.GetSecretName())
-	err = in.clientset.CoreV1().Secrets(namespace).Delete(ctx, msg.GetSecretName(), metav1.DeleteOptions{})
+	err = secrets.Delete(ctx, msg.GetSecretName(), metav1.DeleteOptions{})
 	if err != nil && errors.IsNotFound(err) {
 		return nil
 	}
 
 	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationDelete, metrics.ErrorStatus(err, metrics.StatusError))
+	if err == nil {
+		in.recordNamespaceEvent(ctx, namespace, corev1.EventTypeNormal, EventReasonDeleted, "Deleted secret %s, as %s", strings.ToLower(msg.GetSecretName()), why)
+	}
 
 	return err
 }
@@ -192,9 +633,24 @@ func (in *Synchronizer) getNamespaceFromProjectID(ctx context.Context, projectID
 
 	log.Infof("cache miss for project id: %s, updating cache", projectID)
 
+	if err := in.RefreshProjectNamespaces(ctx); err != nil {
+		return "", err
+	}
+
+	in.lock.RLock()
+	defer in.lock.RUnlock()
+	if namespace, ok := in.projectNamespaceCache[projectID]; ok {
+		return namespace, nil
+	} else {
+		return "", &UnknownProjectError{ProjectID: projectID}
+	}
+}
+
+// RefreshProjectNamespaces caches the namespaces mapped to Google projects, e.g. to keep the cache warm on standby replicas.
+func (in *Synchronizer) RefreshProjectNamespaces(ctx context.Context) error {
 	namespaces, err := in.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return "", fmt.Errorf("listing namespaces: %+v", err)
+		return fmt.Errorf("listing namespaces: %+v", err)
 	}
 
 	for _, namespace := range namespaces.Items {
@@ -205,14 +661,7 @@ func (in *Synchronizer) getNamespaceFromProjectID(ctx context.Context, projectID
 			log.Debugf("caching: %s=%s", projectID, namespace.Name)
 		}
 	}
-
-	in.lock.RLock()
-	defer in.lock.RUnlock()
-	if namespace, ok := in.projectNamespaceCache[projectID]; ok {
-		return namespace, nil
-	} else {
-		return "", fmt.Errorf("no namespace found for project ID: %s", projectID)
-	}
+	return nil
 }
 
 func ToSecretData(msg google.PubSubMessage, namespace string, payload map[string][]byte) kubernetes.SecretData {
@@ -222,28 +671,126 @@ func ToSecretData(msg google.PubSubMessage, namespace string, payload map[string
 		LastModified:   msg.GetTimestamp(),
 		LastModifiedBy: msg.GetPrincipalEmail(),
 		SecretVersion:  msg.GetSecretVersion(),
+		SecretName:     msg.GetSecretName(),
 		Payload:        payload,
 	}
 }
 
 func SecretPayload(metadata *secretmanagerpb.Secret, raw []byte) (map[string][]byte, error) {
-	if secretContainsEnvironmentVariables(metadata) {
-		stringMap, err := godotenv.Unmarshal(string(raw))
+	encoding := secretEncoding(metadata)
+	format := secretFormat(metadata)
+	if format == "" {
+		key, err := secretDataKey(metadata)
 		if err != nil {
 			return nil, err
 		}
-
-		byteMap := make(map[string][]byte)
-		for key, value := range stringMap {
-			byteMap[key] = []byte(value)
+		decoded, err := payload.Decode(encoding, raw)
+		if err != nil {
+			return nil, &payload.DecodeError{Encoding: encoding, Err: err}
 		}
-
-		return byteMap, nil
-	} else {
 		return map[string][]byte{
-			StaticSecretDataKey: raw,
+			key: decoded,
 		}, nil
 	}
+
+	data, err := payload.Parse(format, raw, payload.Options{
+		Nested:    metadata.GetLabels()[NestedLabelKey],
+		NonString: metadata.GetLabels()[NonStringLabelKey],
+		Strict:    secretStrict(metadata),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payload.DecodeValues(encoding, data)
+}
+
+// secretEncoding returns the encoding of the payload, or of each value for expanded payloads, given by the encoding annotation or label.
+// As label values cannot contain +, gzip-base64 is accepted as a label value for gzip+base64.
+func secretEncoding(metadata *secretmanagerpb.Secret) string {
+	if encoding, ok := metadata.GetAnnotations()[EncodingKey]; ok {
+		return encoding
+	}
+	encoding := metadata.GetLabels()[EncodingKey]
+	if encoding == "gzip-base64" {
+		return payload.EncodingGzipBase64
+	}
+	return encoding
+}
+
+// secretFormat returns the payload format of the secret, or an empty string for raw secrets.
+// The env label is kept as a shorthand for the env format.
+func secretFormat(metadata *secretmanagerpb.Secret) string {
+	if format, ok := metadata.GetLabels()[FormatLabelKey]; ok {
+		return format
+	}
+	if secretContainsEnvironmentVariables(metadata) {
+		return payload.FormatEnv
+	}
+	return ""
+}
+
+// InvalidKeyError is returned when a secret asks for a data key that is not valid in a Kubernetes secret.
+type InvalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid data key %q: %s", e.Key, e.Reason)
+}
+
+// InvalidTypeError is returned when a secret has an unsupported type, or a payload that is not valid for its type.
+type InvalidTypeError struct {
+	Err error
+}
+
+func (e *InvalidTypeError) Error() string {
+	return fmt.Sprintf("invalid secret type: %s", e.Err)
+}
+
+func (e *InvalidTypeError) Unwrap() error {
+	return e.Err
+}
+
+// TypedSecretPayload returns the Kubernetes secret type given by the type label, along with the payload converted to that type.
+func TypedSecretPayload(metadata *secretmanagerpb.Secret, payload map[string][]byte) (corev1.SecretType, map[string][]byte, error) {
+	secretType, err := kubernetes.ParseSecretType(metadata.GetLabels()[SecretTypeLabelKey])
+	if err != nil {
+		return "", nil, &InvalidTypeError{Err: err}
+	}
+
+	payload, err = kubernetes.TypedPayload(secretType, payload)
+	if err != nil {
+		return "", nil, &InvalidTypeError{Err: fmt.Errorf("%s: %w", secretType, err)}
+	}
+
+	return secretType, payload, nil
+}
+
+// KeystorePayload adds Java keystores to the payload if the secret has the keystore label.
+func KeystorePayload(metadata *secretmanagerpb.Secret, data map[string][]byte) (map[string][]byte, error) {
+	if !secretLabelEnabled(metadata, KeystoreLabelKey) {
+		return data, nil
+	}
+	return payload.Keystores(data)
+}
+
+// secretDataKey returns the key for raw payloads, configured by annotation or label.
+// Annotations allow any key, while label values cannot contain e.g. dots.
+func secretDataKey(metadata *secretmanagerpb.Secret) (string, error) {
+	key, ok := metadata.GetAnnotations()[DataKeyKey]
+	if !ok {
+		key, ok = metadata.GetLabels()[DataKeyKey]
+	}
+	if !ok {
+		return StaticSecretDataKey, nil
+	}
+
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return "", &InvalidKeyError{Key: key, Reason: strings.Join(errs, "; ")}
+	}
+
+	return key, nil
 }
 
 func secretLabelEnabled(metadata *secretmanagerpb.Secret, key string) bool {
@@ -2,9 +2,13 @@ package synchronizer_test
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"filippo.io/age"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
@@ -13,10 +17,16 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
 	kubernetesFake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/nais/hunter2/pkg/fake"
+	"github.com/nais/hunter2/pkg/google"
 	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/sharding"
 	"github.com/nais/hunter2/pkg/synchronizer"
 )
 
@@ -26,7 +36,7 @@ func init() {
 
 var (
 	logger           = log.NewEntry(log.StandardLogger())
-	kubernetesClient = kubernetesFake.NewSimpleClientset()
+	kubernetesClient = kubernetesFake.NewClientset()
 	projectID        = "12345678"
 	namespace        = "some-namespace"
 	principalEmail   = "some-principal@domain.test"
@@ -52,6 +62,33 @@ var (
 	}
 )
 
+// drainEvents returns the events recorded so far.
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// ackedMessage counts how often the message is acked and nacked.
+type ackedMessage struct {
+	google.PubSubMessage
+	acks, nacks int
+}
+
+func (m *ackedMessage) Ack() {
+	m.acks++
+}
+
+func (m *ackedMessage) Nack() {
+	m.nacks++
+}
+
 func TestToSecretData(t *testing.T) {
 	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
 	payload, err := synchronizer.SecretPayload(metadata, genericPayload)
@@ -106,14 +143,19 @@ func TestSynchronizer_Sync_CreateNewSecret(t *testing.T) {
 		kubernetes.LastModified:        timestamp.Format(time.RFC3339),
 		kubernetes.LastModifiedBy:      principalEmail,
 		kubernetes.SecretVersion:       secretVersion,
+		kubernetes.SecretName:          secretName,
 		kubernetes.StakaterReloaderKey: "true",
+		kubernetes.ContentHash:         secret.GetAnnotations()[kubernetes.ContentHash],
 	}, secret.GetAnnotations())
+	assert.Len(t, secret.GetAnnotations()[kubernetes.ContentHash], 64)
 }
 
 func TestSynchronizer_Sync_UpdateExistingSecret(t *testing.T) {
 	secretVersion = "2"
 
-	secretManagerClient := fake.NewSecretManagerClient(genericPayload, metadata, nil)
+	secretManagerClient := fake.NewSecretManagerClientWithSecrets(map[string]fake.Secret{
+		secretName: {Data: genericPayload, Metadata: metadata, Version: secretVersion},
+	})
 	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, kubernetesClient, cache)
 	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
 
@@ -151,6 +193,8 @@ func TestSynchronizer_Sync_SkipNonOwnedSecret(t *testing.T) {
 
 	secret, err := kubernetesClient.CoreV1().Secrets(namespace).Get(ctx, nonOwnedSecretName, metav1.GetOptions{})
 	assert.NoError(t, err)
+	// the managed fields record the create above
+	secret.ManagedFields = nil
 	assert.Equal(t, nonOwnedSecret, secret)
 }
 
@@ -183,3 +227,1679 @@ func TestSynchronizer_Sync_DeleteNotFoundSecret(t *testing.T) {
 	assert.Error(t, err)
 	assert.True(t, errors.IsNotFound(err))
 }
+
+func TestServiceAccountResolver(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "annotated",
+				Annotations: map[string]string{
+					synchronizer.ProjectIDAnnotation:                 "annotated-project",
+					synchronizer.ImpersonateServiceAccountAnnotation: "team@annotated-project.iam.gserviceaccount.com",
+				},
+			},
+		},
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "plain",
+				Annotations: map[string]string{
+					synchronizer.ProjectIDAnnotation: "plain-project",
+				},
+			},
+		},
+	)
+	static := map[string]string{
+		"static-project": "team@static-project.iam.gserviceaccount.com",
+	}
+	resolve := synchronizer.NewServiceAccounts(clientset, static).Resolve
+
+	serviceAccount, err := resolve(ctx, "static-project")
+	assert.NoError(t, err)
+	assert.Equal(t, "team@static-project.iam.gserviceaccount.com", serviceAccount)
+
+	serviceAccount, err = resolve(ctx, "annotated-project")
+	assert.NoError(t, err)
+	assert.Equal(t, "team@annotated-project.iam.gserviceaccount.com", serviceAccount)
+
+	serviceAccount, err = resolve(ctx, "plain-project")
+	assert.NoError(t, err)
+	assert.Empty(t, serviceAccount)
+}
+
+func TestServiceAccounts_Refresh(t *testing.T) {
+	annotated := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "annotated",
+			Annotations: map[string]string{
+				synchronizer.ProjectIDAnnotation:                 "annotated-project",
+				synchronizer.ImpersonateServiceAccountAnnotation: "team@annotated-project.iam.gserviceaccount.com",
+			},
+		},
+	}
+	clientset := kubernetesFake.NewClientset(annotated)
+	serviceAccounts := synchronizer.NewServiceAccounts(clientset, nil)
+	listed := func() int {
+		var lists int
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "list" && action.GetResource().Resource == "namespaces" {
+				lists++
+			}
+		}
+		return lists
+	}
+
+	// projects without a service account are cached as well
+	for i := 0; i < 3; i++ {
+		serviceAccount, err := serviceAccounts.Resolve(ctx, "unknown-project")
+		assert.NoError(t, err)
+		assert.Empty(t, serviceAccount)
+		serviceAccount, err = serviceAccounts.Resolve(ctx, "annotated-project")
+		assert.NoError(t, err)
+		assert.Equal(t, "team@annotated-project.iam.gserviceaccount.com", serviceAccount)
+	}
+	assert.Equal(t, 1, listed())
+
+	// removed annotations are picked up on refresh
+	delete(annotated.Annotations, synchronizer.ImpersonateServiceAccountAnnotation)
+	_, err := clientset.CoreV1().Namespaces().Update(ctx, annotated, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, serviceAccounts.Refresh(ctx))
+	serviceAccount, err := serviceAccounts.Resolve(ctx, "annotated-project")
+	assert.NoError(t, err)
+	assert.Empty(t, serviceAccount)
+	assert.Equal(t, 2, listed())
+}
+
+func TestSecretPayload_JSON(t *testing.T) {
+	metadataWithJSON := &secretmanagerpb.Secret{
+		Name: secretName,
+		Labels: map[string]string{
+			"sync":       "true",
+			"format":     "json",
+			"nested":     "json",
+			"non-string": "reject",
+		},
+	}
+
+	payload, err := synchronizer.SecretPayload(metadataWithJSON, []byte(`{"FOO": "BAR", "nested": {"BAR": "BAZ"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"FOO":    []byte("BAR"),
+		"nested": []byte(`{"BAR":"BAZ"}`),
+	}, payload)
+
+	_, err = synchronizer.SecretPayload(metadataWithJSON, []byte(`{"FOO": 1}`))
+	assert.Error(t, err)
+}
+
+func TestSecretPayload_Formats(t *testing.T) {
+	for format, raw := range map[string][]byte{
+		"env":        []byte("FOO=BAR\n"),
+		"json":       []byte(`{"FOO": "BAR"}`),
+		"yaml":       []byte("FOO: BAR\n"),
+		"properties": []byte("FOO = BAR\n"),
+	} {
+		t.Run(format, func(t *testing.T) {
+			metadataWithFormat := &secretmanagerpb.Secret{
+				Name: secretName,
+				Labels: map[string]string{
+					"sync":   "true",
+					"format": format,
+				},
+			}
+
+			payload, err := synchronizer.SecretPayload(metadataWithFormat, raw)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]byte{"FOO": []byte("BAR")}, payload)
+		})
+	}
+}
+
+func TestSecretPayload_UnsupportedFormat(t *testing.T) {
+	metadataWithFormat := &secretmanagerpb.Secret{
+		Name: secretName,
+		Labels: map[string]string{
+			"sync":   "true",
+			"format": "toml",
+		},
+	}
+
+	_, err := synchronizer.SecretPayload(metadataWithFormat, genericPayload)
+	assert.EqualError(t, err, `unsupported format "toml"`)
+}
+
+func TestSecretPayload_DataKey(t *testing.T) {
+	metadataWithAnnotation := &secretmanagerpb.Secret{
+		Name:        secretName,
+		Labels:      map[string]string{"sync": "true", "hunter2-key": "password"},
+		Annotations: map[string]string{"hunter2-key": "credentials.json"},
+	}
+	payload, err := synchronizer.SecretPayload(metadataWithAnnotation, genericPayload)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"credentials.json": genericPayload}, payload)
+
+	metadataWithLabel := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "hunter2-key": "password"},
+	}
+	payload, err = synchronizer.SecretPayload(metadataWithLabel, genericPayload)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"password": genericPayload}, payload)
+
+	metadataWithInvalidKey := &secretmanagerpb.Secret{
+		Name:        secretName,
+		Labels:      map[string]string{"sync": "true"},
+		Annotations: map[string]string{"hunter2-key": "../etc/passwd"},
+	}
+	_, err = synchronizer.SecretPayload(metadataWithInvalidKey, genericPayload)
+	assert.ErrorAs(t, err, new(*synchronizer.InvalidKeyError))
+}
+
+func TestSynchronizer_Sync_InvalidDataKey(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	})
+	recorder := record.NewFakeRecorder(10)
+	metadataWithInvalidKey := &secretmanagerpb.Secret{
+		Name:        secretName,
+		Labels:      map[string]string{"sync": "true"},
+		Annotations: map[string]string{"hunter2-key": "not/valid"},
+	}
+
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+	secretManagerClient := fake.NewSecretManagerClient(genericPayload, metadataWithInvalidKey, nil)
+	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, clientset, cache, synchronizer.WithEventRecorder(recorder))
+
+	err := syncer.Sync(ctx, msg)
+	assert.Error(t, err)
+
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	assert.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "Warning InvalidKey")
+	assert.Contains(t, event, `invalid data key "not/valid"`)
+}
+
+func TestSynchronizer_Sync_InvalidSecretType(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	})
+	recorder := record.NewFakeRecorder(10)
+	metadataWithType := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "type": "tls"},
+	}
+
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+	secretManagerClient := fake.NewSecretManagerClient(genericPayload, metadataWithType, nil)
+	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, clientset, cache, synchronizer.WithEventRecorder(recorder))
+
+	err := syncer.Sync(ctx, msg)
+	assert.Error(t, err)
+
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.Contains(t, <-recorder.Events, "Warning InvalidType Secret Manager secret some-secret: invalid secret type: kubernetes.io/tls: PEM bundle contains no certificates")
+}
+
+func TestSynchronizer_Sync_TypedSecret(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	metadataWithType := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "type": "dockerconfigjson"},
+	}
+	config := []byte(`{"auths": {"europe-north1-docker.pkg.dev": {"auth": "dXNlcjpwYXNz"}}}`)
+
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+	secretManagerClient := fake.NewSecretManagerClient(config, metadataWithType, nil)
+	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, clientset, cache)
+
+	err := syncer.Sync(ctx, msg)
+	assert.NoError(t, err)
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeDockerConfigJson, secret.Type)
+	assert.Equal(t, map[string][]byte{corev1.DockerConfigJsonKey: config}, secret.Data)
+}
+
+func TestKeystorePayload(t *testing.T) {
+	data := map[string][]byte{"secret": genericPayload}
+
+	actual, err := synchronizer.KeystorePayload(metadata, data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, actual)
+
+	metadataWithKeystore := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "keystore": "true"},
+	}
+	_, err = synchronizer.KeystorePayload(metadataWithKeystore, data)
+	assert.EqualError(t, err, "PEM bundle contains no certificates")
+}
+
+func TestTemplatePayload(t *testing.T) {
+	data := map[string][]byte{"PASSWORD": []byte("hunter2")}
+	metadataWithTemplate := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "env": "true"},
+		Annotations: map[string]string{
+			"hunter2-template":     "password: {{ .PASSWORD }}",
+			"hunter2-template-key": "application.yaml",
+		},
+	}
+
+	payload, err := synchronizer.TemplatePayload(metadataWithTemplate, "password: {{ .PASSWORD }}", data)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"PASSWORD":         []byte("hunter2"),
+		"application.yaml": []byte("password: hunter2"),
+	}, payload)
+
+	payload, err = synchronizer.TemplatePayload(metadata, "", data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, payload)
+
+	metadataWithMissingSecret := &secretmanagerpb.Secret{
+		Name:        secretName,
+		Annotations: map[string]string{"hunter2-template-secret": "some-template"},
+	}
+	_, err = synchronizer.TemplatePayload(metadataWithMissingSecret, "", data)
+	assert.EqualError(t, err, "invalid template: template secret some-template not found or empty")
+
+	_, err = synchronizer.TemplatePayload(metadataWithTemplate, "{{ .MISSING }}", data)
+	assert.ErrorAs(t, err, new(*synchronizer.TemplateError))
+}
+
+func TestSynchronizer_Sync_InvalidTemplate(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	})
+	recorder := record.NewFakeRecorder(10)
+	metadataWithTemplate := &secretmanagerpb.Secret{
+		Name:        secretName,
+		Labels:      map[string]string{"sync": "true"},
+		Annotations: map[string]string{"hunter2-template": "{{ .PASSWORD }}"},
+	}
+
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+	secretManagerClient := fake.NewSecretManagerClient(genericPayload, metadataWithTemplate, nil)
+	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, clientset, cache, synchronizer.WithEventRecorder(recorder))
+
+	err := syncer.Sync(ctx, msg)
+	assert.Error(t, err)
+	event := <-recorder.Events
+	assert.Contains(t, event, "Warning InvalidTemplate")
+	assert.NotContains(t, event, string(genericPayload))
+}
+
+func TestSynchronizer_Sync_References(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	secrets := map[string]fake.Secret{
+		"database": {
+			Data:     []byte("USERNAME=app\nPASSWORD=hunter2\n"),
+			Metadata: &secretmanagerpb.Secret{Name: "database", Labels: map[string]string{"format": "env"}},
+		},
+		"api-key": {
+			Data:     []byte("some-key"),
+			Metadata: &secretmanagerpb.Secret{Name: "api-key"},
+		},
+		"token": {
+			Data:     []byte("dG9rZW4tJHtzbTovL2FwaS1rZXl9"),
+			Metadata: &secretmanagerpb.Secret{Name: "token", Labels: map[string]string{"encoding": "base64"}},
+		},
+		secretName: {
+			Data:     []byte("DATABASE_PASSWORD=${sm://database#PASSWORD}\nAPI_KEY=${sm://api-key}\nURL=postgres://${sm://database#USERNAME}@db\nTOKEN=${sm://token}\n"),
+			Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true", "format": "env"}},
+			Version:  secretVersion,
+		},
+		"Worker-Config": {
+			Data:     []byte("DATABASE_PASSWORD=${sm://database#PASSWORD}\n"),
+			Metadata: &secretmanagerpb.Secret{Name: "Worker-Config", Labels: map[string]string{"sync": "true", "format": "env"}},
+		},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache)
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp))
+	assert.NoError(t, err)
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "Worker-Config", secretVersion, projectID, timestamp))
+	assert.NoError(t, err)
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"DATABASE_PASSWORD": []byte("hunter2"),
+		"API_KEY":           []byte("some-key"),
+		"URL":               []byte("postgres://app@db"),
+		"TOKEN":             []byte("token-some-key"),
+	}, secret.Data)
+	assert.Equal(t, []string{"api-key", "database", "token"}, kubernetes.ReferencesOf(*secret))
+
+	// a change to a referenced secret without the sync label re-synchronizes the dependent secret
+	secrets["database"] = fake.Secret{
+		Data:     []byte("USERNAME=app\nPASSWORD=correct-horse\n"),
+		Metadata: secrets["database"].Metadata,
+	}
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "2", projectID, timestamp))
+	assert.NoError(t, err)
+
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("correct-horse"), secret.Data["DATABASE_PASSWORD"])
+	assert.Equal(t, secretVersion, secret.GetAnnotations()[kubernetes.SecretVersion])
+
+	// dependents are synchronized from their Secret Manager secret, whose name is not lowercase like theirs
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, "worker-config", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("correct-horse"), secret.Data["DATABASE_PASSWORD"])
+	assert.Equal(t, "Worker-Config", kubernetes.SecretNameOf(*secret))
+}
+
+func TestSynchronizer_Sync_InvalidReferences(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		secrets map[string]fake.Secret
+		err     string
+	}{
+		{
+			name:    "missing secret",
+			secrets: map[string]fake.Secret{},
+			err:     "invalid reference: secret other not found",
+		},
+		{
+			name: "missing key",
+			secrets: map[string]fake.Secret{
+				"other": {Data: []byte("B=b\n"), Metadata: &secretmanagerpb.Secret{Labels: map[string]string{"format": "env"}}},
+			},
+			err: `invalid reference: secret other has no key "A"`,
+		},
+		{
+			name: "cycle",
+			secrets: map[string]fake.Secret{
+				"other": {Data: []byte("A=${sm://some-secret#A}\n"), Metadata: &secretmanagerpb.Secret{Labels: map[string]string{"format": "env"}}},
+			},
+			err: "invalid reference: cycle of references: some-secret -> other -> some-secret",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: namespace},
+			})
+			recorder := record.NewFakeRecorder(10)
+			tt.secrets[secretName] = fake.Secret{
+				Data:     []byte("A=${sm://other#A}\n"),
+				Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true", "format": "env"}},
+			}
+			syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(tt.secrets), clientset, cache, synchronizer.WithEventRecorder(recorder))
+
+			err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp))
+			assert.EqualError(t, err, "wrong secret format: "+tt.err)
+			assert.Contains(t, <-recorder.Events, "Warning InvalidReference Secret Manager secret some-secret: "+tt.err)
+		})
+	}
+}
+
+func TestSynchronizer_Sync_Target(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	})
+	recorder := record.NewFakeRecorder(10)
+	member := func(data, version string) fake.Secret {
+		return fake.Secret{
+			Data:     []byte(data),
+			Metadata: &secretmanagerpb.Secret{Labels: map[string]string{"sync": "true", "format": "env", "hunter2-target": "myapp"}},
+			Version:  version,
+		}
+	}
+	secrets := map[string]fake.Secret{
+		"database": member("PASSWORD=hunter2\nHOST=db\n", "3"),
+		"api":      member("API_KEY=some-key\nHOST=api\n", "7"),
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache, synchronizer.WithEventRecorder(recorder))
+	getTarget := func() (*corev1.Secret, error) {
+		return clientset.CoreV1().Secrets(namespace).Get(ctx, "myapp", metav1.GetOptions{})
+	}
+
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "3", projectID, timestamp)))
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "7", projectID, timestamp)))
+
+	secret, err := getTarget()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"API_KEY":  []byte("some-key"),
+		"HOST":     []byte("api"),
+		"PASSWORD": []byte("hunter2"),
+	}, secret.Data)
+	assert.Equal(t, map[string]string{"api": "7", "database": "3"}, kubernetes.SourcesOf(*secret))
+	assert.Equal(t, []string{
+		"Normal Created Created from Secret Manager secrets database=3",
+		"Normal Updated Updated from Secret Manager secrets api=7, database=3",
+		"Warning KeyConflict Keys defined by more than one secret, using the value from the first by name: HOST (api, database)",
+	}, drainEvents(recorder))
+
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, "database", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// keys of deleted members are removed
+	delete(secrets, "api")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "8", projectID, timestamp)))
+
+	secret, err = getTarget()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"HOST":     []byte("db"),
+		"PASSWORD": []byte("hunter2"),
+	}, secret.Data)
+	assert.Equal(t, map[string]string{"database": "3"}, kubernetes.SourcesOf(*secret))
+
+	// members without the target are synchronized on their own, and the target is deleted with its last member
+	secrets["database"].Metadata.Labels = map[string]string{"sync": "true", "format": "env"}
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "4", projectID, timestamp)))
+
+	_, err = getTarget()
+	assert.True(t, errors.IsNotFound(err))
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, "database", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), secret.Data["PASSWORD"])
+}
+
+func TestSynchronizer_Sync_TargetMembers(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	})
+	recorder := record.NewFakeRecorder(100)
+	member := func(data, version string, labels ...string) fake.Secret {
+		metadata := &secretmanagerpb.Secret{Labels: map[string]string{"sync": "true", "format": "env", "hunter2-target": "myapp"}}
+		for i := 0; i < len(labels); i += 2 {
+			metadata.Labels[labels[i]] = labels[i+1]
+		}
+		return fake.Secret{Data: []byte(data), Metadata: metadata, Version: version}
+	}
+	secrets := map[string]fake.Secret{
+		"database": member("PASSWORD=hunter2\n", "3"),
+		"api":      member("API_KEY=some-key\n", "7"),
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache, synchronizer.WithEventRecorder(recorder))
+	getTarget := func() *corev1.Secret {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, "myapp", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return secret
+	}
+
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "3", projectID, timestamp)))
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "7", projectID, timestamp)))
+	drainEvents(recorder)
+
+	// the other members are merged at their latest versions
+	secrets["database"] = member("PASSWORD=hunter3\n", "4")
+	secrets["api"] = member("API_KEY=other-key\n", "8")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "8", projectID, timestamp)))
+	secret := getTarget()
+	assert.Equal(t, map[string][]byte{"API_KEY": []byte("other-key"), "PASSWORD": []byte("hunter3")}, secret.Data)
+	assert.Equal(t, map[string]string{"api": "8", "database": "4"}, kubernetes.SourcesOf(*secret))
+	drainEvents(recorder)
+
+	// invalid members are left out, without holding back the others
+	secrets["api"] = member("API_KEY=\"other-key\n", "9")
+	secrets["cache"] = member("CACHE_URL=redis://cache\n", "1", "versioned", "true")
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "9", projectID, timestamp))
+	assert.ErrorAs(t, err, new(*synchronizer.FormatError))
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "cache", "1", projectID, timestamp))
+	assert.EqualError(t, err, `while synchronizing k8s secret: wrong secret format: invalid target "myapp": merged secrets are mutable and of type Opaque, but it has the versioned label`)
+	secret = getTarget()
+	assert.Equal(t, map[string][]byte{"PASSWORD": []byte("hunter3")}, secret.Data)
+	assert.Equal(t, map[string]string{"database": "4"}, kubernetes.SourcesOf(*secret))
+	assert.Equal(t, []string{
+		"Warning InvalidPayload Secret Manager secret api: invalid env at line 1: unterminated quoted value",
+		"Warning InvalidMember Left out secrets that cannot be synchronized, see their events: api",
+		"Normal Updated Updated from Secret Manager secrets database=4",
+		"Warning InvalidTarget Secret Manager secret cache: invalid target \"myapp\": merged secrets are mutable and of type Opaque, but it has the versioned label",
+		"Warning InvalidMember Left out secrets that cannot be synchronized, see their events: cache",
+	}, drainEvents(recorder))
+
+	// a target whose members are all invalid is kept as it is
+	secrets["database"] = member("PASSWORD=\"hunter3\n", "5")
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "5", projectID, timestamp))
+	assert.ErrorAs(t, err, new(*synchronizer.FormatError))
+	secret = getTarget()
+	assert.Equal(t, map[string][]byte{"PASSWORD": []byte("hunter3")}, secret.Data)
+	assert.Equal(t, map[string]string{"database": "4"}, kubernetes.SourcesOf(*secret))
+}
+
+// mergedMembers returns Secret Manager secrets merged into the myapp target, and a function that returns the target.
+func mergedMembers(t *testing.T, clientset *kubernetesFake.Clientset) (func(data, version string) fake.Secret, func() *corev1.Secret) {
+	member := func(data, version string) fake.Secret {
+		return fake.Secret{
+			Data:     []byte(data),
+			Metadata: &secretmanagerpb.Secret{Labels: map[string]string{"sync": "true", "format": "env", "hunter2-target": "myapp"}},
+			Version:  version,
+		}
+	}
+	getTarget := func() *corev1.Secret {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, "myapp", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return secret
+	}
+	return member, getTarget
+}
+
+func TestSynchronizer_Sync_TargetDeletionPolicyDelayed(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace, Annotations: map[string]string{synchronizer.ProjectIDAnnotation: projectID}},
+	})
+	recorder := record.NewFakeRecorder(100)
+	member, getTarget := mergedMembers(t, clientset)
+	secrets := map[string]fake.Secret{
+		"database": member("PASSWORD=hunter2\n", "3"),
+		"api":      member("API_KEY=some-key\n", "7"),
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithEventRecorder(recorder), synchronizer.WithDeletionPolicy(synchronizer.DeletionPolicyDelayed, time.Hour))
+	managed := func() []corev1.Secret {
+		managed, err := syncer.ManagedSecrets(ctx)
+		assert.NoError(t, err)
+		return managed
+	}
+
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "3", projectID, timestamp)))
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "7", projectID, timestamp)))
+	drainEvents(recorder)
+
+	// the keys of deleted members are kept until the grace period has passed
+	delete(secrets, "api")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "8", projectID, timestamp)))
+	secret := getTarget()
+	assert.Equal(t, map[string][]byte{"API_KEY": []byte("some-key"), "PASSWORD": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, map[string]string{"api": "7", "database": "3"}, kubernetes.SourcesOf(*secret))
+	removed := kubernetes.RemovedSourcesOf(*secret)
+	assert.Equal(t, []string{"API_KEY"}, removed["api"].Keys)
+	deleteAfter := removed["api"].DeleteAfter
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *deleteAfter, time.Minute)
+	assert.Contains(t, drainEvents(recorder), "Warning DeletionScheduled Keys of api will be removed after "+
+		deleteAfter.Format(time.RFC3339)+", as the Secret Manager secret has been deleted: API_KEY")
+
+	// the other members are merged as before, and the target is kept with its last member
+	secrets["database"] = member("PASSWORD=hunter3\n", "4")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "4", projectID, timestamp)))
+	delete(secrets, "database")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "5", projectID, timestamp)))
+	assert.NoError(t, syncer.DeleteExpired(ctx, managed()))
+	secret = getTarget()
+	assert.Equal(t, map[string][]byte{"API_KEY": []byte("some-key"), "PASSWORD": []byte("hunter3")}, secret.Data)
+	assert.Equal(t, map[string]string{"api": "7", "database": "4"}, kubernetes.SourcesOf(*secret))
+	assert.Equal(t, *deleteAfter, *kubernetes.RemovedSourcesOf(*secret)["api"].DeleteAfter)
+
+	// the keys are removed once the grace period has passed, and the target once all its members are gone
+	removed = kubernetes.RemovedSourcesOf(*secret)
+	passed := time.Now().Add(-time.Minute)
+	api := removed["api"]
+	api.DeleteAfter = &passed
+	removed["api"] = api
+	annotation, err := json.Marshal(removed)
+	assert.NoError(t, err)
+	secret.Annotations[kubernetes.RemovedSources] = string(annotation)
+	_, err = clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{FieldManager: kubernetes.FieldManager})
+	assert.NoError(t, err)
+
+	assert.NoError(t, syncer.DeleteExpired(ctx, managed()))
+	secret = getTarget()
+	assert.Equal(t, map[string][]byte{"PASSWORD": []byte("hunter3")}, secret.Data)
+	assert.Equal(t, map[string]string{"database": "4"}, kubernetes.SourcesOf(*secret))
+	assert.Equal(t, []string{"PASSWORD"}, kubernetes.RemovedSourcesOf(*secret)["database"].Keys)
+}
+
+func TestSynchronizer_Sync_TargetDeletionPolicyOrphan(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	recorder := record.NewFakeRecorder(100)
+	member, getTarget := mergedMembers(t, clientset)
+	secrets := map[string]fake.Secret{
+		"database": member("PASSWORD=hunter2\n", "3"),
+		"api":      member("API_KEY=some-key\n", "7"),
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithEventRecorder(recorder), synchronizer.WithDeletionPolicy(synchronizer.DeletionPolicyOrphan, 0))
+
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "3", projectID, timestamp)))
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "7", projectID, timestamp)))
+	drainEvents(recorder)
+
+	// the keys of deleted members are kept for good, also after the last member is deleted
+	delete(secrets, "api")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "8", projectID, timestamp)))
+	delete(secrets, "database")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "4", projectID, timestamp)))
+	secret := getTarget()
+	assert.Equal(t, map[string][]byte{"API_KEY": []byte("some-key"), "PASSWORD": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, map[string]string{"api": "7", "database": "3"}, kubernetes.SourcesOf(*secret))
+	assert.Equal(t, map[string]kubernetes.RemovedSource{
+		"api":      {Policy: "orphan", Reason: "the Secret Manager secret has been deleted", Keys: []string{"API_KEY"}},
+		"database": {Policy: "orphan", Reason: "the Secret Manager secret has been deleted", Keys: []string{"PASSWORD"}},
+	}, kubernetes.RemovedSourcesOf(*secret))
+	events := drainEvents(recorder)
+	assert.Contains(t, events, "Warning Orphaned Keeping the keys of api, as the Secret Manager secret has been deleted: API_KEY")
+	assert.Contains(t, events, "Warning Orphaned Keeping the keys of database, as the Secret Manager secret has been deleted: PASSWORD")
+
+	// members that reappear are merged again
+	secrets["api"] = member("API_KEY=other-key\n", "9")
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "9", projectID, timestamp)))
+	secret = getTarget()
+	assert.Equal(t, map[string][]byte{"API_KEY": []byte("other-key"), "PASSWORD": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, map[string]string{"api": "9", "database": "3"}, kubernetes.SourcesOf(*secret))
+	assert.NotContains(t, kubernetes.RemovedSourcesOf(*secret), "api")
+}
+
+func TestSynchronizer_Sync_TargetReleasePolicy(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	recorder := record.NewFakeRecorder(100)
+	member, getTarget := mergedMembers(t, clientset)
+	secrets := map[string]fake.Secret{
+		"database": member("PASSWORD=hunter2\n", "3"),
+		"api":      member("API_KEY=some-key\n", "7"),
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithEventRecorder(recorder))
+	release := func(name string, labels map[string]string) {
+		secrets[name].Metadata.Labels = labels
+		assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, name, secrets[name].Version, projectID, timestamp)))
+	}
+	const why = "the Secret Manager secret no longer has the sync=true label"
+
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "3", projectID, timestamp)))
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "api", "7", projectID, timestamp)))
+	drainEvents(recorder)
+
+	// released members keep their keys with the stale policy by default, or with the policy of their release label
+	release("api", map[string]string{"format": "env", "hunter2-target": "myapp"})
+	release("database", map[string]string{"format": "env", "hunter2-target": "myapp", synchronizer.ReleaseLabelKey: "orphan"})
+	secret := getTarget()
+	assert.Equal(t, map[string][]byte{"API_KEY": []byte("some-key"), "PASSWORD": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, map[string]string{"api": "7", "database": "3"}, kubernetes.SourcesOf(*secret))
+	assert.Equal(t, map[string]kubernetes.RemovedSource{
+		"api":      {Policy: "stale", Reason: why, Keys: []string{"API_KEY"}},
+		"database": {Policy: "orphan", Reason: why, Keys: []string{"PASSWORD"}},
+	}, kubernetes.RemovedSourcesOf(*secret))
+	events := drainEvents(recorder)
+	assert.Contains(t, events, "Warning Released Keeping the keys of api as stale until it is synchronized again, as "+why+": API_KEY")
+	assert.Contains(t, events, "Warning Orphaned Keeping the keys of database, as "+why+": PASSWORD")
+
+	// released members are merged again when the label is added back
+	release("api", map[string]string{"sync": "true", "format": "env", "hunter2-target": "myapp"})
+	secret = getTarget()
+	assert.Equal(t, map[string][]byte{"API_KEY": []byte("some-key"), "PASSWORD": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, map[string]kubernetes.RemovedSource{
+		"database": {Policy: "orphan", Reason: why, Keys: []string{"PASSWORD"}},
+	}, kubernetes.RemovedSourcesOf(*secret))
+
+	// with the delete policy, the keys are removed right away, and the target with its last member
+	release("api", map[string]string{"format": "env", "hunter2-target": "myapp", synchronizer.ReleaseLabelKey: "delete"})
+	secret = getTarget()
+	assert.Equal(t, map[string][]byte{"PASSWORD": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, map[string]string{"database": "3"}, kubernetes.SourcesOf(*secret))
+	release("database", map[string]string{"format": "env", "hunter2-target": "myapp", synchronizer.ReleaseLabelKey: "delete"})
+	_, err := clientset.CoreV1().Secrets(namespace).Get(ctx, "myapp", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestSynchronizer_Sync_InvalidTarget(t *testing.T) {
+	metadataWithTarget := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "hunter2-target": "my_app"},
+	}
+	secretManagerClient := fake.NewSecretManagerClient(genericPayload, metadataWithTarget, nil)
+	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, kubernetesFake.NewClientset(), cache)
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp))
+	assert.ErrorContains(t, err, `wrong secret format: invalid target "my_app"`)
+}
+
+func TestKeyRulesPayload(t *testing.T) {
+	data := map[string][]byte{
+		"DB_USER":     []byte("app"),
+		"DB_PASSWORD": []byte("hunter2"),
+		"DB_DEBUG":    []byte("true"),
+		"API_KEY":     []byte("some-key"),
+	}
+	withAnnotations := func(annotations map[string]string) *secretmanagerpb.Secret {
+		return &secretmanagerpb.Secret{
+			Name:        secretName,
+			Labels:      map[string]string{"sync": "true", "format": "env"},
+			Annotations: annotations,
+		}
+	}
+
+	payload, err := synchronizer.KeyRulesPayload(withAnnotations(nil), data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, payload)
+
+	payload, err = synchronizer.KeyRulesPayload(withAnnotations(map[string]string{
+		"hunter2-include": "DB_*, API_KEY",
+		"hunter2-exclude": "*_DEBUG",
+		"hunter2-rename":  "DB_USER=USERNAME, DB_PASSWORD=PASSWORD",
+		"hunter2-prefix":  "MYAPP_",
+	}), data)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"MYAPP_USERNAME": []byte("app"),
+		"MYAPP_PASSWORD": []byte("hunter2"),
+		"MYAPP_API_KEY":  []byte("some-key"),
+	}, payload)
+
+	payload, err = synchronizer.KeyRulesPayload(metadata, map[string][]byte{"secret": genericPayload})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"secret": genericPayload}, payload)
+
+	for _, tt := range []struct {
+		annotations map[string]string
+		err         string
+	}{
+		{map[string]string{"hunter2-include": "DB_["}, `invalid data key "DB_[": malformed glob pattern`},
+		{map[string]string{"hunter2-rename": "DB_USER"}, `invalid data key "DB_USER": hunter2-rename must be a comma-separated list of OLD=NEW pairs`},
+		{map[string]string{"hunter2-rename": "DB_USER=API_KEY"}, `invalid data key "API_KEY": both`},
+		{map[string]string{"hunter2-prefix": "my/"}, `invalid data key "my/`},
+		{map[string]string{"hunter2-prefix": "1"}, `invalid data key "1`},
+	} {
+		_, err = synchronizer.KeyRulesPayload(withAnnotations(tt.annotations), data)
+		assert.ErrorContains(t, err, tt.err)
+		assert.ErrorAs(t, err, new(*synchronizer.InvalidKeyError))
+	}
+}
+
+func TestValidatePayload(t *testing.T) {
+	warnings, err := synchronizer.ValidatePayload(map[string][]byte{"FOO": []byte("bar")}, true)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	data := map[string][]byte{"FOO": []byte("bar"), "EMPTY": {}, "ALSO_EMPTY": nil}
+	warnings, err = synchronizer.ValidatePayload(data, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"empty value for keys ALSO_EMPTY, EMPTY"}, warnings)
+
+	_, err = synchronizer.ValidatePayload(data, true)
+	assert.EqualError(t, err, "invalid payload: empty value for keys ALSO_EMPTY, EMPTY")
+
+	_, err = synchronizer.ValidatePayload(map[string][]byte{"not/valid": []byte("hunter2")}, false)
+	assert.ErrorAs(t, err, new(*synchronizer.InvalidKeyError))
+	assert.NotContains(t, err.Error(), "hunter2")
+
+	_, err = synchronizer.ValidatePayload(map[string][]byte{"large": make([]byte, corev1.MaxSecretSize)}, false)
+	assert.EqualError(t, err, "invalid payload: 1048581 bytes in 1 keys, more than the limit of 1048576 bytes for a Kubernetes secret")
+}
+
+func TestSynchronizer_Sync_Strict(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	})
+	recorder := record.NewFakeRecorder(10)
+	metadataWithStrict := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "env": "true", "strict": "true"},
+	}
+
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+	secretManagerClient := fake.NewSecretManagerClient([]byte("PASSWORD=hunter2\nPASSWORD=hunter3\n"), metadataWithStrict, nil)
+	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, clientset, cache, synchronizer.WithEventRecorder(recorder))
+
+	err := syncer.Sync(ctx, msg)
+	assert.EqualError(t, err, `wrong secret format: invalid env at line 2: duplicate key "PASSWORD", first defined at line 1`)
+	event := <-recorder.Events
+	assert.Contains(t, event, "Warning InvalidPayload")
+	assert.NotContains(t, event, "hunter2")
+}
+
+func TestSecretPayload_Encoding(t *testing.T) {
+	withEncoding := func(labels, annotations map[string]string) *secretmanagerpb.Secret {
+		return &secretmanagerpb.Secret{Name: secretName, Labels: labels, Annotations: annotations}
+	}
+
+	payload, err := synchronizer.SecretPayload(withEncoding(map[string]string{"encoding": "base64"}, nil), []byte("aHVudGVyMg==\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, payload)
+
+	payload, err = synchronizer.SecretPayload(withEncoding(map[string]string{"format": "env", "encoding": "base64"}, nil), []byte("A=aHVudGVyMg==\nB=\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"A": []byte("hunter2"), "B": {}}, payload)
+
+	gzipped := []byte("H4sIAAAAAAAAA8sozStJLTICAFb8RycHAAAA")
+	for _, metadata := range []*secretmanagerpb.Secret{
+		withEncoding(map[string]string{"encoding": "gzip-base64"}, nil),
+		withEncoding(nil, map[string]string{"encoding": "gzip+base64"}),
+	} {
+		payload, err = synchronizer.SecretPayload(metadata, gzipped)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, payload)
+	}
+
+	_, err = synchronizer.SecretPayload(withEncoding(map[string]string{"format": "env", "encoding": "base64"}, nil), []byte("A=hunter2\n"))
+	assert.EqualError(t, err, `invalid base64 value for key "A": illegal base64 data at input byte 4`)
+
+	_, err = synchronizer.SecretPayload(withEncoding(map[string]string{"encoding": "base32"}, nil), genericPayload)
+	assert.EqualError(t, err, `invalid base32 payload: unsupported encoding "base32"`)
+}
+
+func TestAgeIdentitySources(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	keys := []byte("# created: 2024-03-01T12:00:00Z\n" + identity.String() + "\n")
+
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	assert.NoError(t, os.WriteFile(path, keys, 0o600))
+	identities, err := synchronizer.AgeIdentityFile(path)(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []age.Identity{identity}, identities)
+
+	clientset := kubernetesFake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-age", Namespace: "hunter2"},
+		Data:       map[string][]byte{"keys.txt": keys},
+	})
+	identities, err = synchronizer.AgeIdentitySecret(clientset, "hunter2", "sops-age")(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []age.Identity{identity}, identities)
+
+	_, err = synchronizer.AgeIdentitySecret(clientset, "hunter2", "missing")(ctx)
+	assert.Error(t, err)
+}
+
+func TestSynchronizer_Sync_DecryptionFailed(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	})
+	recorder := record.NewFakeRecorder(10)
+	encrypted := []byte("PASSWORD=ENC[AES256_GCM,data:AAAA,iv:AAAA,tag:AAAA,type:str]\nsops_mac=ENC[AES256_GCM,data:AAAA,iv:AAAA,tag:AAAA,type:str]\nsops_version=3.8.1\n")
+
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+	secretManagerClient := fake.NewSecretManagerClient(encrypted, metadataWithEnv, nil)
+	syncer := synchronizer.NewSynchronizer(logger, secretManagerClient, clientset, cache, synchronizer.WithEventRecorder(recorder))
+
+	err := syncer.Sync(ctx, msg)
+	assert.EqualError(t, err, "wrong secret format: cannot decrypt SOPS payload: no age identities configured")
+	assert.Contains(t, <-recorder.Events, "Warning DecryptionFailed")
+
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestSynchronizer_Sync_Previous(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		labels   map[string]string
+		current  string
+		previous string
+		expected map[string][]byte
+	}{
+		{
+			name:     "raw",
+			labels:   map[string]string{"sync": "true", "previous": "true"},
+			current:  "hunter3",
+			previous: "hunter2",
+			expected: map[string][]byte{"secret": []byte("hunter3"), "secret.previous": []byte("hunter2")},
+		},
+		{
+			name:     "env",
+			labels:   map[string]string{"sync": "true", "previous": "true", "env": "true"},
+			current:  "TOKEN=hunter3\nNEW=value\n",
+			previous: "TOKEN=hunter2\n",
+			expected: map[string][]byte{"TOKEN": []byte("hunter3"), "NEW": []byte("value"), "TOKEN_PREVIOUS": []byte("hunter2")},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := kubernetesFake.NewClientset()
+			secrets := map[string]fake.Secret{
+				secretName: {
+					Data:     []byte(tt.current),
+					Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: tt.labels},
+					Previous: map[string][]byte{"1": []byte("ignored"), "3": []byte(tt.previous)},
+					Version:  "4",
+				},
+			}
+			syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache)
+
+			err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "4", projectID, timestamp))
+			assert.NoError(t, err)
+
+			secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, secret.Data)
+			assert.Equal(t, "4", secret.GetAnnotations()[kubernetes.SecretVersion])
+			assert.Equal(t, "3", secret.GetAnnotations()[kubernetes.PreviousSecretVersion])
+		})
+	}
+}
+
+func TestSynchronizer_Sync_PreviousReferences(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	secrets := map[string]fake.Secret{
+		secretName: {
+			Data:     []byte("TOKEN=${sm://new-token}\n"),
+			Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true", "previous": "true", "format": "env"}},
+			Previous: map[string][]byte{"3": []byte("TOKEN=${sm://old-token#TOKEN}\n")},
+			Version:  "4",
+		},
+		"new-token": {Data: []byte("hunter3"), Metadata: &secretmanagerpb.Secret{}},
+		"old-token": {Data: []byte("TOKEN=hunter2\n"), Metadata: &secretmanagerpb.Secret{Labels: map[string]string{"format": "env"}}},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache)
+
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "4", projectID, timestamp)))
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"TOKEN": []byte("hunter3"), "TOKEN_PREVIOUS": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, []string{"new-token", "old-token"}, kubernetes.ReferencesOf(*secret))
+}
+
+func TestSynchronizer_Sync_PreviousOfLatestVersion(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	secrets := map[string]fake.Secret{
+		secretName: {
+			Data:     []byte("hunter3"),
+			Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true", "previous": "true"}},
+			Previous: map[string][]byte{"1": []byte("hunter1"), "3": []byte("hunter2")},
+			Version:  "4",
+		},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache)
+
+	// messages for changes to the secret itself, e.g. its labels, carry version 1
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp))
+	assert.NoError(t, err)
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter3"), "secret.previous": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, "4", secret.GetAnnotations()[kubernetes.SecretVersion])
+	assert.Equal(t, "3", secret.GetAnnotations()[kubernetes.PreviousSecretVersion])
+}
+
+func TestSynchronizer_Sync_WithoutPrevious(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	metadataWithPrevious := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "previous": "true"},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClient(genericPayload, metadataWithPrevious, nil), clientset, cache)
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp))
+	assert.NoError(t, err)
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"secret": genericPayload}, secret.Data)
+	assert.NotContains(t, secret.GetAnnotations(), kubernetes.PreviousSecretVersion)
+}
+
+func TestSynchronizer_Sync_Versioned(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	secrets := map[string]fake.Secret{
+		secretName: {
+			Data:     []byte("hunter2"),
+			Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true", "versioned": "true", "retain": "2"}},
+		},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache)
+
+	for _, version := range []string{"1", "2", "3"} {
+		secrets[secretName] = fake.Secret{Data: secrets[secretName].Data, Metadata: secrets[secretName].Metadata, Version: version}
+		err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, version, projectID, timestamp))
+		assert.NoError(t, err)
+	}
+
+	_, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	for _, version := range []string{"1", "2", "3"} {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName+"-v"+version, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.True(t, *secret.Immutable)
+		assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, secret.Data)
+		assert.Equal(t, version, secret.GetAnnotations()[kubernetes.SecretVersion])
+		assert.Equal(t, secretName, secret.GetAnnotations()[kubernetes.VersionOf])
+		if version == "3" {
+			assert.Equal(t, "true", secret.GetLabels()[kubernetes.Current])
+		} else {
+			assert.NotContains(t, secret.GetLabels(), kubernetes.Current)
+		}
+	}
+
+	managed, err := syncer.ManagedSecrets(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, syncer.CollectGarbage(ctx, managed))
+
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName+"-v1", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	for _, version := range []string{"2", "3"} {
+		_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName+"-v"+version, metav1.GetOptions{})
+		assert.NoError(t, err)
+	}
+
+	// messages for changes to the secret itself carry version 1, but the latest version is synchronized
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp))
+	assert.NoError(t, err)
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName+"-v1", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName+"-v3", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", secret.GetLabels()[kubernetes.Current])
+
+	// deleting the secret in Secret Manager deletes all its versions
+	delete(secrets, secretName)
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "3", projectID, timestamp))
+	assert.NoError(t, err)
+
+	managed, err = syncer.ManagedSecrets(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, managed)
+}
+
+func TestSynchronizer_Sync_InvalidRetain(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	invalid := &secretmanagerpb.Secret{
+		Name:   secretName,
+		Labels: map[string]string{"sync": "true", "versioned": "true", "retain": "0"},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClient(genericPayload, invalid, nil), clientset, cache)
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp))
+	assert.EqualError(t, err, `wrong secret format: invalid payload: retain must be a positive number, got "0"`)
+}
+
+func TestSynchronizer_Sync_ApplyKeepsOtherFields(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	secrets := map[string]fake.Secret{
+		secretName: {Data: []byte("FOO=bar\nREMOVED=value\n"), Metadata: metadataWithEnv},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache)
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp))
+	assert.NoError(t, err)
+
+	// another controller adds a label and an annotation
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	secret.Labels["team"] = "some-team"
+	secret.Annotations["example.com/owner"] = "someone"
+	_, err = clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{FieldManager: "other-controller"})
+	assert.NoError(t, err)
+
+	secrets[secretName] = fake.Secret{Data: []byte("FOO=baz\n"), Metadata: metadataWithEnv, Version: "2"}
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "2", projectID, timestamp))
+	assert.NoError(t, err)
+
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"FOO": []byte("baz")}, secret.Data)
+	assert.Equal(t, "2", secret.GetAnnotations()[kubernetes.SecretVersion])
+	assert.Equal(t, "some-team", secret.GetLabels()["team"])
+	assert.Equal(t, "someone", secret.GetAnnotations()["example.com/owner"])
+}
+
+func TestSynchronizer_Sync_ApplyConflict(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	recorder := record.NewFakeRecorder(10)
+	secrets := map[string]fake.Secret{
+		secretName: {Data: []byte("FOO=bar\n"), Metadata: metadataWithEnv},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache, synchronizer.WithEventRecorder(recorder))
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp))
+	assert.NoError(t, err)
+
+	// someone edits a value written by hunter2
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	secret.Data["FOO"] = []byte("edited")
+	_, err = clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{FieldManager: "kubectl-edit"})
+	assert.NoError(t, err)
+
+	// a conflict is not resolved by redelivering the message, so it is acked
+	secrets[secretName] = fake.Secret{Data: []byte("FOO=baz\n"), Metadata: metadataWithEnv, Version: "2"}
+	msg := &ackedMessage{PubSubMessage: fake.NewPubSubMessage(principalEmail, secretName, "2", projectID, timestamp)}
+	err = syncer.Sync(ctx, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, msg.acks)
+	assert.Equal(t, 0, msg.nacks)
+
+	events := drainEvents(recorder)
+	assert.Len(t, events, 2)
+	assert.Contains(t, events[1], "Warning Conflict fields of secret some-secret written by hunter2 have been changed by others")
+	assert.Contains(t, events[1], "kubectl-edit")
+	assert.NotContains(t, events[1], "edited")
+
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("edited"), secret.Data["FOO"])
+}
+
+func TestSynchronizer_Sync_ApplyTakesOverUpdatedFields(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClient([]byte("FOO=new\n"), metadataWithEnv, nil), clientset, cache)
+
+	// a secret written by hunter2 before it used server-side apply
+	existing := kubernetes.OpaqueSecret(kubernetes.SecretData{
+		Name:      secretName,
+		Namespace: namespace,
+		Payload:   map[string][]byte{"FOO": []byte("old")},
+	})
+	_, err := clientset.CoreV1().Secrets(namespace).Create(ctx, existing, metav1.CreateOptions{FieldManager: kubernetes.FieldManager})
+	assert.NoError(t, err)
+
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp))
+	assert.NoError(t, err)
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"FOO": []byte("new")}, secret.Data)
+}
+
+func TestSynchronizer_Sync_SkipUnchanged(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	syncMetadata := &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}
+	secrets := map[string]fake.Secret{
+		secretName: {Data: genericPayload, Metadata: syncMetadata},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache)
+	writes := func() int {
+		count := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "patch" {
+				count++
+			}
+		}
+		clientset.ClearActions()
+		return count
+	}
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, writes())
+
+	// a redelivered message does not rewrite the secret
+	err = syncer.Sync(ctx, fake.NewPubSubMessage("someone-else@domain.test", secretName, "1", projectID, timestamp.Add(time.Minute)))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, writes())
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, principalEmail, secret.GetAnnotations()[kubernetes.LastModifiedBy])
+
+	secrets[secretName] = fake.Secret{Data: []byte("other-payload"), Metadata: syncMetadata, Version: "2"}
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "2", projectID, timestamp))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, writes())
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("other-payload"), secret.Data["secret"])
+}
+
+func TestSynchronizer_Sync_Events(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "hunter2"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "handmade", Namespace: namespace}},
+	)
+	recorder := record.NewFakeRecorder(10)
+	syncMetadata := &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}
+	secrets := map[string]fake.Secret{
+		secretName:  {Data: genericPayload, Metadata: syncMetadata},
+		"handmade":  {Data: genericPayload, Metadata: syncMetadata},
+		"unlabeled": {Data: genericPayload, Metadata: &secretmanagerpb.Secret{Name: "unlabeled"}},
+		"too-large": {Data: make([]byte, corev1.MaxSecretSize), Metadata: syncMetadata},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, map[string]string{projectID: namespace},
+		synchronizer.WithEventRecorder(recorder), synchronizer.WithEventNamespace("hunter2"))
+	sync := func(name, version, project string) {
+		_ = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, name, version, project, timestamp))
+	}
+
+	sync(secretName, "1", projectID)
+	secrets[secretName] = fake.Secret{Data: []byte("other-payload"), Metadata: syncMetadata, Version: "2"}
+	sync(secretName, "2", projectID)
+	delete(secrets, secretName)
+	sync(secretName, "3", projectID)
+	sync("unlabeled", "1", projectID)
+	sync("handmade", "1", projectID)
+	sync("too-large", "1", projectID)
+	sync(secretName, "1", "unknown-project")
+
+	assert.Equal(t, []string{
+		"Normal Created Created from version 1 of the Secret Manager secret",
+		"Normal Updated Updated from version 2 of the Secret Manager secret",
+		"Normal Deleted Deleted secret some-secret, as the Secret Manager secret has been deleted",
+		"Normal NoSyncLabel Secret Manager secret unlabeled was not synchronized, as it does not have the sync=true label",
+		"Warning NotManaged Secret Manager secret handmade was not synchronized, as this secret is not managed by hunter2",
+		"Warning TooLarge Secret Manager secret too-large: invalid payload: 1048582 bytes in 1 keys, more than the limit of 1048576 bytes for a Kubernetes secret",
+		"Warning UnknownProject Secret Manager secret some-secret was not synchronized: no namespace found for project ID: unknown-project",
+	}, drainEvents(recorder))
+}
+
+func TestSynchronizer_Sync_Status(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	dynamicClient := dynamicFake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		kubernetes.SecretSyncResource: "SecretSyncList",
+	})
+	envMetadata := &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true", "format": "env"}}
+	secrets := map[string]fake.Secret{
+		secretName: {Data: []byte("FOO=bar\n"), Metadata: envMetadata},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache, synchronizer.WithStatus(dynamicClient))
+	getStatus := func() (*kubernetes.SecretSync, error) {
+		object, err := dynamicClient.Resource(kubernetes.SecretSyncResource).Namespace(namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return kubernetes.SecretSyncFromUnstructured(object)
+	}
+	conditions := func(secretSync *kubernetes.SecretSync) map[string]metav1.ConditionStatus {
+		result := make(map[string]metav1.ConditionStatus)
+		for _, condition := range secretSync.Status.Conditions {
+			result[condition.Type] = condition.Status
+		}
+		return result
+	}
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp))
+	assert.NoError(t, err)
+
+	secretSync, err := getStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, kubernetes.SecretSyncSpec{ProjectID: projectID, SecretName: secretName, Target: secretName}, secretSync.Spec)
+	assert.Equal(t, "1", secretSync.Status.AppliedVersion)
+	assert.Equal(t, principalEmail, secretSync.Status.LastPrincipal)
+	assert.Empty(t, secretSync.Status.LastError)
+	assert.NotNil(t, secretSync.Status.LastSyncTime)
+	assert.Equal(t, map[string]metav1.ConditionStatus{
+		kubernetes.ConditionSynced: metav1.ConditionTrue,
+		kubernetes.ConditionValid:  metav1.ConditionTrue,
+		kubernetes.ConditionStale:  metav1.ConditionFalse,
+	}, conditions(secretSync))
+
+	// an invalid version leaves the secret at the last valid version
+	secrets[secretName] = fake.Secret{Data: []byte("FOO=\"bar\n"), Metadata: envMetadata, Version: "2"}
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "2", projectID, timestamp))
+	assert.Error(t, err)
+
+	secretSync, err = getStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, "1", secretSync.Status.AppliedVersion)
+	assert.Equal(t, "2", secretSync.Status.LastVersion)
+	assert.Equal(t, "wrong secret format: invalid env at line 1: unterminated quoted value", secretSync.Status.LastError)
+	assert.Equal(t, map[string]metav1.ConditionStatus{
+		kubernetes.ConditionSynced: metav1.ConditionFalse,
+		kubernetes.ConditionValid:  metav1.ConditionFalse,
+		kubernetes.ConditionStale:  metav1.ConditionTrue,
+	}, conditions(secretSync))
+
+	// the status is deleted along with the secret
+	delete(secrets, secretName)
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "2", projectID, timestamp))
+	assert.NoError(t, err)
+
+	_, err = getStatus()
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestSynchronizer_Sync_StatusOfLatestVersion(t *testing.T) {
+	dynamicClient := dynamicFake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		kubernetes.SecretSyncResource: "SecretSyncList",
+	})
+	secrets := map[string]fake.Secret{
+		secretName: {
+			Data:     genericPayload,
+			Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}},
+			Version:  "3",
+		},
+		"database": {
+			Data:     []byte("PASSWORD=hunter2\n"),
+			Metadata: &secretmanagerpb.Secret{Name: "database", Labels: map[string]string{"sync": "true", "format": "env", "hunter2-target": "myapp"}},
+			Version:  "5",
+		},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), kubernetesFake.NewClientset(), cache, synchronizer.WithStatus(dynamicClient))
+
+	// messages for changes to the secrets themselves carry version 1, but the latest versions are synchronized
+	for name, version := range map[string]string{secretName: "3", "database": "5"} {
+		err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, name, "1", projectID, timestamp))
+		assert.NoError(t, err)
+
+		object, err := dynamicClient.Resource(kubernetes.SecretSyncResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		secretSync, err := kubernetes.SecretSyncFromUnstructured(object)
+		assert.NoError(t, err)
+		assert.Equal(t, version, secretSync.Status.LastVersion)
+		assert.Equal(t, version, secretSync.Status.AppliedVersion)
+	}
+}
+
+func TestSynchronizer_Pull(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace, Annotations: map[string]string{synchronizer.ProjectIDAnnotation: projectID}}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "manual", Namespace: namespace}},
+	)
+	secrets := map[string]fake.Secret{
+		"database": {
+			Data:     []byte("USER=app\nPASSWORD=hunter2\n"),
+			Metadata: &secretmanagerpb.Secret{Name: "database"},
+			Version:  "2",
+			Previous: map[string][]byte{"1": []byte("USER=app\nPASSWORD=hunter1\n")},
+		},
+		"api-key": {Data: []byte("some-key"), Metadata: &secretmanagerpb.Secret{Name: "api-key"}},
+		"manual":  {Data: []byte("some-value"), Metadata: &secretmanagerpb.Secret{Name: "manual"}},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, map[string]string{projectID: namespace})
+	pull := &kubernetes.SecretPull{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-app", Namespace: namespace, UID: "some-uid"},
+		Spec: kubernetes.SecretPullSpec{Secrets: []kubernetes.SecretPullSource{
+			{Name: "database", Version: "1", Format: "env", Keys: map[string]string{"PASSWORD": "DB_PASSWORD"}},
+			{Name: "projects/" + projectID + "/secrets/api-key"},
+			{Name: "projects/other-project/secrets/api-key"},
+			{Name: "manual"},
+		}},
+	}
+
+	statuses, err := syncer.Pull(ctx, pull)
+	assert.NoError(t, err)
+	assert.Equal(t, []kubernetes.SecretPullSourceStatus{
+		{Name: "database", AppliedVersion: "1"},
+		{Name: "projects/" + projectID + "/secrets/api-key", AppliedVersion: "1"},
+		{Name: "projects/other-project/secrets/api-key", Error: "secret projects/other-project/secrets/api-key is not in project " + projectID + ", which is mapped to this namespace"},
+		{Name: "manual", Error: "secret manual exists in namespace, but is not managed by hunter2"},
+	}, statuses)
+
+	database, err := clientset.CoreV1().Secrets(namespace).Get(ctx, "database", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"USER": []byte("app"), "DB_PASSWORD": []byte("hunter1")}, database.Data)
+	assert.Equal(t, "1", database.GetAnnotations()[kubernetes.SecretVersion])
+	assert.Equal(t, "some-app", database.GetAnnotations()[kubernetes.PulledBy])
+	assert.Equal(t, []metav1.OwnerReference{pull.OwnerReference()}, database.GetOwnerReferences())
+
+	apiKey, err := clientset.CoreV1().Secrets(namespace).Get(ctx, "api-key", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"secret": []byte("some-key")}, apiKey.Data)
+
+	// pulled secrets are left alone by push mode
+	err = syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, "database", "2", projectID, timestamp))
+	assert.EqualError(t, err, "secret database is pulled by SecretPull some-app")
+
+	// other SecretPulls cannot take over pulled secrets
+	other := &kubernetes.SecretPull{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-app", Namespace: namespace},
+		Spec:       kubernetes.SecretPullSpec{Secrets: []kubernetes.SecretPullSource{{Name: "database"}}},
+	}
+	statuses, err = syncer.Pull(ctx, other)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret database is already pulled by SecretPull some-app", statuses[0].Error)
+
+	// secrets no longer named are deleted, and the latest version is pulled without a version
+	pull.Spec.Secrets = []kubernetes.SecretPullSource{{Name: "database", Format: "env"}}
+	statuses, err = syncer.Pull(ctx, pull)
+	assert.NoError(t, err)
+	assert.Equal(t, []kubernetes.SecretPullSourceStatus{{Name: "database", AppliedVersion: "2"}}, statuses)
+
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, "api-key", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	database, err = clientset.CoreV1().Secrets(namespace).Get(ctx, "database", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"USER": []byte("app"), "PASSWORD": []byte("hunter2")}, database.Data)
+}
+
+func TestSynchronizer_Pull_UnmappedNamespace(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other-namespace", Annotations: map[string]string{synchronizer.ProjectIDAnnotation: projectID}}},
+	)
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(nil), clientset, map[string]string{projectID: namespace})
+	pull := &kubernetes.SecretPull{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-app", Namespace: "other-namespace"},
+		Spec:       kubernetes.SecretPullSpec{Secrets: []kubernetes.SecretPullSource{{Name: secretName}}},
+	}
+
+	_, err := syncer.Pull(ctx, pull)
+	assert.EqualError(t, err, "project "+projectID+" is mapped to namespace "+namespace+", not other-namespace")
+}
+
+func TestSynchronizer_RefreshProjectNamespaces(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace, Annotations: map[string]string{synchronizer.ProjectIDAnnotation: projectID}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unmapped-namespace"}},
+	)
+	projectNamespaces := make(map[string]string)
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(nil), clientset, projectNamespaces)
+
+	assert.NoError(t, syncer.RefreshProjectNamespaces(ctx))
+	assert.Equal(t, map[string]string{projectID: namespace}, projectNamespaces)
+}
+
+type shard map[string]bool
+
+func (s shard) Owns(projectID string) bool {
+	return s[projectID]
+}
+
+func TestSynchronizer_Sync_OtherShard(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace, Annotations: map[string]string{synchronizer.ProjectIDAnnotation: projectID}}},
+	)
+	secrets := map[string]fake.Secret{
+		secretName: {Data: []byte("hunter2"), Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, map[string]string{projectID: namespace},
+		synchronizer.WithShard(shard{"other-project": true}))
+
+	err := syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp))
+	assert.NoError(t, err)
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	_, err = syncer.Pull(ctx, &kubernetes.SecretPull{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-app", Namespace: namespace},
+		Spec:       kubernetes.SecretPullSpec{Secrets: []kubernetes.SecretPullSource{{Name: secretName}}},
+	})
+	assert.ErrorIs(t, err, sharding.ErrOtherShard)
+}
+
+func TestSynchronizer_Sync_DeletionPolicyDelayed(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	recorder := record.NewFakeRecorder(100)
+	metadata := &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}
+	secrets := map[string]fake.Secret{secretName: {Data: []byte("hunter2"), Metadata: metadata}}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithEventRecorder(recorder), synchronizer.WithDeletionPolicy(synchronizer.DeletionPolicyDelayed, time.Hour))
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+	managed := func() []corev1.Secret {
+		managed, err := syncer.ManagedSecrets(ctx)
+		assert.NoError(t, err)
+		return managed
+	}
+
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	delete(secrets, secretName)
+	assert.NoError(t, syncer.Sync(ctx, msg))
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	deleteAfter, pending := kubernetes.PendingDeletion(*secret)
+	assert.True(t, pending)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deleteAfter, time.Minute)
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, secret.Data)
+
+	// the secret is kept until the grace period has passed
+	assert.NoError(t, syncer.DeleteExpired(ctx, managed()))
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// the deletion is cancelled when the secret reappears
+	secrets[secretName] = fake.Secret{Data: []byte("hunter2"), Metadata: metadata}
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, secret.GetAnnotations(), kubernetes.DeleteAfter)
+	assert.NotContains(t, secret.GetAnnotations(), kubernetes.DeletionReason)
+
+	events := drainEvents(recorder)
+	assert.Contains(t, events, "Warning DeletionScheduled Will be deleted after "+deleteAfter.UTC().Format(time.RFC3339)+
+		", as the Secret Manager secret has been deleted. Remove the hunter2.nais.io/delete-after annotation to keep it")
+	assert.Contains(t, events, "Normal DeletionCancelled Deletion cancelled, as it is synchronized again")
+
+	// the secret is deleted once the grace period has passed
+	expired := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithDeletionPolicy(synchronizer.DeletionPolicyDelayed, -time.Minute))
+	delete(secrets, secretName)
+	assert.NoError(t, expired.Sync(ctx, msg))
+	assert.NoError(t, expired.DeleteExpired(ctx, managed()))
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestSynchronizer_Sync_DeletionPolicyOrphan(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	secrets := map[string]fake.Secret{
+		secretName: {Data: []byte("hunter2"), Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithDeletionPolicy(synchronizer.DeletionPolicyOrphan, 0))
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	delete(secrets, secretName)
+	assert.NoError(t, syncer.Sync(ctx, msg))
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, kubernetes.IsOwned(*secret))
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, secret.Data)
+}
+
+func TestSynchronizer_Sync_ReleasePolicyStale(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	recorder := record.NewFakeRecorder(100)
+	metadata := &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}
+	secrets := map[string]fake.Secret{secretName: {Data: []byte("hunter2"), Metadata: metadata}}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithEventRecorder(recorder))
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	drainEvents(recorder)
+
+	metadata.Labels = map[string]string{"sync": "false"}
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, kubernetes.IsOwned(*secret))
+	assert.Contains(t, secret.GetAnnotations(), kubernetes.StaleSince)
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, secret.Data)
+
+	// secrets that are already stale are released only once
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	assert.Equal(t, []string{
+		"Normal NoSyncLabel Secret Manager secret some-secret was not synchronized, as it does not have the sync=true label",
+		"Warning Released Released secret some-secret with the stale policy, as the Secret Manager secret no longer has the sync=true label",
+		"Normal NoSyncLabel Secret Manager secret some-secret was not synchronized, as it does not have the sync=true label",
+	}, drainEvents(recorder))
+
+	// the stale mark is removed when the label is added back
+	metadata.Labels = map[string]string{"sync": "true"}
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, secret.GetAnnotations(), kubernetes.StaleSince)
+}
+
+func TestSynchronizer_Sync_ReleasePolicyDelete(t *testing.T) {
+	clientset := kubernetesFake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	recorder := record.NewFakeRecorder(100)
+	metadata := &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true", "versioned": "true"}}
+	secrets := map[string]fake.Secret{secretName: {Data: []byte("hunter2"), Metadata: metadata}}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithEventRecorder(recorder), synchronizer.WithReleasePolicy(synchronizer.ReleasePolicyDelete))
+	msg := fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp)
+
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	_, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName+"-v1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	drainEvents(recorder)
+
+	metadata.Labels = map[string]string{"versioned": "true"}
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName+"-v1", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.Contains(t, drainEvents(recorder),
+		"Warning Released Released secret some-secret with the delete policy, as the Secret Manager secret no longer has the sync=true label")
+}
+
+func TestSynchronizer_Sync_ReleaseLabel(t *testing.T) {
+	clientset := kubernetesFake.NewClientset()
+	metadata := &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}
+	secrets := map[string]fake.Secret{secretName: {Data: []byte("hunter2"), Metadata: metadata}}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithReleasePolicy(synchronizer.ReleasePolicyDelete))
+	msg := fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)
+
+	assert.NoError(t, syncer.Sync(ctx, msg))
+	metadata.Labels = map[string]string{synchronizer.ReleaseLabelKey: "orphan"}
+	assert.NoError(t, syncer.Sync(ctx, msg))
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, kubernetes.IsOwned(*secret))
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, secret.Data)
+}
+
+func TestSynchronizer_Sync_Adopt(t *testing.T) {
+	handmade := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName,
+			Namespace:   namespace,
+			Labels:      map[string]string{"team": "some-team"},
+			Annotations: map[string]string{kubernetes.Adopt: "true"},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"secret": []byte("hunter1"), "old-key": []byte("old-value")},
+	}
+	clientset := kubernetesFake.NewClientset(handmade)
+	recorder := record.NewFakeRecorder(100)
+	secrets := map[string]fake.Secret{
+		secretName: {Data: []byte("hunter2"), Metadata: &secretmanagerpb.Secret{Name: secretName, Labels: map[string]string{"sync": "true"}}},
+	}
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(secrets), clientset, cache,
+		synchronizer.WithEventRecorder(recorder))
+
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "1", projectID, timestamp)))
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, kubernetes.IsOwned(*secret))
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter2")}, secret.Data)
+	assert.Equal(t, "some-team", secret.GetLabels()["team"])
+	assert.Equal(t, kubernetes.DataHash(*handmade), secret.GetAnnotations()[kubernetes.AdoptedDataHash])
+	assert.NotContains(t, secret.GetAnnotations(), kubernetes.Adopt)
+	assert.Equal(t, []string{
+		"Normal Adopted Adopted by hunter2, and updated from version 1 of the Secret Manager secret. The hash of the previous contents is in the hunter2.nais.io/adopted-data-hash annotation",
+	}, drainEvents(recorder))
+
+	// the adopted secret is managed like any other
+	secrets[secretName] = fake.Secret{Data: []byte("hunter3"), Metadata: secrets[secretName].Metadata, Version: "2"}
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, "2", projectID, timestamp)))
+	secret, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"secret": []byte("hunter3")}, secret.Data)
+	assert.Equal(t, "2", secret.GetAnnotations()[kubernetes.SecretVersion])
+	assert.Equal(t, []string{"Normal Updated Updated from version 2 of the Secret Manager secret"}, drainEvents(recorder))
+}
+
+func TestSynchronizer_Sync_AdoptWithoutSecretManagerSecret(t *testing.T) {
+	handmade := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName,
+			Namespace:   namespace,
+			Annotations: map[string]string{kubernetes.Adopt: "true"},
+		},
+		Data: map[string][]byte{"secret": []byte("hunter1")},
+	}
+	clientset := kubernetesFake.NewClientset(handmade)
+	syncer := synchronizer.NewSynchronizer(logger, fake.NewSecretManagerClientWithSecrets(map[string]fake.Secret{}), clientset, cache)
+
+	// secrets waiting to be adopted are not deleted, as they are not managed yet
+	assert.NoError(t, syncer.Sync(ctx, fake.NewPubSubMessage(principalEmail, secretName, secretVersion, projectID, timestamp)))
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, kubernetes.IsOwned(*secret))
+}
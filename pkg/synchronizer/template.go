@@ -0,0 +1,96 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/nais/hunter2/pkg/payload"
+)
+
+const (
+	TemplateKey            = "hunter2-template"
+	TemplateSecretKey      = "hunter2-template-secret"
+	TemplateDataKeyKey     = "hunter2-template-key"
+	DefaultTemplateDataKey = "config"
+)
+
+// TemplateError is returned when a template cannot be found, parsed or rendered.
+type TemplateError struct {
+	Err error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("invalid template: %s", e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// fetchTemplate returns the template for the secret, given inline in the TemplateKey annotation,
+// or as the latest version of the Secret Manager secret named in the TemplateSecretKey annotation.
+// Secrets without a template return an empty string. Missing template secrets are returned as an empty
+// template, so that they are reported as invalid by TemplatePayload rather than retried.
+func (in *Synchronizer) fetchTemplate(ctx context.Context, projectID string, metadata *secretmanagerpb.Secret) (string, error) {
+	templateSecret, ok := metadata.GetAnnotations()[TemplateSecretKey]
+	if !ok {
+		return metadata.GetAnnotations()[TemplateKey], nil
+	}
+
+	in.logger.Debugf("fetching template from secret: %s", templateSecret)
+	raw, err := in.secretManagerClient.GetSecretData(ctx, projectID, templateSecret)
+	if grpcerr, ok := status.FromError(err); ok && grpcerr.Code() == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(raw), nil
+}
+
+// TemplatePayload renders the template for the secret against the payload keys, and adds the result to the payload
+// under the key given by the TemplateDataKeyKey annotation.
+func TemplatePayload(metadata *secretmanagerpb.Secret, text string, data map[string][]byte) (map[string][]byte, error) {
+	annotations := metadata.GetAnnotations()
+	_, inline := annotations[TemplateKey]
+	templateSecret, external := annotations[TemplateSecretKey]
+	switch {
+	case !inline && !external:
+		return data, nil
+	case inline && external:
+		return nil, &TemplateError{Err: fmt.Errorf("only one of the %s and %s annotations can be set", TemplateKey, TemplateSecretKey)}
+	case external && text == "":
+		return nil, &TemplateError{Err: fmt.Errorf("template secret %s not found or empty", templateSecret)}
+	}
+
+	key, ok := annotations[TemplateDataKeyKey]
+	if !ok {
+		key = DefaultTemplateDataKey
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return nil, &InvalidKeyError{Key: key, Reason: strings.Join(errs, "; ")}
+	}
+	if _, ok := data[key]; ok {
+		return nil, &TemplateError{Err: fmt.Errorf("rendered key %q already exists in the payload", key)}
+	}
+
+	rendered, err := payload.Render(key, text, data)
+	if err != nil {
+		return nil, &TemplateError{Err: err}
+	}
+
+	result := make(map[string][]byte, len(data)+1)
+	for k, v := range data {
+		result[k] = v
+	}
+	result[key] = rendered
+
+	return result, nil
+}
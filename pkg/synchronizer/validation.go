@@ -0,0 +1,65 @@
+package synchronizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+// StrictLabelKey enables strict validation of the payload, rejecting duplicate and empty keys.
+const StrictLabelKey = "strict"
+
+// ValidationError is returned when the payload cannot be written to a Kubernetes secret.
+// The reason describes the keys involved, but never the values.
+type ValidationError struct {
+	Status metrics.Status
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid payload: %s", e.Reason)
+}
+
+func secretStrict(metadata *secretmanagerpb.Secret) bool {
+	return secretLabelEnabled(metadata, StrictLabelKey)
+}
+
+// ValidatePayload checks that the payload can be written to a Kubernetes secret, before it is applied.
+// Keys must be valid, and the payload must fit in a secret. Keys with empty values are returned as warnings,
+// or rejected in strict mode.
+func ValidatePayload(data map[string][]byte, strict bool) ([]string, error) {
+	var empty []string
+	size := 0
+	for key, value := range data {
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return nil, &InvalidKeyError{Key: key, Reason: strings.Join(errs, "; ")}
+		}
+		if len(value) == 0 {
+			empty = append(empty, key)
+		}
+		size += len(key) + len(value)
+	}
+	sort.Strings(empty)
+
+	if size > corev1.MaxSecretSize {
+		return nil, &ValidationError{
+			Status: metrics.StatusTooLarge,
+			Reason: fmt.Sprintf("%d bytes in %d keys, more than the limit of %d bytes for a Kubernetes secret", size, len(data), corev1.MaxSecretSize),
+		}
+	}
+
+	if len(empty) == 0 {
+		return nil, nil
+	}
+	reason := fmt.Sprintf("empty value for keys %s", strings.Join(empty, ", "))
+	if strict {
+		return nil, &ValidationError{Status: metrics.StatusEmptyValue, Reason: reason}
+	}
+	return []string{reason}, nil
+}
@@ -0,0 +1,198 @@
+package synchronizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/nais/hunter2/pkg/kubernetes"
+	"github.com/nais/hunter2/pkg/metrics"
+)
+
+const (
+	// VersionedLabelKey enables writing each version of the secret to its own immutable secret, named <name>-v<version>.
+	VersionedLabelKey = "versioned"
+	// RetainLabelKey sets the number of versions to keep for versioned secrets.
+	RetainLabelKey = "retain"
+	DefaultRetain  = 3
+)
+
+// secretRetain returns the number of immutable versions to keep for versioned secrets, or zero for mutable secrets.
+func secretRetain(metadata *secretmanagerpb.Secret, version string) (int, error) {
+	if !secretLabelEnabled(metadata, VersionedLabelKey) {
+		return 0, nil
+	}
+	if _, err := strconv.Atoi(version); err != nil {
+		return 0, &ValidationError{Status: metrics.StatusInvalidData, Reason: fmt.Sprintf("versioned secrets need a version number, got %q", version)}
+	}
+
+	value, ok := metadata.GetLabels()[RetainLabelKey]
+	if !ok {
+		return DefaultRetain, nil
+	}
+	retain, err := strconv.Atoi(value)
+	if err != nil || retain < 1 {
+		return 0, &ValidationError{Status: metrics.StatusInvalidData, Reason: fmt.Sprintf("%s must be a positive number, got %q", RetainLabelKey, value)}
+	}
+	return retain, nil
+}
+
+// createVersionedSecret creates the immutable secret for a version, and moves the current label to it.
+// Versions that already exist are left as they are, as their contents cannot change.
+func (in *Synchronizer) createVersionedSecret(ctx context.Context, secret *corev1.Secret) error {
+	secrets := in.clientset.CoreV1().Secrets(secret.GetNamespace())
+
+	in.logger.Debugf("creating versioned k8s secret '%s'", secret.GetName())
+	created, err := secrets.Create(ctx, secret, metav1.CreateOptions{FieldManager: kubernetes.FieldManager})
+	switch {
+	case errors.IsAlreadyExists(err):
+		in.logger.Debugf("versioned k8s secret '%s' already exists", secret.GetName())
+		err = nil
+	case err == nil:
+		in.eventf(created, corev1.EventTypeNormal, EventReasonCreated, "Created from %s", describeSource(secret))
+	}
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationCreate, metrics.ErrorStatus(err, metrics.StatusError))
+	if err != nil {
+		return err
+	}
+
+	name, _ := kubernetes.IsVersioned(*secret)
+	versions, err := in.versionsOf(ctx, secret.GetNamespace(), name)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := in.resume(ctx, version); err != nil {
+			return err
+		}
+		current := version.GetName() == secret.GetName()
+		if (version.GetLabels()[kubernetes.Current] == "true") == current {
+			continue
+		}
+		if err := in.setCurrent(ctx, version, current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCurrent adds or removes the current label. Labels can be changed on immutable secrets.
+func (in *Synchronizer) setCurrent(ctx context.Context, secret corev1.Secret, current bool) error {
+	var value any
+	if current {
+		value = "true"
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"labels": map[string]any{kubernetes.Current: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = in.clientset.CoreV1().Secrets(secret.GetNamespace()).Patch(ctx, secret.GetName(), types.MergePatchType, patch, metav1.PatchOptions{FieldManager: kubernetes.FieldManager})
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationUpdate, metrics.ErrorStatus(err, metrics.StatusError))
+	if err != nil {
+		return fmt.Errorf("updating current label of %s: %w", secret.GetName(), err)
+	}
+	return nil
+}
+
+// versionsOf returns the versioned secrets for a secret in the namespace.
+func (in *Synchronizer) versionsOf(ctx context.Context, namespace, name string) ([]corev1.Secret, error) {
+	secrets, err := in.clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", kubernetes.CreatedBy, kubernetes.CreatedByValue),
+	})
+	if err != nil {
+		metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationRead, metrics.StatusError)
+		return nil, fmt.Errorf("listing versions of %s: %w", name, err)
+	}
+
+	var versions []corev1.Secret
+	for _, secret := range secrets.Items {
+		if versionOf, ok := kubernetes.IsVersioned(secret); ok && versionOf == name {
+			versions = append(versions, secret)
+		}
+	}
+	return versions, nil
+}
+
+// deleteVersionedSecrets deletes all versioned secrets for a secret in the namespace.
+func (in *Synchronizer) deleteVersionedSecrets(ctx context.Context, namespace, name, why string) error {
+	versions, err := in.versionsOf(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := in.deleteVersion(ctx, version, why); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *Synchronizer) deleteVersion(ctx context.Context, secret corev1.Secret, why string) error {
+	in.logger.Debugf("deleting versioned k8s secret '%s'", secret.GetName())
+	err := in.clientset.CoreV1().Secrets(secret.GetNamespace()).Delete(ctx, secret.GetName(), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	metrics.LogRequest(metrics.SystemKubernetes, metrics.OperationDelete, metrics.ErrorStatus(err, metrics.StatusError))
+	if err == nil {
+		in.recordNamespaceEvent(ctx, secret.GetNamespace(), corev1.EventTypeNormal, EventReasonDeleted, "Deleted secret %s, as %s", secret.GetName(), why)
+	}
+	return err
+}
+
+// CollectGarbage deletes the oldest versioned secrets among the managed secrets, keeping the newest versions as
+// given by the retain annotation of the newest version, and always keeping the current version.
+func (in *Synchronizer) CollectGarbage(ctx context.Context, managed []corev1.Secret) error {
+	type key struct{ namespace, name string }
+	groups := make(map[key][]corev1.Secret)
+	for _, secret := range managed {
+		if name, ok := kubernetes.IsVersioned(secret); ok && in.ownsNamespace(secret.GetNamespace()) {
+			k := key{namespace: secret.GetNamespace(), name: name}
+			groups[k] = append(groups[k], secret)
+		}
+	}
+
+	var errs []error
+	for _, versions := range groups {
+		sort.Slice(versions, func(i, j int) bool {
+			return versionNumber(versions[i]) > versionNumber(versions[j])
+		})
+
+		retain, err := strconv.Atoi(versions[0].GetAnnotations()[kubernetes.Retain])
+		if err != nil || retain < 1 {
+			retain = DefaultRetain
+		}
+		for _, version := range versions[min(retain, len(versions)):] {
+			if version.GetLabels()[kubernetes.Current] == "true" {
+				continue
+			}
+			in.logger.Infof("deleting versioned k8s secret '%s', as only the newest %d versions are kept", version.GetName(), retain)
+			if err := in.deleteVersion(ctx, version, fmt.Sprintf("only the newest %d versions are kept", retain)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("deleting old versions: %v", errs)
+	}
+	return nil
+}
+
+func versionNumber(secret corev1.Secret) int {
+	version, _ := strconv.Atoi(secret.GetAnnotations()[kubernetes.SecretVersion])
+	return version
+}